@@ -0,0 +1,221 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+//
+// Items dequeued with DequeueWithAck are checked out rather than removed.
+// Each checked-out item is written to its own single-item segment file in
+// the "inflight" sub-directory of the queue before it is removed from the
+// head of the queue.  Ack deletes that file.  Nack, or re-opening the queue
+// after a crash, puts the item back at the head of the queue.
+//
+
+import (
+	"path"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const inflightDir = "inflight"
+
+// ErrAlreadyAcknowledged is returned when Ack or Nack is called on a token
+// that has already been acknowledged.
+var ErrAlreadyAcknowledged = errors.New("item is already acknowledged")
+
+// AckToken settles an item checked out with DequeueWithAck.
+type AckToken struct {
+	q  *DQue
+	id int
+}
+
+// Ack permanently removes the checked-out item from the queue.
+func (t AckToken) Ack() error {
+	q := t.q
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if _, ok := q.inflight[t.id]; !ok {
+		return ErrAlreadyAcknowledged
+	}
+
+	if err := q.config.fs().Remove(q.inflightPath(t.id)); err != nil {
+		return errors.Wrap(err, "error deleting in-flight item")
+	}
+	delete(q.inflight, t.id)
+	return nil
+}
+
+// Nack returns the checked-out item to the head of the queue so it is the
+// next item dequeued.
+func (t AckToken) Nack() error {
+	q := t.q
+	if err := t.nack(); err != nil {
+		return err
+	}
+	q.signalNotEmpty()
+	return nil
+}
+
+func (t AckToken) nack() error {
+	q := t.q
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	obj, ok := q.inflight[t.id]
+	if !ok {
+		return ErrAlreadyAcknowledged
+	}
+
+	if err := q.firstSegment.prepend([]interface{}{obj}); err != nil {
+		return errors.Wrap(err, "error returning item to the head of the queue")
+	}
+	atomic.AddInt64(&q.count, 1)
+	delete(q.inflight, t.id)
+
+	// If this fails the item is requeued a second time when the queue is
+	// next opened, which is better than losing it.
+	if err := q.config.fs().Remove(q.inflightPath(t.id)); err != nil {
+		return errors.Wrap(err, "error deleting in-flight item")
+	}
+	return nil
+}
+
+// DequeueWithAck checks out the first item in the queue.  The item is no
+// longer returned by Dequeue or Peek, but it isn't permanently removed
+// until the returned token's Ack method is called.  Calling Nack instead
+// returns the item to the head of the queue.  Items that are still checked
+// out when the queue is closed (or the process dies) are returned to the head
+// of the queue when it is next opened, so every item is delivered at least
+// once.
+//
+// Checked-out items are not counted by Size.
+// When the queue is empty, nil and dque.ErrEmpty are returned.  An item
+// checked out when its removal can't be synced, such as when the
+// SyncTimeout option gives up on the sync, is returned with its token
+// along with the error.
+func (q *DQue) DequeueWithAck() (interface{}, AckToken, error) {
+	obj, token, err := q.dequeueWithAck()
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return obj, token, err
+}
+
+func (q *DQue) dequeueWithAck() (interface{}, AckToken, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	id := q.lastInflightID + 1
+	var stored interface{}
+	as := func(seg *qSegment, index int, object interface{}) (interface{}, error) {
+		// The item is kept in its envelope, so Nack returns it with the time
+		// it was first enqueued
+		object, err := seg.resolve(object)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := seg.item(object)
+		if err != nil {
+			return nil, err
+		}
+
+		// Persist the item before removing it from the queue
+		if err := q.writeInflight(id, object); err != nil {
+			return nil, err
+		}
+		stored = object
+		return obj, nil
+	}
+	obj, err := q.dequeueAsLocked(as)
+	if obj == nil {
+		if stored != nil {
+			// The item is still in the queue, so it mustn't be requeued
+			q.config.fs().Remove(q.inflightPath(id))
+		}
+		return nil, AckToken{}, err
+	}
+
+	q.lastInflightID = id
+	if q.inflight == nil {
+		q.inflight = make(map[int]interface{})
+	}
+	q.inflight[id] = stored
+	return obj, AckToken{q: q, id: id}, err
+}
+
+// writeInflight writes a checked-out item to its own file.  Nothing is left
+// behind if it fails.
+func (q *DQue) writeInflight(id int, object interface{}) error {
+	if err := mkdirIfMissing(q.config.fs(), path.Join(q.fullPath, inflightDir), q.config.dirPerm()); err != nil {
+		return errors.Wrap(err, "error creating in-flight directory")
+	}
+	seg, err := newQueueSegment(path.Join(q.fullPath, inflightDir), id, q.turbo, q.builder, &q.config)
+	if err != nil {
+		return errors.Wrap(err, "error creating in-flight item")
+	}
+	err = seg.add(object)
+	if closeErr := seg.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		q.config.fs().Remove(seg.filePath())
+		return errors.Wrap(err, "error writing in-flight item")
+	}
+	return nil
+}
+
+// inflightPath returns the path of the file for the given checked-out item
+func (q *DQue) inflightPath(id int) string {
+	return path.Join(q.fullPath, inflightDir, q.config.segmentFileName(id))
+}
+
+// requeueInflight returns items that were checked out, but never settled,
+// to the head of the queue.  It is called while loading the queue.
+func (q *DQue) requeueInflight() error {
+	dir := path.Join(q.fullPath, inflightDir)
+	if !dirExists(q.config.fs(), dir) {
+		return nil
+	}
+
+	numbers, err := listSegmentNumbers(q.config.fs(), dir, q.config.segmentPattern(), q.config.logf)
+	if err != nil {
+		return err
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	var objects []interface{}
+	for _, num := range numbers {
+		seg, err := openQueueSegment(dir, num, q.turbo, q.builder, &q.config)
+		if err != nil {
+			return errors.Wrap(err, "unable to load in-flight item")
+		}
+		objects = append(objects, seg.objects...)
+		if err := seg.close(); err != nil {
+			return err
+		}
+	}
+
+	if err := q.firstSegment.prepend(objects); err != nil {
+		return errors.Wrap(err, "error returning in-flight items to the head of the queue")
+	}
+
+	for _, num := range numbers {
+		if err := q.config.fs().Remove(path.Join(dir, q.config.segmentFileName(num))); err != nil {
+			return errors.Wrap(err, "error deleting in-flight item")
+		}
+	}
+	return nil
+}
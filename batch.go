@@ -0,0 +1,178 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Batch collects items to be enqueued to one or more queues together.
+// Commit either adds every item to its queue or, if anything goes wrong,
+// none of them.  The zero value is an empty batch ready to use.  A Batch must
+// not be used by more than one goroutine at a time.
+//
+// A batch is atomic with respect to errors and to other goroutines, which
+// never see part of it, but not to crashes: a crash part way through Commit
+// can leave some of the items in some of the queues.  Where that matters,
+// give consumers a way to recognize an item they have already seen.
+type Batch struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	q   *DQue
+	obj interface{}
+}
+
+// tailMark records the end of a queue so items added after it can be
+// removed again.
+type tailMark struct {
+	number    int   // of the last segment
+	items     int   // in the last segment
+	fileBytes int64 // of the last segment
+}
+
+// Add adds an item to be enqueued to q when the batch is committed.
+func (b *Batch) Add(q *DQue, obj interface{}) {
+	b.entries = append(b.entries, batchEntry{q: q, obj: obj})
+}
+
+// Len returns the number of items in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Commit enqueues the items of the batch to their queues in the order they
+// were added, and empties the batch.  Every queue in the batch is locked
+// while its items are written.  If an item can't be enqueued, the items
+// already written are removed again, the error is returned, and the batch
+// is left as it was so Commit can be retried.
+//
+// Queues with SetMaxSegments can't be in a batch, because the items they
+// discard to make room can't be put back.
+func (b *Batch) Commit() error {
+	// Check every item before anything is written
+	var queues []*DQue
+	counts := make(map[*DQue]int64)
+	for i, e := range b.entries {
+		if err := e.q.checkItem(e.obj); err != nil {
+			return errors.Wrapf(err, "batch item %d can't be enqueued", i)
+		}
+		if counts[e.q] == 0 {
+			queues = append(queues, e.q)
+		}
+		counts[e.q]++
+	}
+
+	// Always lock queues in the same order so two batches can't deadlock
+	sort.Slice(queues, func(i, j int) bool { return queues[i].fullPath < queues[j].fullPath })
+	err := b.commitLocked(queues)
+	for _, q := range queues {
+		q.notifySegmentsComplete()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, q := range queues {
+		atomic.AddInt64(&q.count, counts[q])
+		q.signalNotEmpty()
+		q.observeEnqueueN(int(counts[q]))
+	}
+	b.entries = nil
+	return nil
+}
+
+// commitLocked writes the items of the batch with every queue locked.
+func (b *Batch) commitLocked(queues []*DQue) error {
+	marks := make(map[*DQue]tailMark)
+	for _, q := range queues {
+		q.lockAll()
+		defer q.unlockAll()
+
+		if q.fileLock == nil {
+			return ErrQueueClosed
+		}
+		if q.config.readOnly {
+			return ErrReadOnly
+		}
+		if q.shuttingDown {
+			return ErrShuttingDown
+		}
+		if q.maxSegments > 0 {
+			return errors.New("a batch can't enqueue to a queue with a maximum number of segments")
+		}
+		marks[q] = tailMark{number: q.lastSegment.number, items: q.lastSegment.size(), fileBytes: q.lastSegment.fileBytes}
+	}
+
+	for i, e := range b.entries {
+		err := e.q.rollLastSegment()
+		if err == nil {
+			err = e.q.lastSegment.add(e.obj)
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "error enqueueing batch item %d", i)
+			for _, q := range queues {
+				if rbErr := q.rollbackTail(marks[q]); rbErr != nil {
+					return errors.Wrapf(rbErr, "error removing the items of a failed batch (%v). Queue %s is in an inconsistent state", err, q.fullPath)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackTail removes every item added to the end of the queue since the
+// mark, deleting the segments created for them.  Both locks must be held.
+func (q *DQue) rollbackTail(m tailMark) error {
+	q.invalidateReadAhead()
+	for num := q.lastSegment.number; num > m.number; num-- {
+		var err error
+		if num == q.lastSegment.number {
+			err = q.lastSegment.close()
+		}
+		if err == nil {
+			err = q.config.fs().Remove(path.Join(q.fullPath, q.config.segmentFileName(num)))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error deleting queue segment %d", num)
+		}
+		q.config.observer.segmentDeleted(num)
+	}
+
+	// The mark's segment is no longer complete
+	for i, num := range q.completed {
+		if num >= m.number {
+			q.completed = q.completed[:i]
+			break
+		}
+	}
+
+	switch m.number {
+	case q.lastSegment.number:
+		return q.lastSegment.cutBack(m.items, m.fileBytes)
+	case q.firstSegment.number:
+		q.lastSegment = q.firstSegment
+		return q.lastSegment.cutBack(m.items, m.fileBytes)
+	}
+
+	// The old last segment was closed when the next one was created
+	if err := q.config.fs().Truncate(path.Join(q.fullPath, q.config.segmentFileName(m.number)), m.fileBytes); err != nil {
+		return errors.Wrapf(err, "unable to truncate segment %d", m.number)
+	}
+	seg, err := openQueueSegment(q.fullPath, m.number, q.turbo, q.builder, &q.config)
+	if err != nil {
+		return errors.Wrapf(err, "error opening queue segment %d", m.number)
+	}
+	q.lastSegment = seg
+	return nil
+}
@@ -33,11 +33,22 @@ func BenchmarkEnqueue_Turbo(b *testing.B) {
 	benchmarkEnqueue(b, true /* true=turbo */)
 }
 
+// BenchmarkEnqueue_Gzip reports the allocations of enqueueing to a
+// compressed queue, which reuses its gzip writers.
+func BenchmarkEnqueue_Gzip(b *testing.B) {
+	benchmarkEnqueueWithOptions(b, true /* true=turbo */, dque.Options{Compression: dque.CompressionGzip})
+}
+
 func benchmarkEnqueue(b *testing.B, turbo bool) {
+	benchmarkEnqueueWithOptions(b, turbo, dque.Options{})
+}
+
+func benchmarkEnqueueWithOptions(b *testing.B, turbo bool, opts dque.Options) {
 
 	qName := "testBenchEnqueue"
 
 	b.StopTimer()
+	b.ReportAllocs()
 
 	// Clean up from a previous run
 	if err := os.RemoveAll(qName); err != nil {
@@ -45,17 +56,18 @@ func benchmarkEnqueue(b *testing.B, turbo bool) {
 	}
 
 	// Create the queue
-	q, err := dque.New(qName, ".", 100, item3Builder)
+	q, err := dque.NewWithOptions(qName, ".", 100, item3Builder, opts)
 	if err != nil {
 		b.Fatal("Error creating new dque:", err)
 	}
+	defer q.Close()
 	if turbo {
 		_ = q.TurboOn()
 	}
 	b.StartTimer()
 
 	for n := 0; n < b.N; n++ {
-		err := q.Enqueue(item3{"Short Name", n, true})
+		err := q.Enqueue(&item3{"Short Name", n, true})
 		if err != nil {
 			b.Fatal("Error enqueuing to dque:", err)
 		}
@@ -90,6 +102,7 @@ func benchmarkDequeue(b *testing.B, turbo bool) {
 	if err != nil {
 		b.Fatal("Error creating new dque", err)
 	}
+	defer q.Close()
 	var iterations int = 5000
 	if turbo {
 		_ = q.TurboOn()
@@ -97,7 +110,7 @@ func benchmarkDequeue(b *testing.B, turbo bool) {
 	}
 
 	for i := 0; i < iterations; i++ {
-		err := q.Enqueue(item3{"Sorta, kind of, a Big Long Name", i, true})
+		err := q.Enqueue(&item3{"Sorta, kind of, a Big Long Name", i, true})
 		if err != nil {
 			b.Fatal("Error enqueuing to dque:", err)
 		}
@@ -116,3 +129,71 @@ func benchmarkDequeue(b *testing.B, turbo bool) {
 		b.Fatal("Error removing queue directory for BenchmarkDequeue", err)
 	}
 }
+
+func BenchmarkProducerConsumer_Safe(b *testing.B) {
+	benchmarkProducerConsumer(b, false /* true=turbo */)
+}
+func BenchmarkProducerConsumer_Turbo(b *testing.B) {
+	benchmarkProducerConsumer(b, true /* true=turbo */)
+}
+
+// benchmarkProducerConsumer has one goroutine enqueueing while another
+// dequeues from a backlog, which is the most common way a queue is shared.
+// The backlog keeps the producer and the consumer on different segments.
+func benchmarkProducerConsumer(b *testing.B, turbo bool) {
+
+	qName := "testBenchProducerConsumer"
+
+	b.StopTimer()
+
+	// Clean up from a previous run
+	if err := os.RemoveAll(qName); err != nil {
+		b.Fatal("Error removing queue directory:", err)
+	}
+
+	// Create the queue
+	q, err := dque.New(qName, ".", 100, item3Builder)
+	if err != nil {
+		b.Fatal("Error creating new dque:", err)
+	}
+	if turbo {
+		_ = q.TurboOn()
+	}
+
+	// Build a backlog big enough that the consumer never catches up
+	for n := 0; n < b.N; n++ {
+		if err := q.Enqueue(&item3{"Short Name", n, true}); err != nil {
+			b.Fatal("Error enqueuing to dque:", err)
+		}
+	}
+	b.StartTimer()
+
+	done := make(chan error)
+	go func() {
+		for n := 0; n < b.N; n++ {
+			if err := q.Enqueue(&item3{"Short Name", n, true}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for n := 0; n < b.N; n++ {
+		_, err := q.Dequeue()
+		if err != nil {
+			b.Fatal("Error dequeuing from dque:", err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal("Error enqueuing to dque:", err)
+	}
+
+	b.StopTimer()
+	q.Close()
+
+	// Clean up from the run
+	if err := os.RemoveAll(qName); err != nil {
+		b.Fatal("Error removing queue directory for BenchmarkProducerConsumer:", err)
+	}
+}
@@ -0,0 +1,58 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer kept for reuse, so one huge item
+// doesn't pin its memory for the life of the process.
+const maxPooledBuffer = 64 << 10
+
+// removalMarker is the record length of zero appended to a segment file
+// for each item removed from it.
+var removalMarker [4]byte
+
+// bufferPool holds the buffers items are encoded into, so enqueueing
+// doesn't allocate new ones for every item.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// gzipWriterPool holds gzip writers, which are costly to create, for
+// compressing items.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(ioutil.Discard) },
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buff := bufferPool.Get().(*bytes.Buffer)
+	buff.Reset()
+	return buff
+}
+
+// putBuffer gives a buffer back to the pool.  Nothing may use its bytes
+// afterwards.
+func putBuffer(buff *bytes.Buffer) {
+	if buff.Cap() > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buff)
+}
+
+// getGzipWriter returns a gzip writer from the pool that writes to buff.
+// It is given back with gzipWriterPool.Put once closed.
+func getGzipWriter(buff *bytes.Buffer) *gzip.Writer {
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	zw.Reset(buff)
+	return zw
+}
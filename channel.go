@@ -0,0 +1,112 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// errCanceled stops the goroutine started by Channel from waiting for an item
+var errCanceled = errors.New("channel is canceled")
+
+// Channel starts a goroutine that dequeues items and sends them on the
+// returned channel, which buffers up to bufSize items.  This allows
+//
+//	items, cancel := q.Channel(100)
+//	defer cancel()
+//	for item := range items {
+//		...
+//	}
+//
+// The channel is closed when the queue is closed, when an item can't be
+// dequeued, or when the returned cancel function is called.  Items are
+// dequeued before they are sent, so items still buffered in the channel are
+// no longer in the queue.  An item that was dequeued but could not be sent
+// before cancel was called is put back at the head of the queue.  cancel
+// waits for the goroutine to exit and may be called more than once.
+func (q *DQue) Channel(bufSize int) (<-chan interface{}, func()) {
+	ch := make(chan interface{}, bufSize)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	// canceled is guarded by the head lock
+	canceled := false
+
+	// Wake the goroutine if it is waiting for an item when cancel is called
+	go func() {
+		select {
+		case <-done:
+		case <-exited:
+			return
+		}
+		q.mutex.Lock()
+		canceled = true
+		q.emptyCond.Broadcast()
+		q.mutex.Unlock()
+	}()
+
+	go func() {
+		defer close(exited)
+		defer close(ch)
+		for {
+			q.mutex.Lock()
+			obj, _ := q.waitLocked(q.dequeueLocked, &canceled, errCanceled)
+			q.mutex.Unlock()
+			// An item is handed over even if its removal wasn't synced
+			if obj == nil {
+				return
+			}
+			q.observeDequeue()
+
+			select {
+			case ch <- obj:
+			case <-done:
+				// Don't lose the item we are holding.  There is nobody to
+				// report a failure to, and it only fails if the queue has
+				// been closed or the segment can't be rewritten.
+				_ = q.putBack(obj)
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+	return ch, cancel
+}
+
+// putBack returns a dequeued item to the head of the queue.
+func (q *DQue) putBack(obj interface{}) error {
+	if err := q.putBackLocked(obj); err != nil {
+		return err
+	}
+	q.signalNotEmpty()
+	return nil
+}
+
+func (q *DQue) putBackLocked(obj interface{}) error {
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return ErrReadOnly
+	}
+	if err := q.firstSegment.prepend([]interface{}{obj}); err != nil {
+		return errors.Wrap(err, "error returning item to the head of the queue")
+	}
+	atomic.AddInt64(&q.count, 1)
+	return nil
+}
@@ -0,0 +1,92 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+//
+// Dequeued items are normally recorded by appending a removal marker, a
+// record length of zero, to the segment file for each item.  With
+// Options.CheckpointEvery, segments are created with headerFlagCheckpoints
+// set and their removals are recorded by an occasional checkpoint instead:
+//
+//   bytes 0-3   checkpointMarker, a record length no item can have
+//   bytes 4-7   the number of items removed from the file since it was
+//               written (little endian)
+//
+// The count covers every removal before it, so a checkpoint stands in for
+// any removal markers it follows.  Loading a segment understands both.
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	checkpointMarker = math.MaxUint32
+	checkpointSize   = 8
+)
+
+// checkpointing returns true if removals from the segment are recorded by
+// checkpoints rather than a marker per item.
+func (seg *qSegment) checkpointing() bool {
+	return seg.cfg.checkpointEvery > 0 && seg.header.checkpoints
+}
+
+// writeCheckpoint appends a checkpoint recording that the given number of
+// items have been removed from the segment, without syncing it.  The
+// segment mutex must be held.
+func (seg *qSegment) writeCheckpoint(removed int) error {
+	b := make([]byte, checkpointSize)
+	binary.LittleEndian.PutUint32(b, checkpointMarker)
+	binary.LittleEndian.PutUint32(b[4:], uint32(removed))
+
+	if _, err := seg.file.Write(b); err != nil {
+		seg.undoWrite()
+		return diskError(err, fmt.Sprintf("failed to write checkpoint to segment %d", seg.number))
+	}
+	seg.fileBytes += checkpointSize
+	seg.uncheckpointed = 0
+	return nil
+}
+
+// checkpoint records the removals from the segment that no checkpoint has
+// recorded yet.
+func (seg *qSegment) checkpoint() error {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	if seg.uncheckpointed == 0 {
+		return nil
+	}
+	if err := seg.writeCheckpoint(seg.removeCount); err != nil {
+		return err
+	}
+
+	// Possibly force writes to disk
+	return seg._sync()
+}
+
+// applyCheckpoint removes the items a checkpoint read from the file at the
+// given offset records as removed, beyond those already removed.  The
+// segment mutex must be held.
+func (seg *qSegment) applyCheckpoint(removed int, offset int64) error {
+	if removed < seg.removeCount || removed > seg.removeCount+len(seg.objects) {
+		return ErrCorruptedSegment{
+			Path:   seg.filePath(),
+			Offset: offset,
+			Err:    fmt.Errorf("checkpoint of %d removals after %d of %d items", removed, seg.removeCount, seg.removeCount+len(seg.objects)),
+		}
+	}
+	for seg.removeCount < removed {
+		seg.dropFirst()
+		seg.removeCount++
+	}
+	return nil
+}
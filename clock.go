@@ -0,0 +1,29 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"time"
+)
+
+// Clock tells the time-based features of a queue, such as TTLs, scheduled
+// delivery, the dedup window, OldestItemAge, and Rates, what time it is.
+// Set Options.Clock to control it, such as to test code that uses those
+// features without waiting.  Timers, such as the timeouts of the blocking
+// methods, always run on real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the current time from the queue's clock, which is the system
+// clock unless another one was set.
+func (c *config) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
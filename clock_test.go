@@ -0,0 +1,215 @@
+package dque
+
+//
+// White box testing of the clock used by time-based features.
+//
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	qName := "testClock"
+	os.RemoveAll(qName)
+	defer os.RemoveAll(qName)
+
+	q, err := New(qName, ".", 3, item1Builder)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	defer q.Close()
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q.config.clock = clock
+
+	// An item expires once the clock passes its TTL
+	q.SetTTL(time.Hour)
+	if err := q.Enqueue(&item1{Name: "expires"}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	clock.advance(2 * time.Hour)
+	_, err = q.Dequeue()
+	assert(t, ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	assert(t, 1 == q.Stats().ExpiredCount, "Expected 1 expired item but got %d", q.Stats().ExpiredCount)
+	q.SetTTL(0)
+
+	// A scheduled item is delivered once the clock reaches its time
+	if err := q.EnqueueAt(&item1{Name: "scheduled"}, clock.Now().Add(time.Hour)); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	_, err = q.Dequeue()
+	assert(t, ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	clock.advance(time.Hour)
+	obj, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, "scheduled" == obj.(*item1).Name, "Expected the scheduled item but got %s", obj.(*item1).Name)
+}
+
+func TestClock_OldestItemAge(t *testing.T) {
+	qName := "testOldestItemAge"
+	os.RemoveAll(qName)
+	defer os.RemoveAll(qName)
+
+	q, err := New(qName, ".", 3, item1Builder)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	defer q.Close()
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q.config.clock = clock
+
+	_, err = q.OldestItemAge()
+	assert(t, ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+
+	for _, name := range []string{"first", "second"} {
+		if err := q.Enqueue(&item1{Name: name}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		clock.advance(time.Minute)
+	}
+	age, err := q.OldestItemAge()
+	if err != nil {
+		t.Fatal("Error getting the oldest item's age:", err)
+	}
+	assert(t, 2*time.Minute == age, "Expected an age of 2m but got %s", age)
+
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	age, err = q.OldestItemAge()
+	if err != nil {
+		t.Fatal("Error getting the oldest item's age:", err)
+	}
+	assert(t, time.Minute == age, "Expected an age of 1m but got %s", age)
+}
+
+func TestClock_Nack(t *testing.T) {
+	qName := "testClockNack"
+	os.RemoveAll(qName)
+	defer os.RemoveAll(qName)
+
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q, err := NewWithOptions(qName, ".", 3, item1Builder, Options{Clock: clock})
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	if err := q.Enqueue(&item1{Name: "first"}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	clock.advance(time.Hour)
+
+	// A returned item keeps the time it was first enqueued
+	_, token, err := q.DequeueWithAck()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	clock.advance(time.Minute)
+	if err := token.Nack(); err != nil {
+		t.Fatal("Error returning item:", err)
+	}
+	age, err := q.OldestItemAge()
+	assert(t, err == nil && time.Hour+time.Minute == age, "Expected an age of 1h1m but got %s, %v", age, err)
+
+	// So does one still checked out when the queue is closed
+	if _, _, err := q.DequeueWithAck(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	q.Close()
+	q, err = OpenWithOptions(qName, ".", 3, item1Builder, Options{Clock: clock})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	defer q.Close()
+	age, err = q.OldestItemAge()
+	assert(t, err == nil && time.Hour+time.Minute == age, "Expected an age of 1h1m after opening but got %s, %v", age, err)
+}
+
+func TestClock_Rates(t *testing.T) {
+	qName := "testClockRates"
+	os.RemoveAll(qName)
+	defer os.RemoveAll(qName)
+
+	q, err := New(qName, ".", 3, item1Builder)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q.config.clock = clock
+	q.rates.start(clock.Now())
+
+	// The first sample is the rate since the queue was opened
+	for i := 0; i < 60; i++ {
+		if err := q.Enqueue(&item1{Name: "item"}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	clock.advance(time.Minute)
+	enqueueRate, dequeueRate := q.Rates()
+	assert(t, 1 == enqueueRate, "Expected 1 enqueue per second but got %v", enqueueRate)
+	assert(t, 0 == dequeueRate, "Expected no dequeues but got %v", dequeueRate)
+
+	// Later samples move the averages towards the latest rates
+	for i := 0; i < 30; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	clock.advance(time.Minute)
+	enqueueRate, dequeueRate = q.Rates()
+	assert(t, enqueueRate > 0.36 && enqueueRate < 0.37, "Expected about 0.37 enqueues per second but got %v", enqueueRate)
+	assert(t, dequeueRate > 0.31 && dequeueRate < 0.32, "Expected about 0.32 dequeues per second but got %v", dequeueRate)
+
+	// A closed queue has no rates
+	q.Close()
+	enqueueRate, dequeueRate = q.Rates()
+	assert(t, 0 == enqueueRate && 0 == dequeueRate, "Expected no rates once closed but got %v and %v", enqueueRate, dequeueRate)
+}
+
+func TestClock_RatesPrepend(t *testing.T) {
+	qName := "testClockRatesPrepend"
+	os.RemoveAll(qName)
+	defer os.RemoveAll(qName)
+
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q, err := NewWithOptions(qName, ".", 3, item1Builder, Options{Clock: clock})
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	defer q.Close()
+
+	// Every prepended item counts as an enqueue
+	items := make([]interface{}, 60)
+	for i := range items {
+		items[i] = &item1{Name: "item"}
+	}
+	if err := q.Prepend(items); err != nil {
+		t.Fatal("Error prepending:", err)
+	}
+	clock.advance(time.Minute)
+	enqueueRate, _ := q.Rates()
+	assert(t, 1 == enqueueRate, "Expected 1 enqueue per second but got %v", enqueueRate)
+}
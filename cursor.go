@@ -0,0 +1,372 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+//
+// A cursor reads every item of the queue independently of Dequeue and of
+// other cursors.  Its position, the number of a segment and the index of the
+// next item among all the items ever written to that segment, is kept in a
+// file of the same name in the "cursors" sub-directory of the queue.
+//
+// Items are read straight from the segment files, including items the queue
+// has already dequeued, so a segment file is kept until both the head of the
+// queue and every cursor have moved past it.
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const cursorDir = "cursors"
+
+// Cursor reads the items of a queue in order without removing them.  Create
+// one with DQue.NewCursor.
+//
+// Rewriting a segment, which Compact, RemoveWhere, Nack, and reopening a
+// queue with unacknowledged items do, changes the index of the items in it,
+// so a cursor positioned in that segment may skip or repeat items.
+type Cursor struct {
+	q        *DQue
+	name     string
+	segment  int           // number of the segment holding the next item
+	index    int           // index of the next item among all items written to the segment
+	objects  []interface{} // items read from the segment
+	complete bool          // objects holds every item of the segment
+}
+
+// NewCursor returns the named cursor of the queue.  A new cursor starts at
+// the head of the queue.  An existing cursor, including one created before
+// the queue was last opened, continues from where it was.  Every call with
+// the same name returns the same *Cursor.
+func (q *DQue) NewCursor(name string) (*Cursor, error) {
+	if len(name) == 0 || strings.ContainsAny(name, `/\`) || strings.HasSuffix(name, ".tmp") {
+		return nil, errors.New("the cursor name must be a valid file name: " + name)
+	}
+
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return nil, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if c, ok := q.cursors[name]; ok {
+		return c, nil
+	}
+
+	// Start with the first item that is still in the queue
+	c := &Cursor{q: q, name: name, segment: q.firstSegment.number, index: q.firstSegment.removeCount}
+	if err := mkdirIfMissing(q.config.fs(), path.Join(q.fullPath, cursorDir), q.config.dirPerm()); err != nil {
+		return nil, errors.Wrap(err, "error creating cursor directory")
+	}
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	if q.cursors == nil {
+		q.cursors = make(map[string]*Cursor)
+	}
+	q.cursors[name] = c
+	return c, nil
+}
+
+// DeleteCursor deletes the named cursor so it no longer keeps segment files
+// from being deleted.
+func (q *DQue) DeleteCursor(name string) error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return ErrReadOnly
+	}
+	if _, ok := q.cursors[name]; !ok {
+		return errors.New("cursor does not exist: " + name)
+	}
+
+	if err := q.config.fs().Remove(q.cursorPath(name)); err != nil {
+		return errors.Wrap(err, "error deleting cursor "+name)
+	}
+	delete(q.cursors, name)
+	return q.releaseSegments()
+}
+
+// Name returns the name of the cursor.
+func (c *Cursor) Name() string {
+	return c.name
+}
+
+// Next returns the item at the cursor and moves the cursor past it.
+// When the cursor has read every item, nil and dque.ErrEmpty are returned.
+func (c *Cursor) Next() (interface{}, error) {
+	q := c.q
+
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	obj, err := c.peekLocked()
+	if err != nil {
+		return nil, err
+	}
+	c.index++
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Peek returns the item at the cursor without moving the cursor.
+// When the cursor has read every item, nil and dque.ErrEmpty are returned.
+func (c *Cursor) Peek() (interface{}, error) {
+	q := c.q
+
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	return c.peekLocked()
+}
+
+// peekLocked returns the item at the cursor, moving to the next segment if
+// the cursor has read all of the current one.  Both locks must be held.
+func (c *Cursor) peekLocked() (interface{}, error) {
+	q := c.q
+	if q.fileLock == nil {
+		return nil, ErrQueueClosed
+	}
+	if q.cursors[c.name] != c {
+		return nil, errors.New("cursor has been deleted: " + c.name)
+	}
+
+	for {
+		// Items may have been added since the segment was read, unless it
+		// was already followed by another segment
+		if c.index >= len(c.objects) && !c.complete {
+			complete := c.segment < q.lastSegment.number
+			if err := c.readSegment(); err != nil {
+				return nil, err
+			}
+			c.complete = complete
+		}
+		if c.index < len(c.objects) {
+			return c.objects[c.index], nil
+		}
+		if !c.complete {
+			return nil, ErrEmpty
+		}
+
+		// Move to the next segment and let go of this one
+		if err := c.moveTo(c.segment+1, 0); err != nil {
+			return nil, err
+		}
+		if err := q.releaseSegments(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readSegment reads every item written to the cursor's segment.  A segment
+// missing from disk has no items.
+func (c *Cursor) readSegment() error {
+	q := c.q
+	seg := qSegment{dirPath: q.fullPath, number: c.segment, objectBuilder: q.builder, cfg: &q.config}
+	if !fileExists(q.config.fs(), seg.filePath()) {
+		c.objects = []interface{}{}
+		return nil
+	}
+
+	objects, err := seg.readAll()
+	if err != nil {
+		return errors.Wrap(err, "error reading segment for cursor "+c.name)
+	}
+	c.objects = objects
+	return nil
+}
+
+// moveTo moves the cursor to the given position.
+func (c *Cursor) moveTo(segment int, index int) error {
+	c.segment = segment
+	c.index = index
+	c.objects = nil
+	c.complete = false
+	return c.save()
+}
+
+// save writes the position of the cursor to disk.
+func (c *Cursor) save() error {
+	q := c.q
+	data := []byte(fmt.Sprintf("%d %d\n", c.segment, c.index))
+	tmpPath := q.cursorPath(c.name) + ".tmp"
+	if q.turbo {
+		if err := writeFile(q.config.fs(), tmpPath, data, q.config.filePerm()); err != nil {
+			return err
+		}
+	} else if err := writeFileSync(q.config.fs(), tmpPath, data, q.config.filePerm()); err != nil {
+		return err
+	}
+	if err := q.config.fs().Rename(tmpPath, q.cursorPath(c.name)); err != nil {
+		return errors.Wrap(err, "error writing cursor "+c.name)
+	}
+	return nil
+}
+
+// cursorPath returns the path of the file holding the position of the named cursor
+func (q *DQue) cursorPath(name string) string {
+	return path.Join(q.fullPath, cursorDir, name)
+}
+
+// loadCursors reads the position of every cursor so segment files still
+// needed by a cursor aren't deleted.  It is called while loading the queue.
+func (q *DQue) loadCursors() error {
+	dir := path.Join(q.fullPath, cursorDir)
+	if !dirExists(q.config.fs(), dir) {
+		return nil
+	}
+
+	files, err := q.config.fs().ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "unable to read files in "+dir)
+	}
+	q.cursors = make(map[string]*Cursor)
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		data, err := readFile(q.config.fs(), path.Join(dir, f.Name()))
+		if err != nil {
+			return errors.Wrap(err, "error reading cursor "+f.Name())
+		}
+		var segment, index int
+		if _, err := fmt.Sscanf(string(data), "%d %d", &segment, &index); err != nil {
+			return errors.Wrap(err, "error reading cursor "+f.Name())
+		}
+		q.cursors[f.Name()] = &Cursor{q: q, name: f.Name(), segment: segment, index: index}
+	}
+	return nil
+}
+
+// resetCursors moves every cursor to the start of the given segment.  It is
+// used when every segment before it has been deleted.
+func (q *DQue) resetCursors(segment int) error {
+	for _, c := range q.cursors {
+		if err := c.moveTo(segment, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentRetained returns true if a cursor still needs the given segment.
+func (q *DQue) segmentRetained(number int) bool {
+	for _, c := range q.cursors {
+		if c.segment <= number {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseSegments deletes the segment files kept for cursors that every
+// cursor has moved past.  Both locks must be held.
+func (q *DQue) releaseSegments() error {
+	numbers, err := listSegmentNumbers(q.config.fs(), q.fullPath, q.config.segmentPattern(), q.config.logf)
+	if err != nil {
+		return err
+	}
+	removed := false
+	for _, num := range numbers {
+		if num >= q.firstSegment.number || q.segmentRetained(num) {
+			break
+		}
+		if err := q.config.removeSegmentFile(path.Join(q.fullPath, q.config.segmentFileName(num))); err != nil {
+			return errors.Wrap(err, "error deleting queue segment")
+		}
+		q.config.observer.segmentDeleted(num)
+		removed = true
+	}
+	if removed && !q.turbo {
+		return syncDir(q.config.fs(), q.fullPath)
+	}
+	return nil
+}
+
+// readAll reads every item written to the segment file, including the ones
+// that have since been removed from the queue.  A partial record at the end
+// of the file is ignored.
+func (seg *qSegment) readAll() ([]interface{}, error) {
+	f, err := seg.cfg.fs().OpenFile(seg.filePath(), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening file: "+seg.filePath())
+	}
+	defer f.Close()
+
+	// An empty file is a new segment that doesn't have its header yet
+	if info, err := f.Stat(); err != nil {
+		return nil, errors.Wrap(err, "error reading file: "+seg.filePath())
+	} else if info.Size() == 0 {
+		return nil, nil
+	}
+	if seg.header, err = readSegmentHeader(f, seg.filePath()); err != nil {
+		return nil, err
+	}
+	if err := seg.cfg.checkKey(seg.header, seg.filePath()); err != nil {
+		return nil, err
+	}
+
+	objects := []interface{}{}
+	for {
+		lenBytes := make([]byte, 4)
+		if _, err := io.ReadFull(f, lenBytes); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return objects, nil
+			}
+			return nil, errors.Wrap(err, "error reading object length")
+		}
+		gobLen := binary.LittleEndian.Uint32(lenBytes)
+		if gobLen == 0 {
+			// Skip removal markers
+			continue
+		}
+		if gobLen == checkpointMarker {
+			// Skip checkpoints and the count they hold
+			if _, err := io.ReadFull(f, lenBytes); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return objects, nil
+				}
+				return nil, errors.Wrap(err, "error reading checkpoint")
+			}
+			continue
+		}
+
+		data := make([]byte, int(gobLen))
+		if _, err := io.ReadFull(f, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return objects, nil
+			}
+			return nil, errors.Wrap(err, "error reading gob data from file")
+		}
+		object, err := seg.decode(data)
+		if err != nil {
+			return nil, ErrUnableToDecode{Path: seg.filePath(), Err: err}
+		}
+		objects = append(objects, unwrap(object))
+	}
+}
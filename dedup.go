@@ -0,0 +1,184 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultDedupItems is the number of keys EnqueueUnique remembers until
+// SetDedupWindow is called.
+const defaultDedupItems = 1000
+
+// dedupFile is the file in the queue's directory that holds the dedup
+// window when Options.PersistDedup is given.  Each line is the time a key
+// was enqueued, in Unix nanoseconds, and the quoted key.
+const dedupFile = "dedup"
+
+// dedupWindow remembers the keys recently given to EnqueueUnique, oldest
+// first.
+type dedupWindow struct {
+	mutex    sync.Mutex // held across the check and the enqueue
+	maxItems int
+	maxAge   time.Duration
+	order    *list.List               // of *dedupKey
+	keys     map[string]*list.Element // into order
+}
+
+type dedupKey struct {
+	key string
+	at  time.Time
+}
+
+// SetDedupWindow sets how long EnqueueUnique remembers a key: for the last
+// items keys and for d, whichever forgets it first.  Either limit can be
+// zero, but not both.  The keys already remembered are kept.  The default
+// window is the last 1000 keys.
+func (q *DQue) SetDedupWindow(items int, d time.Duration) error {
+	if items < 0 || d < 0 || (items == 0 && d == 0) {
+		return errors.New("DQue.SetDedupWindow() requires a positive number of items or duration")
+	}
+
+	w := q.dedup
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.maxItems = items
+	w.maxAge = d
+	w.forget(q.config.now())
+	return nil
+}
+
+// EnqueueUnique adds an item to the end of the queue unless the same key
+// was given to EnqueueUnique within the dedup window, in which case false is
+// returned and nothing is enqueued.  It lets a producer retry an enqueue
+// without knowing whether the last attempt succeeded.  The window is kept in
+// memory, so it starts empty each time the queue is opened, unless
+// Options.PersistDedup is given.
+//
+// An item whose write couldn't be synced, such as when the SyncTimeout
+// option gives up on the sync, is in the queue all the same, so its key is
+// remembered and true is returned along with the error.
+func (q *DQue) EnqueueUnique(key string, obj interface{}) (bool, error) {
+	w := q.dedup
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := q.config.now()
+	w.forget(now)
+	if _, ok := w.keys[key]; ok {
+		return false, nil
+	}
+
+	if err := q.checkItem(obj); err != nil {
+		return false, err
+	}
+	added, err := q.enqueue(obj)
+	if !added {
+		return false, err
+	}
+	q.signalNotEmpty()
+	q.observeEnqueue()
+
+	w.keys[key] = w.order.PushBack(&dedupKey{key: key, at: now})
+	w.forget(now)
+	if q.config.persistDedup {
+		if saveErr := q.saveDedup(); err == nil {
+			err = saveErr
+		}
+	}
+	return true, err
+}
+
+// saveDedup replaces the dedup file with the keys in the window.  The
+// window's mutex must be held.
+func (q *DQue) saveDedup() error {
+	var b bytes.Buffer
+	for e := q.dedup.order.Front(); e != nil; e = e.Next() {
+		k := e.Value.(*dedupKey)
+		fmt.Fprintf(&b, "%d %s\n", k.at.UnixNano(), strconv.Quote(k.key))
+	}
+
+	filePath := path.Join(q.fullPath, dedupFile)
+	tmpPath := filePath + ".tmp"
+	if err := writeFileSync(q.config.fs(), tmpPath, b.Bytes(), q.config.filePerm()); err != nil {
+		return err
+	}
+	if err := q.config.fs().Rename(tmpPath, filePath); err != nil {
+		return errors.Wrap(err, "error writing the dedup window")
+	}
+	return nil
+}
+
+// loadDedup reads the keys saved in the dedup file into the window.  They
+// are forgotten as usual once the window is next checked.  It is called
+// while loading the queue.
+func (q *DQue) loadDedup() error {
+	filePath := path.Join(q.fullPath, dedupFile)
+	data, err := readFile(q.config.fs(), filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reading the dedup window from "+filePath)
+	}
+
+	w := q.dedup
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return errors.Errorf("the dedup window in %s is corrupt", filePath)
+		}
+		at, err := strconv.ParseInt(line[:i], 10, 64)
+		if err != nil {
+			return errors.Errorf("the dedup window in %s is corrupt", filePath)
+		}
+		key, err := strconv.Unquote(line[i+1:])
+		if err != nil {
+			return errors.Errorf("the dedup window in %s is corrupt", filePath)
+		}
+		if _, ok := w.keys[key]; !ok {
+			w.keys[key] = w.order.PushBack(&dedupKey{key: key, at: time.Unix(0, at)})
+		}
+	}
+	return nil
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{
+		maxItems: defaultDedupItems,
+		order:    list.New(),
+		keys:     make(map[string]*list.Element),
+	}
+}
+
+// forget drops the keys that have left the window.  The mutex must be held.
+func (w *dedupWindow) forget(now time.Time) {
+	for e := w.order.Front(); e != nil; e = w.order.Front() {
+		k := e.Value.(*dedupKey)
+		tooMany := w.maxItems > 0 && w.order.Len() > w.maxItems
+		tooOld := w.maxAge > 0 && now.Sub(k.at) >= w.maxAge
+		if !tooMany && !tooOld {
+			return
+		}
+		w.order.Remove(e)
+		delete(w.keys, k.key)
+	}
+}
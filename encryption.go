@@ -0,0 +1,107 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+//
+// When the header of a segment has headerFlagEncrypted set, the data of every
+// record after its 4-byte length, envelope included, is sealed with AES-GCM:
+//
+//   bytes 0-11   random nonce
+//   bytes 12-    ciphertext followed by the 16-byte authentication tag
+//
+// Removal markers are not encrypted.  The reserved bytes of the header hold
+// a short check value derived from the key, so a wrong key is told apart from
+// a corrupted record.
+//
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionKeySize is the size in bytes of the AES-256 keys used to encrypt
+// queues.
+const EncryptionKeySize = 32
+
+const keyCheckSize = 4
+
+// ErrWrongKey is returned when opening an encrypted queue with a key other
+// than the one it was written with, or without a key.  Compare with
+// errors.Is.
+var ErrWrongKey = errors.New("wrong encryption key")
+
+// encryption seals and opens the records of encrypted segments.
+type encryption struct {
+	aead  cipher.AEAD
+	check []byte // stored in segment headers to recognize the key
+}
+
+func newEncryption(key []byte) (*encryption, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, errors.Errorf("the encryption key must be %d bytes, not %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating cipher")
+	}
+	sum := sha256.Sum256(append([]byte("dque key check:"), key...))
+	return &encryption{aead: aead, check: sum[:keyCheckSize]}, nil
+}
+
+// seal encrypts the data of a record.
+func (e *encryption) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(data)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "error generating nonce")
+	}
+	return e.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open decrypts the data of a record sealed by seal.
+func (e *encryption) open(data []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	if len(data) < n+e.aead.Overhead() {
+		return nil, errors.Errorf("encrypted record of %d bytes is too short", len(data))
+	}
+	data, err := e.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decrypting object")
+	}
+	return data, nil
+}
+
+// checkKey returns ErrWrongKey if the segment with the given header can't be
+// read with the queue's key.
+func (c *config) checkKey(h segmentHeader, filePath string) error {
+	if !h.encrypted {
+		return nil
+	}
+	if c.encryption == nil {
+		return errors.Wrap(ErrWrongKey, "segment file "+filePath+" is encrypted but no key was given")
+	}
+	if !bytes.Equal(h.keyCheck, c.encryption.check) {
+		return errors.Wrap(ErrWrongKey, "segment file "+filePath+" was encrypted with another key")
+	}
+	return nil
+}
+
+// NewWithEncryption creates a new durable queue whose items are encrypted
+// with AES-256-GCM using the given 32-byte key.  The same key must be given
+// in Options.EncryptionKey every time the queue is opened.
+func NewWithEncryption(name string, dirPath string, itemsPerSegment int, builder func() interface{}, key []byte) (*DQue, error) {
+	return NewWithOptions(name, dirPath, itemsPerSegment, builder, Options{EncryptionKey: key})
+}
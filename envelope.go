@@ -0,0 +1,204 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+//
+// When the header of a segment has headerFlagEnvelope set, every item in the
+// file is wrapped in a small envelope that carries what dque knows about the
+// item, leaving the encoding of the item itself alone:
+//
+//   byte  0     envelope flags
+//   bytes 1-8   time the item was enqueued in Unix nanoseconds (little endian)
+//   bytes 9-16  only with envelopeFlagNotBefore, the time the item is to be
+//               delivered in Unix nanoseconds (little endian)
+//   1 byte      only with envelopeFlagType, the length of the type tag
+//   then        the type tag, which picks the builder of a multi-type queue
+//   then        the encoded (and possibly compressed) item
+//
+// Items read from such a segment are kept in memory as *envelope so the
+// envelope survives a rewrite of the segment.  They are unwrapped before
+// being handed to the caller.
+//
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	envelopeSize          = 9
+	envelopeFlagNotBefore = 1 // the envelope holds a delivery time
+	envelopeFlagType      = 2 // the envelope holds a type tag
+	notBeforeSize         = 8
+	maxTagSize            = 255
+)
+
+// envelope is the in-memory form of an item from a segment with envelopes.
+type envelope struct {
+	obj        interface{}
+	enqueuedAt int64  // Unix nanoseconds
+	notBefore  int64  // Unix nanoseconds, zero unless set by EnqueueAt
+	tag        string // the type tag of an item in a multi-type queue
+}
+
+// wrap returns the item in an envelope stamped with the given time, unless
+// it already is in one.
+func wrap(object interface{}, now time.Time) *envelope {
+	if env, ok := object.(*envelope); ok {
+		return env
+	}
+	return &envelope{obj: object, enqueuedAt: now.UnixNano()}
+}
+
+// unwrap returns the item held by an envelope, or the object itself if it
+// isn't in one.
+func unwrap(object interface{}) interface{} {
+	if env, ok := object.(*envelope); ok {
+		return env.obj
+	}
+	return object
+}
+
+// bytes returns the on-disk representation of the envelope, without the item.
+func (env *envelope) bytes() []byte {
+	b := make([]byte, envelopeSize, envelopeSize+notBeforeSize+1+len(env.tag))
+	binary.LittleEndian.PutUint64(b[1:9], uint64(env.enqueuedAt))
+	if env.notBefore != 0 {
+		b[0] |= envelopeFlagNotBefore
+		b = b[:envelopeSize+notBeforeSize]
+		binary.LittleEndian.PutUint64(b[9:17], uint64(env.notBefore))
+	}
+	if env.tag != "" {
+		b[0] |= envelopeFlagType
+		b = append(b, byte(len(env.tag)))
+		b = append(b, env.tag...)
+	}
+	return b
+}
+
+// due returns true if the item can be delivered at now.
+func (env *envelope) due(now int64) bool {
+	return env.notBefore <= now
+}
+
+// readEnvelope reads the envelope at the start of a record and returns it
+// along with the encoded item that follows it.
+func readEnvelope(data []byte) (*envelope, []byte, error) {
+	if len(data) < envelopeSize {
+		return nil, nil, errors.Errorf("record of %d bytes is too short for an envelope", len(data))
+	}
+	flags := data[0]
+	if flags&^(envelopeFlagNotBefore|envelopeFlagType) != 0 {
+		return nil, nil, errors.Errorf("unknown envelope flags %d", flags)
+	}
+	env := &envelope{enqueuedAt: int64(binary.LittleEndian.Uint64(data[1:9]))}
+	data = data[envelopeSize:]
+	if flags&envelopeFlagNotBefore != 0 {
+		if len(data) < notBeforeSize {
+			return nil, nil, errors.Errorf("record of %d bytes is too short for an envelope", envelopeSize+len(data))
+		}
+		env.notBefore = int64(binary.LittleEndian.Uint64(data[:notBeforeSize]))
+		data = data[notBeforeSize:]
+	}
+	if flags&envelopeFlagType != 0 {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, nil, errors.New("record is too short for the type tag in its envelope")
+		}
+		env.tag = string(data[1 : 1+int(data[0])])
+		data = data[1+int(data[0]):]
+	}
+	return env, data, nil
+}
+
+// SetTTL sets how long items stay in the queue.  Dequeue, Peek, and the
+// methods built on them drop expired items from the head of the queue
+// instead of returning them.  Expired items are counted by Size until they
+// are dropped, and are counted in Stats once they are.  A TTL of zero, the
+// default, keeps items forever.
+//
+// Only items enqueued by a version of dque that records enqueue times can
+// expire, and a read-only queue never drops them.
+func (q *DQue) SetTTL(d time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.ttl = d
+}
+
+// OldestItemAge returns how long ago the first item in the queue was
+// enqueued, which shows how far consumers are behind.  For an item
+// enqueued by a version of dque that didn't record enqueue times, the time
+// its segment file was last modified is used instead, which makes the item
+// look younger than it is.  ErrEmpty is returned if the queue is empty.
+func (q *DQue) OldestItemAge() (time.Duration, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.fileLock == nil {
+		return 0, ErrQueueClosed
+	}
+	if q.firstSegment.size() == 0 {
+		return 0, ErrEmpty
+	}
+
+	var enqueuedAt time.Time
+	if nanos, ok := q.firstSegment.firstEnqueuedAt(); ok {
+		enqueuedAt = time.Unix(0, nanos)
+	} else {
+		info, err := q.config.fs().Stat(q.firstSegment.filePath())
+		if err != nil {
+			return 0, errors.Wrap(err, "unable to get the age of segment file "+q.firstSegment.filePath())
+		}
+		enqueuedAt = info.ModTime()
+	}
+
+	if age := q.config.now().Sub(enqueuedAt); age > 0 {
+		return age, nil
+	}
+	return 0, nil
+}
+
+// dropExpiredLocked drops the expired items from the head of the queue.  The
+// head lock must be held.
+func (q *DQue) dropExpiredLocked() error {
+	if q.ttl <= 0 || q.config.readOnly {
+		return nil
+	}
+
+	cutoff := q.config.now().Add(-q.ttl).UnixNano()
+	for {
+		enqueuedAt, ok := q.firstSegment.firstEnqueuedAt()
+		if !ok || enqueuedAt > cutoff {
+			return nil
+		}
+		removed, err := q.firstSegment.discard()
+		if !removed {
+			return errors.Wrap(err, "error removing expired item from the first segment")
+		}
+		q.expired++
+		q.countRemoved(1)
+		var syncErr error
+		if err != nil {
+			// The item is gone from the segment all the same
+			syncErr = errors.Wrap(err, "error syncing the removal of an expired item from the first segment")
+		}
+
+		if q.firstSegment.size() == 0 {
+			q.tailMutex.Lock()
+			err := q.skipEmptyFirstSegments()
+			q.tailMutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if syncErr != nil {
+			return syncErr
+		}
+	}
+}
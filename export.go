@@ -0,0 +1,110 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Export writes every item in the queue, in order, to w as a JSON array,
+// for debugging or for moving the items to a queue with a different
+// on-disk format with Import.  Items are encoded with encoding/json, so
+// only their exported fields are written, and the byte slices of a queue
+// using CodecBytes are written as base64 strings.  Items scheduled with
+// EnqueueAt are written whether or not they are due, without their
+// delivery time.  The queue isn't changed, but nothing can be enqueued or
+// dequeued until Export returns.
+func (q *DQue) Export(w io.Writer) error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.writeOnly {
+		return ErrWriteOnly
+	}
+
+	sep := "[\n"
+	err := q.forEachItem(func(item interface{}) error {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding item of type %T as JSON", item)
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		sep = ",\n"
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[\n" {
+		_, err = io.WriteString(w, "[]\n")
+	} else {
+		_, err = io.WriteString(w, "\n]\n")
+	}
+	return err
+}
+
+// Import enqueues the items of a JSON array written by Export, decoding
+// each one into an item made by the queue's builder.  Items are enqueued
+// as they are read, so if Import fails part way through, the items before
+// the one that failed stay enqueued.  A multi-type queue can't import
+// items, since the JSON doesn't hold their types.
+func (q *DQue) Import(r io.Reader) error {
+	if q.config.builders != nil {
+		return errors.New("DQue.Import() can't tell the types of the items of a multi-type queue")
+	}
+
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return errors.Wrap(err, "error reading the JSON array of items")
+	} else if tok != json.Delim('[') {
+		return errors.Errorf("expected a JSON array of items but found %v", tok)
+	}
+
+	for i := 0; dec.More(); i++ {
+		item, err := q.decodeJSON(dec)
+		if err != nil {
+			return errors.Wrapf(err, "error decoding item %d", i)
+		}
+		if err := q.Enqueue(item); err != nil {
+			return errors.Wrapf(err, "error enqueueing item %d", i)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return errors.Wrap(err, "error reading the end of the JSON array of items")
+	}
+	return nil
+}
+
+// decodeJSON decodes the next item from dec into an item of the queue.
+func (q *DQue) decodeJSON(dec *json.Decoder) (interface{}, error) {
+	if q.config.Codec == CodecBytes {
+		var b []byte
+		if err := dec.Decode(&b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	item := q.builder()
+	if failed, ok := item.(builderError); ok {
+		return nil, failed
+	}
+	if err := dec.Decode(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
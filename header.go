@@ -0,0 +1,258 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+//
+// Every segment file starts with a small fixed-size header that records how
+// the items in the file were written:
+//
+//   bytes 0-3    magic "dque"
+//   byte  4      format version
+//   byte  5      codec id
+//   byte  6      compression
+//   byte  7      flags (bit 0: items are wrapped in envelopes, see envelope.go;
+//                bit 1: records are encrypted, see encryption.go;
+//                bit 2: removals may be recorded by checkpoints, see
+//                checkpoint.go)
+//   bytes 8-11   items per segment (little endian)
+//   bytes 12-15  key check of encrypted segments, otherwise reserved (zero)
+//
+// Files written before the header existed begin directly with the 4-byte
+// length of the first item.  Those are rejected with ErrIncompatibleSegment
+// and can be upgraded once with MigrateLegacySegments.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentFormatVersion = 1
+	segmentHeaderSize    = 16
+
+	// Ids of the codecs in segment headers
+	codecGob   = 1
+	codecBytes = 2
+
+	// Flags in segment headers
+	headerFlagEnvelope    = 1
+	headerFlagEncrypted   = 2
+	headerFlagCheckpoints = 4
+)
+
+var segmentMagic = []byte("dque")
+
+// segmentHeader is the in-memory form of a segment file header.
+type segmentHeader struct {
+	version         uint8
+	codec           Codec
+	compression     Compression
+	itemsPerSegment int
+	envelope        bool   // items are wrapped in envelopes
+	encrypted       bool   // records are encrypted
+	checkpoints     bool   // removals may be recorded by checkpoints
+	keyCheck        []byte // recognizes the key of an encrypted segment
+}
+
+// newSegmentHeader returns the header for a new segment of a queue with
+// the given config.
+func newSegmentHeader(cfg *config) segmentHeader {
+	h := segmentHeader{
+		version:         segmentFormatVersion,
+		codec:           cfg.Codec,
+		compression:     cfg.Compression,
+		itemsPerSegment: cfg.ItemsPerSegment,
+		envelope:        true,
+		checkpoints:     cfg.checkpointEvery > 0,
+	}
+	if cfg.encryption != nil {
+		h.encrypted = true
+		h.keyCheck = cfg.encryption.check
+	}
+	return h
+}
+
+// bytes returns the on-disk representation of the header.
+func (h segmentHeader) bytes() []byte {
+	b := make([]byte, segmentHeaderSize)
+	copy(b, segmentMagic)
+	b[4] = h.version
+	b[5] = codecID(h.codec)
+	b[6] = byte(h.compression)
+	if h.envelope {
+		b[7] |= headerFlagEnvelope
+	}
+	if h.encrypted {
+		b[7] |= headerFlagEncrypted
+		copy(b[12:16], h.keyCheck)
+	}
+	if h.checkpoints {
+		b[7] |= headerFlagCheckpoints
+	}
+	binary.LittleEndian.PutUint32(b[8:12], uint32(h.itemsPerSegment))
+	return b
+}
+
+// codecID returns the id of the codec in segment headers
+func codecID(c Codec) uint8 {
+	if c == CodecBytes {
+		return codecBytes
+	}
+	return codecGob
+}
+
+// readSegmentHeader reads the header at the start of r and validates it.
+// ErrIncompatibleSegment is returned if the header is missing or was written
+// by an unknown version of dque.
+func readSegmentHeader(r io.Reader, filePath string) (segmentHeader, error) {
+	b := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return segmentHeader{}, ErrIncompatibleSegment{Path: filePath, Reason: "missing header"}
+		}
+		return segmentHeader{}, errors.Wrap(err, "error reading segment header")
+	}
+	if !bytes.Equal(b[:4], segmentMagic) {
+		return segmentHeader{}, ErrIncompatibleSegment{Path: filePath, Reason: "missing header"}
+	}
+
+	h := segmentHeader{
+		version:         b[4],
+		compression:     Compression(b[6]),
+		itemsPerSegment: int(binary.LittleEndian.Uint32(b[8:12])),
+		envelope:        b[7]&headerFlagEnvelope != 0,
+		encrypted:       b[7]&headerFlagEncrypted != 0,
+		checkpoints:     b[7]&headerFlagCheckpoints != 0,
+		keyCheck:        b[12:16],
+	}
+	if h.version != segmentFormatVersion {
+		return h, ErrIncompatibleSegment{Path: filePath, Reason: fmt.Sprintf("unsupported format version %d", h.version)}
+	}
+	switch b[5] {
+	case codecGob:
+		h.codec = CodecGob
+	case codecBytes:
+		h.codec = CodecBytes
+	default:
+		return h, ErrIncompatibleSegment{Path: filePath, Reason: fmt.Sprintf("unknown codec %d", b[5])}
+	}
+	if h.compression > CompressionGzip {
+		return h, ErrIncompatibleSegment{Path: filePath, Reason: fmt.Sprintf("unknown compression %d", h.compression)}
+	}
+	if b[7]&^(headerFlagEnvelope|headerFlagEncrypted|headerFlagCheckpoints) != 0 {
+		return h, ErrIncompatibleSegment{Path: filePath, Reason: fmt.Sprintf("unknown flags %d", b[7])}
+	}
+	return h, nil
+}
+
+// MigrateLegacySegments adds a header to every segment file of the named queue
+// that was written by a version of dque that predates segment headers.  The
+// queue must not be open while this runs.  The number of upgraded files is
+// returned.
+func MigrateLegacySegments(name string, dirPath string, itemsPerSegment int) (int, error) {
+	return MigrateLegacySegmentsWithOptions(name, dirPath, itemsPerSegment, Options{})
+}
+
+// MigrateLegacySegmentsWithOptions is MigrateLegacySegments for a queue kept
+// with the given options.  The files are found through Options.Storage with
+// Options.SegmentPrefix and Options.SegmentWidth, and what is skipped is
+// logged to Options.Logger.
+func MigrateLegacySegmentsWithOptions(name string, dirPath string, itemsPerSegment int, opts Options) (int, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	if err := opts.validate(); err != nil {
+		return 0, err
+	}
+	fs := opts.storage()
+	fullPath := path.Join(dirPath, name)
+	if !dirExists(fs, fullPath) {
+		return 0, errors.New("the given queue does not exist (" + fullPath + ")")
+	}
+
+	fileLock, err := acquireLock(fs, fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer fileLock.Close()
+
+	cfg := config{ItemsPerSegment: itemsPerSegment, SegmentPrefix: opts.SegmentPrefix, SegmentWidth: opts.SegmentWidth, logger: opts.Logger}
+	numbers, err := listSegmentNumbers(fs, fullPath, cfg.segmentPattern(), cfg.logf)
+	if err != nil {
+		return 0, err
+	}
+
+	header := newSegmentHeader(&cfg)
+	header.envelope = false
+	count := 0
+	for _, number := range numbers {
+		filePath := path.Join(fullPath, cfg.segmentFileName(number))
+		info, err := fs.Stat(filePath)
+		if err != nil {
+			return count, errors.Wrap(err, "error reading file: "+filePath)
+		}
+		data, err := readFile(fs, filePath)
+		if err != nil {
+			return count, errors.Wrap(err, "error reading file: "+filePath)
+		}
+		if len(data) >= 4 && bytes.Equal(data[:4], segmentMagic) {
+			// Already has a header
+			continue
+		}
+
+		// Write the upgraded file beside the original and then swap them
+		tmpPath := filePath + ".tmp"
+		if err := writeFileSync(fs, tmpPath, append(header.bytes(), data...), info.Mode().Perm()); err != nil {
+			return count, err
+		}
+		if err := fs.Rename(tmpPath, filePath); err != nil {
+			return count, errors.Wrap(err, "error replacing file: "+filePath)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// writeFile writes data to a file.  The file is created with the given
+// permission if it does not exist.
+func writeFile(fs Storage, filePath string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return errors.Wrap(err, "error creating file: "+filePath)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "error writing file: "+filePath)
+	}
+	return f.Close()
+}
+
+// writeFileSync writes data to a file and syncs it to disk.  The file is
+// created with the given permission if it does not exist.
+func writeFileSync(fs Storage, filePath string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return errors.Wrap(err, "error creating file: "+filePath)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "error writing file: "+filePath)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "error syncing file: "+filePath)
+	}
+	return f.Close()
+}
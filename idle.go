@@ -0,0 +1,351 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// openFiles keeps the segment files opened by openSegmentFile that may be
+// closed while unused, because they have gone idle or to stay within the
+// limit set with SetMaxOpenSegments.
+var openFiles = newFileLimiter()
+
+// fileLimiter keeps track of the open managed files of every queue in the
+// process.  Its mutex guards them as well.
+type fileLimiter struct {
+	mutex sync.Mutex
+	freed *sync.Cond // signalled when a file is closed or stops being used
+	max   int        // zero for no limit
+	open  int        // number of managed files holding an open file
+	lru   *list.List // managed files holding an open file, least recently used first
+}
+
+func newFileLimiter() *fileLimiter {
+	l := &fileLimiter{lru: list.New()}
+	l.freed = sync.NewCond(&l.mutex)
+	return l
+}
+
+// SetMaxOpenSegments limits the number of segment files held open at once
+// by all the queues of the process, so that many queues can't run it out of
+// file descriptors.  Once the limit is reached, opening another segment
+// file closes the least recently used one, which is opened again when it is
+// next used.  If every open segment file is being read or written at that
+// moment, opening another one waits for one to be free.  A limit of zero or
+// less, the default, means no limit.
+//
+// The limit only covers segment files opened after it is set, so it should
+// be set before opening any queues.  Lock files aren't counted.
+func SetMaxOpenSegments(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	openFiles.max = n
+	for openFiles.full() && openFiles.closeUnused() {
+	}
+	openFiles.freed.Broadcast()
+}
+
+// limited returns true if a limit on open segment files has been set.
+func (l *fileLimiter) limited() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.max > 0
+}
+
+// full returns true if no more files may be opened.  The mutex must be
+// held.
+func (l *fileLimiter) full() bool {
+	return l.max > 0 && l.open >= l.max
+}
+
+// makeRoom closes the least recently used file that isn't in use if no
+// more files may be opened, or waits for one to be freed if every file is
+// in use.  True is returned if there is room to open a file without the
+// mutex having been released; otherwise the caller must check again.  The
+// mutex must be held.
+func (l *fileLimiter) makeRoom() bool {
+	if !l.full() || l.closeUnused() {
+		return true
+	}
+	l.freed.Wait()
+	return false
+}
+
+// closeUnused closes the least recently used file that isn't in use.  False
+// is returned if every open file is in use.  The mutex must be held.
+func (l *fileLimiter) closeUnused() bool {
+	for e := l.lru.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*managedFile)
+		if m.busy == 0 {
+			if err := l.closeFile(m); err != nil {
+				m.cfg.logf("dque: unable to close segment file %s: %v", m.name, err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// opened records that m holds the open file f.  The mutex must be held.
+func (l *fileLimiter) opened(m *managedFile, f File) {
+	m.f = f
+	m.elem = l.lru.PushBack(m)
+	l.open++
+}
+
+// closeFile closes the file m holds open.  The mutex must be held.
+func (l *fileLimiter) closeFile(m *managedFile) error {
+	err := m.f.Close()
+	m.f = nil
+	l.lru.Remove(m.elem)
+	m.elem = nil
+	l.open--
+	l.freed.Broadcast()
+	return err
+}
+
+// openSegmentFile opens the file a segment keeps open for writing, or for
+// reading in a read-only queue.  With Options.IdleTimeout the file is
+// closed whenever it goes unused for that long, and with a limit set by
+// SetMaxOpenSegments it is closed when others need to be opened.
+func (c *config) openSegmentFile(name string, flag int, perm os.FileMode) (File, error) {
+	if c.idleTimeout <= 0 && !openFiles.limited() {
+		return c.fs().OpenFile(name, flag, perm)
+	}
+
+	// Reopening must not create or truncate the file
+	m := &managedFile{cfg: c, name: name, flag: flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC), lastUse: time.Now()}
+
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	for !openFiles.makeRoom() {
+	}
+	f, err := c.fs().OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	openFiles.opened(m, f)
+	if c.idleTimeout > 0 {
+		m.timer = time.AfterFunc(c.idleTimeout, m.release)
+	}
+	return m, nil
+}
+
+// managedFile is a File that closes the file it wraps while it is unused,
+// either once it has gone unused for the idle timeout or to make room for
+// other files, and opens it again when it is next used.  Its fields are
+// guarded by the mutex of openFiles.
+type managedFile struct {
+	cfg     *config
+	name    string
+	flag    int
+	f       File          // nil while closed to save a file descriptor
+	elem    *list.Element // the file's place in openFiles.lru while f is open
+	busy    int           // number of reads, writes, and so on using f
+	offset  int64         // bytes read, to carry on from there when reopened
+	lastUse time.Time
+	timer   *time.Timer // nil without an idle timeout
+	closed  bool
+}
+
+// acquire returns the wrapped file, opening it again if it was closed, and
+// marks it in use until done is called.
+func (m *managedFile) acquire() (File, error) {
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	for m.f == nil {
+		if m.closed {
+			return nil, os.ErrClosed
+		}
+		if !openFiles.makeRoom() {
+			continue
+		}
+		f, err := m.cfg.fs().OpenFile(m.name, m.flag, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reopening segment file: "+m.name)
+		}
+		if m.offset > 0 {
+			// A Storage file can't seek, so what was read is read again
+			if _, err := io.CopyN(ioutil.Discard, f, m.offset); err != nil {
+				f.Close()
+				return nil, errors.Wrap(err, "error reopening segment file: "+m.name)
+			}
+		}
+		openFiles.opened(m, f)
+		if m.timer != nil {
+			m.timer.Reset(m.cfg.idleTimeout)
+		}
+	}
+	if m.closed {
+		return nil, os.ErrClosed
+	}
+	m.busy++
+	m.lastUse = time.Now()
+	openFiles.lru.MoveToBack(m.elem)
+	return m.f, nil
+}
+
+// done marks the end of a use of the file begun by acquire.
+func (m *managedFile) done() {
+	m.doneReading(0)
+}
+
+// doneReading is done for a read of n bytes.
+func (m *managedFile) doneReading(n int) {
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	m.offset += int64(n)
+	m.busy--
+	if m.busy > 0 {
+		return
+	}
+	if m.closed && m.f != nil {
+		// Close left the file to the last use to end
+		if err := openFiles.closeFile(m); err != nil {
+			m.cfg.logf("dque: unable to close segment file %s: %v", m.name, err)
+		}
+		return
+	}
+	openFiles.freed.Broadcast()
+}
+
+// release closes the wrapped file if it has been idle for the timeout, or
+// waits for the rest of the timeout if it hasn't.
+func (m *managedFile) release() {
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	if m.closed || m.f == nil {
+		return
+	}
+	if m.busy > 0 {
+		m.timer.Reset(m.cfg.idleTimeout)
+		return
+	}
+	if idle := time.Since(m.lastUse); idle < m.cfg.idleTimeout {
+		m.timer.Reset(m.cfg.idleTimeout - idle)
+		return
+	}
+	if err := openFiles.closeFile(m); err != nil {
+		m.cfg.logf("dque: unable to close idle file %s: %v", m.name, err)
+	}
+}
+
+func (m *managedFile) Read(p []byte) (int, error) {
+	f, err := m.acquire()
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Read(p)
+	m.doneReading(n)
+	return n, err
+}
+
+func (m *managedFile) Write(p []byte) (int, error) {
+	f, err := m.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer m.done()
+
+	return f.Write(p)
+}
+
+func (m *managedFile) Sync() error {
+	return m.SyncContext(context.Background())
+}
+
+// SyncContext syncs the wrapped file with its own SyncContext if it has
+// one, so wrapping a file doesn't change how it is synced.
+func (m *managedFile) SyncContext(ctx context.Context) error {
+	f, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer m.done()
+
+	if cs, ok := f.(ContextSyncer); ok {
+		return cs.SyncContext(ctx)
+	}
+	return f.Sync()
+}
+
+func (m *managedFile) Stat() (os.FileInfo, error) {
+	openFiles.mutex.Lock()
+	if m.closed {
+		openFiles.mutex.Unlock()
+		return nil, os.ErrClosed
+	}
+	if m.f == nil {
+		// No need to open the file just to stat it
+		openFiles.mutex.Unlock()
+		return m.cfg.fs().Stat(m.name)
+	}
+	f := m.f
+	m.busy++
+	openFiles.mutex.Unlock()
+	defer m.done()
+
+	return f.Stat()
+}
+
+func (m *managedFile) Close() error {
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	if m.closed {
+		return os.ErrClosed
+	}
+	m.closed = true
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	if m.f == nil {
+		return nil
+	}
+	if m.busy > 0 {
+		// A sync that timed out may never return, so rather than wait for
+		// it the file is closed once it is done
+		return nil
+	}
+	return openFiles.closeFile(m)
+}
+
+// withFile calls fn with the file f wraps if it is a managedFile, opening
+// it again if it was closed, for what needs the file itself, such as
+// preallocating it.  Any other file is passed as it is.
+func withFile(f File, fn func(f File) error) error {
+	m, ok := f.(*managedFile)
+	if !ok {
+		return fn(f)
+	}
+	f, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer m.done()
+
+	return fn(f)
+}
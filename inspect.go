@@ -0,0 +1,221 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// SegmentReader gives read-only access to the contents of one segment file,
+// for tools that inspect a queue.  Get one from OpenSegment.
+type SegmentReader interface {
+	// Objects returns the items still in the segment, in order.
+	Objects() []interface{}
+	// Number returns the number of the segment.
+	Number() int
+	// TombstoneCount returns the number of items that have been removed
+	// from the segment but are still in its file.
+	TombstoneCount() int
+	// LiveCount returns the number of items still in the segment.
+	LiveCount() int
+}
+
+// segmentReader is the SegmentReader of a segment loaded read-only.
+type segmentReader struct {
+	seg *qSegment
+}
+
+// SegmentNumbers returns the numbers of the segment files in the directory
+// of a queue, in order.  Only files with the default naming are found.
+func SegmentNumbers(dirPath string) ([]int, error) {
+	return listSegmentNumbers(osStorage{}, dirPath, filePattern, log.Printf)
+}
+
+// OpenSegment reads the numbered segment file in the directory of a queue
+// with the default naming.  The file is read in full and closed before
+// OpenSegment returns, and it is never written to, so a segment can be
+// inspected while its queue is open.  builder is the queue's builder, or
+// nil for a queue that uses CodecBytes.  Encrypted segments can't be read.
+func OpenSegment(dirPath string, number int, builder func() interface{}) (SegmentReader, error) {
+	fs := osStorage{}
+	cfg := &config{readOnly: true, Storage: fs}
+	seg := &qSegment{dirPath: dirPath, number: number, objectBuilder: builder, cfg: cfg}
+	if !fileExists(fs, seg.filePath()) {
+		return nil, errors.New("file does not exist: " + seg.filePath())
+	}
+	if _, err := openReadOnlySegment(seg); err != nil {
+		return nil, err
+	}
+	if err := seg.close(); err != nil {
+		return nil, err
+	}
+	return &segmentReader{seg: seg}, nil
+}
+
+func (r *segmentReader) Objects() []interface{} {
+	// Items read from disk are already decoded
+	objects := make([]interface{}, 0, len(r.seg.objects))
+	for _, object := range r.seg.objects {
+		objects = append(objects, unwrap(object))
+	}
+	return objects
+}
+
+func (r *segmentReader) Number() int {
+	return r.seg.number
+}
+
+func (r *segmentReader) TombstoneCount() int {
+	return r.seg.removeCount
+}
+
+func (r *segmentReader) LiveCount() int {
+	return r.seg.size()
+}
+
+// SegmentInfo describes one segment of an open queue.
+type SegmentInfo struct {
+	Number     int    // number of the segment
+	Path       string // path of the segment file
+	Live       int    // items still in the segment
+	Tombstones int    // items removed from the segment that are still in its file
+	Bytes      int64  // size of the segment file
+	Err        error  // why the segment file couldn't be read, if it couldn't
+}
+
+// Segments describes every segment of the queue, from the first to the last.
+// The first and last segments are described from memory.  The segments
+// between them aren't held in memory, so their files are read to count
+// their records, without decoding any items.  Nil is returned if the queue
+// is closed.
+func (q *DQue) Segments() []SegmentInfo {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return nil
+	}
+
+	infos := make([]SegmentInfo, 0, q.lastSegment.number-q.firstSegment.number+1)
+	for num := q.firstSegment.number; num <= q.lastSegment.number; num++ {
+		info := SegmentInfo{Number: num, Path: path.Join(q.fullPath, q.config.segmentFileName(num))}
+		switch num {
+		case q.firstSegment.number:
+			info.Live, info.Tombstones, info.Bytes = segmentInfoOf(q.firstSegment)
+		case q.lastSegment.number:
+			info.Live, info.Tombstones, info.Bytes = segmentInfoOf(q.lastSegment)
+		default:
+			info.Live, info.Tombstones, info.Bytes, info.Err = countRecords(q.config.fs(), info.Path)
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// segmentInfoOf returns the counts and size of a segment held in memory.
+func segmentInfoOf(seg *qSegment) (int, int, int64) {
+	live := seg.size()
+	return live, seg.sizeOnDisk() - live, seg.bytesOnDisk()
+}
+
+// countRecords counts the items in a segment file and those removed from
+// it by reading the length of each record and skipping its data.  The size
+// of the file is returned too.  A partial record at the end is ignored.
+func countRecords(fs Storage, filePath string) (live int, removed int, size int64, err error) {
+	f, err := fs.OpenFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "error opening file: "+filePath)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "error reading file: "+filePath)
+	}
+	if info.Size() == 0 {
+		// A new segment that doesn't have its header yet
+		return 0, 0, 0, nil
+	}
+	if _, err := readSegmentHeader(f, filePath); err != nil {
+		return 0, 0, info.Size(), err
+	}
+
+	lenBytes := make([]byte, 4)
+	for {
+		recLen, err := readUint32(f, lenBytes)
+		if err == io.EOF {
+			return live, removed, info.Size(), nil
+		}
+		if err != nil {
+			return live, removed, info.Size(), errors.Wrap(err, "error reading object length")
+		}
+		switch recLen {
+		case 0:
+			live--
+			removed++
+			continue
+		case checkpointMarker:
+			count, err := readUint32(f, lenBytes)
+			if err == io.EOF {
+				return live, removed, info.Size(), nil
+			}
+			if err != nil {
+				return live, removed, info.Size(), errors.Wrap(err, "error reading checkpoint")
+			}
+			n := int(count) - removed
+			live -= n
+			removed += n
+			continue
+		}
+		if err := skipRecord(f, int64(recLen), info.Size()); err != nil {
+			if err == io.EOF {
+				return live, removed, info.Size(), nil
+			}
+			return live, removed, info.Size(), errors.Wrap(err, "error reading gob data from file")
+		}
+		live++
+	}
+}
+
+// skipRecord moves past the n bytes of data of a record in a file of the
+// given size, seeking if the file can rather than reading the data.
+// io.EOF is returned if the file ends first.
+func skipRecord(f File, n int64, size int64) error {
+	seeker, ok := f.(io.Seeker)
+	if !ok {
+		_, err := io.CopyN(ioutil.Discard, f, n)
+		return err
+	}
+	pos, err := seeker.Seek(n, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if pos > size {
+		return io.EOF
+	}
+	return nil
+}
+
+// readUint32 reads a little endian uint32 into b and returns it.  io.EOF is
+// returned if the file ends before all of it is read.
+func readUint32(r io.Reader, b []byte) (uint32, error) {
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
@@ -0,0 +1,129 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// lazyRecord stands in for an item that has not been decoded, in a segment
+// loaded with Options.LazyDecode.  It holds where the item's record is in
+// the segment file.  In a segment with envelopes, the envelope is read as
+// the segment is loaded and the lazyRecord is the object it holds.
+type lazyRecord struct {
+	path   string
+	offset int64 // of the record's data, after its length
+	size   int
+}
+
+// lazyOf returns the lazyRecord of an object of a segment, or nil if the
+// object has been decoded.
+func lazyOf(object interface{}) *lazyRecord {
+	if env, ok := object.(*envelope); ok {
+		object = env.obj
+	}
+	lazy, _ := object.(*lazyRecord)
+	return lazy
+}
+
+// decodeLazy returns the object to keep in memory for a record read at the
+// given offset of the file at filePath while loading the segment with
+// Options.LazyDecode.  filePath is shared by every record of the segment
+// rather than built for each one.  Only the envelope is decoded.
+func (seg *qSegment) decodeLazy(data []byte, filePath string, offset int64) (interface{}, error) {
+	lazy := &lazyRecord{path: filePath, offset: offset, size: len(data)}
+	if !seg.header.envelope {
+		return lazy, nil
+	}
+	if seg.header.encrypted {
+		var err error
+		if data, err = seg.cfg.encryption.open(data); err != nil {
+			return nil, err
+		}
+	}
+	env, _, err := readEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	env.obj = lazy
+	return env, nil
+}
+
+// resolve returns an object of the segment decoded, reading it from disk if
+// it is a lazyRecord.
+func (seg *qSegment) resolve(object interface{}) (interface{}, error) {
+	lazy := lazyOf(object)
+	if lazy == nil {
+		return object, nil
+	}
+	data, err := lazy.read(seg.cfg.fs())
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := seg.decode(data)
+	if _, ok := err.(builderError); ok {
+		return nil, err
+	}
+	if err != nil {
+		seg.cfg.observer.decodeFailed(err)
+		return nil, ErrUnableToDecode{Path: lazy.path, Err: err}
+	}
+	return decoded, nil
+}
+
+// read returns the data of the record from the segment file.
+func (lazy *lazyRecord) read(fs Storage) ([]byte, error) {
+	f, err := fs.OpenFile(lazy.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening file: "+lazy.path)
+	}
+	defer f.Close()
+
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err = seeker.Seek(lazy.offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, f, lazy.offset)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error seeking in file: "+lazy.path)
+	}
+	data := make([]byte, lazy.size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, errors.Wrap(err, "error reading gob data from file: "+lazy.path)
+	}
+	return data, nil
+}
+
+// lazyRecordBytes returns the record of an object that hasn't been decoded,
+// copied as it is from the segment's own file, and the object to keep in
+// memory once the record is written at the given offset.  False is
+// returned if the object isn't a lazyRecord of this segment.
+func (seg *qSegment) lazyRecordBytes(object interface{}, offset int64) ([]byte, interface{}, bool, error) {
+	lazy := lazyOf(object)
+	if lazy == nil || lazy.path != seg.filePath() {
+		return nil, nil, false, nil
+	}
+	data, err := lazy.read(seg.cfg.fs())
+	if err != nil {
+		return nil, nil, false, err
+	}
+	rec := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(rec, uint32(len(data)))
+
+	moved := &lazyRecord{path: lazy.path, offset: offset + 4, size: lazy.size}
+	if env, ok := object.(*envelope); ok {
+		copied := *env
+		copied.obj = moved
+		return append(rec, data...), &copied, true, nil
+	}
+	return append(rec, data...), moved, true, nil
+}
@@ -0,0 +1,53 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// NewMultiType creates a new durable queue that holds items of several
+// types in one order, such as the events of an event-sourced system.
+// builders maps the type tag of each type to its builder.  Items are
+// enqueued with EnqueueTyped, or with Enqueue and the other methods, which
+// tag an item by its type.  Dequeue returns each item as the type its
+// builder builds.  See Options.Builders.
+func NewMultiType(name string, dirPath string, itemsPerSegment int, builders map[string]func() interface{}) (*DQue, error) {
+	return NewWithOptions(name, dirPath, itemsPerSegment, nil, Options{Builders: builders})
+}
+
+// OpenMultiType opens an existing queue created with NewMultiType.  The
+// same type tags must be given.
+func OpenMultiType(name string, dirPath string, itemsPerSegment int, builders map[string]func() interface{}) (*DQue, error) {
+	return OpenWithOptions(name, dirPath, itemsPerSegment, nil, Options{Builders: builders})
+}
+
+// EnqueueTyped adds an item to the end of a multi-type queue, checking that
+// it is of the type built by the builder for the given tag.
+func (q *DQue) EnqueueTyped(tag string, obj interface{}) error {
+	if _, ok := q.config.builders[tag]; !ok {
+		return errors.Errorf("no builder was given for type tag %q", tag)
+	}
+	if t := reflect.TypeOf(obj); q.config.tags[t] != tag {
+		return errors.Errorf("type tag %q is for items of type %s, not %s", tag, q.config.taggedType(tag), t)
+	}
+	return q.Enqueue(obj)
+}
+
+// taggedType returns the type of the items with the given type tag, from
+// the types recorded when the builders were checked rather than by
+// building an item.
+func (c *config) taggedType(tag string) reflect.Type {
+	for t, tagged := range c.tags {
+		if tagged == tag {
+			return t
+		}
+	}
+	return nil
+}
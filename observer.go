@@ -0,0 +1,131 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified of the activity of a queue so it can be exported as
+// metrics without dque depending on a metrics library.
+//
+// OnEnqueue and OnDequeue are called after the queue's locks are released.
+// The other methods may be called while the queue is locked, so they must
+// return quickly and must not call methods on the queue.
+type Observer interface {
+	// OnEnqueue is called after an item is enqueued with the size of the
+	// queue, as SizeUnsafe reports it.
+	OnEnqueue(size int)
+	// OnDequeue is called after an item is dequeued with the size of the
+	// queue, as SizeUnsafe reports it.
+	OnDequeue(size int)
+	// OnSegmentCreate is called after a segment file is created.
+	OnSegmentCreate(num int)
+	// OnSegmentDelete is called after a segment file is deleted.
+	OnSegmentDelete(num int)
+	// OnSync is called after a segment file is synced to disk.
+	OnSync()
+	// OnDecodeError is called when an item read from disk cannot be decoded.
+	OnDecodeError(err error)
+}
+
+// ItemObserver may be implemented by an Observer to be told the size of
+// each item, as it is stored, and how long decoding it took, which helps
+// in choosing itemsPerSegment.  Both methods may be called while the queue
+// is locked.
+type ItemObserver interface {
+	// OnItemEncoded is called after an item is encoded for a segment file
+	// with the number of bytes stored for it.
+	OnItemEncoded(bytes int)
+	// OnItemDecoded is called after an item read from disk is decoded with
+	// the number of bytes it was stored in and how long decoding took.
+	OnItemDecoded(bytes int, dur time.Duration)
+}
+
+// SetObserver sets the Observer that is notified of the queue's activity.
+// Passing nil removes the current observer.  To also observe decode errors
+// while the queue is being opened, set Options.Observer instead.
+func (q *DQue) SetObserver(obs Observer) {
+	q.config.observer.set(obs)
+}
+
+// observerBox lets a nil Observer be stored in an atomic.Value, which only
+// accepts values of a single concrete type.
+type observerBox struct {
+	obs Observer
+}
+
+// observerValue holds the Observer of a queue.  It is shared by the queue and
+// its segments and can be replaced while they are in use.
+type observerValue struct {
+	v atomic.Value
+}
+
+func (o *observerValue) set(obs Observer) {
+	o.v.Store(observerBox{obs})
+}
+
+// get returns the current Observer or nil if there is none.
+func (o *observerValue) get() Observer {
+	box, _ := o.v.Load().(observerBox)
+	return box.obs
+}
+
+func (o *observerValue) segmentCreated(num int) {
+	if obs := o.get(); obs != nil {
+		obs.OnSegmentCreate(num)
+	}
+}
+
+func (o *observerValue) segmentDeleted(num int) {
+	if obs := o.get(); obs != nil {
+		obs.OnSegmentDelete(num)
+	}
+}
+
+func (o *observerValue) synced() {
+	if obs := o.get(); obs != nil {
+		obs.OnSync()
+	}
+}
+
+// items returns the current Observer if it is an ItemObserver, or nil.
+func (o *observerValue) items() ItemObserver {
+	obs, _ := o.get().(ItemObserver)
+	return obs
+}
+
+func (o *observerValue) decodeFailed(err error) {
+	if obs := o.get(); obs != nil {
+		obs.OnDecodeError(err)
+	}
+}
+
+// observeEnqueue counts an enqueue for Rates and reports it, with the size
+// of the queue from the item counter so that no lock is taken.
+func (q *DQue) observeEnqueue() {
+	q.observeEnqueueN(1)
+}
+
+// observeEnqueueN is observeEnqueue for n items enqueued at once, which are
+// counted for Rates one by one but reported to the observer once.
+func (q *DQue) observeEnqueueN(n int) {
+	atomic.AddInt64(&q.enqueues, int64(n))
+	if obs := q.config.observer.get(); obs != nil {
+		obs.OnEnqueue(int(atomic.LoadInt64(&q.count)))
+	}
+}
+
+// observeDequeue counts a dequeue for Rates and reports it, with the size
+// of the queue from the item counter so that no lock is taken.
+func (q *DQue) observeDequeue() {
+	atomic.AddInt64(&q.dequeues, 1)
+	if obs := q.config.observer.get(); obs != nil {
+		obs.OnDequeue(int(atomic.LoadInt64(&q.count)))
+	}
+}
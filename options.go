@@ -0,0 +1,317 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"encoding/gob"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDirMode      os.FileMode = 0755
+	defaultFileMode     os.FileMode = 0644
+	defaultSegmentWidth             = 13
+)
+
+// Compression identifies the algorithm used to compress each item before it
+// is written to a segment file.
+type Compression uint8
+
+const (
+	// CompressionNone stores items exactly as gob encoded them.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses each gob encoded item with gzip.
+	CompressionGzip
+)
+
+// Codec identifies how items are encoded before they are written to a
+// segment file.
+type Codec uint8
+
+const (
+	// CodecGob encodes items with encoding/gob.  Every item must be of the
+	// type returned by the queue's builder.
+	CodecGob Codec = iota
+	// CodecBytes stores []byte items exactly as they are, so no builder is
+	// needed.  Empty slices can't be stored because a zero length marks a
+	// removed item in a segment file.
+	CodecBytes
+)
+
+// Options holds the optional settings of a queue.  The zero value gives the
+// same queue you get from New, Open, and NewOrOpen.
+type Options struct {
+	// Compression is applied to every item written to the queue.  It is
+	// recorded in the header of each segment file, so a queue keeps the
+	// compression it was created with for its lifetime.  When an existing
+	// queue is opened, the recorded value wins over this one.
+	Compression Compression
+
+	// Codec encodes every item written to the queue.  Like Compression, it
+	// is recorded in each segment file and the recorded value wins when an
+	// existing queue is opened.
+	Codec Codec
+
+	// DirMode is the permission of the queue directory.  It defaults to 0755.
+	DirMode os.FileMode
+
+	// FileMode is the permission of the segment files.  It defaults to 0644.
+	// Use 0700 and 0600 to keep other local users from reading queued items.
+	// Both modes are subject to the umask of the process.
+	FileMode os.FileMode
+
+	// SegmentPrefix is added to the start of the name of every segment file.
+	// Segment files are only found if the same prefix is given every time
+	// the queue is opened.  It must not contain a path separator.
+	SegmentPrefix string
+
+	// MaxSegmentBytes, when greater than zero, starts a new segment once the
+	// file of the last one reaches this many bytes, even if it holds fewer
+	// than itemsPerSegment items.  Each segment is held in memory while it is
+	// the first or the last, so this bounds memory use when item sizes vary
+	// a lot.  Prepend doesn't start new segments for it.  It is not
+	// recorded, so give it every time the queue is opened.
+	MaxSegmentBytes int64
+
+	// SegmentWidth is the number of digits that segment numbers are zero
+	// padded to in file names.  It defaults to 13.  Use 1 for no padding.
+	SegmentWidth int
+
+	// Observer is notified of the queue's activity, starting while the queue
+	// is being opened.  It can be changed later with SetObserver.
+	Observer Observer
+
+	// GobTypes are registered with gob.Register before the queue is loaded.
+	// Gob must know every concrete type stored in an interface field of an
+	// item, both when the item is enqueued and when it is read back, so the
+	// same types must be given every time the queue is opened.
+	GobTypes []interface{}
+
+	// Logger receives the few messages dque logs, such as a partial record
+	// being truncated after a crash.  It defaults to the standard logger.
+	Logger Logger
+
+	// Storage is where the queue keeps its files.  It defaults to the local
+	// filesystem.
+	Storage Storage
+
+	// OnPoison is called with each queued record that can't be decoded, as
+	// the segment holding it is loaded.  raw is the record as it is stored
+	// in the segment file.  Returning true skips the record: it is removed
+	// from the segment and the queue keeps flowing.  Returning false fails
+	// the load with ErrUnableToDecode, which is also what happens when
+	// OnPoison is nil.  To keep poison records, enqueue raw to a dead-letter
+	// queue that uses CodecBytes.  OnPoison may be called while the queue's
+	// locks are held, so it must not use the queue.
+	OnPoison func(raw []byte, err error) bool
+
+	// EncryptionKey is a 32-byte key used to encrypt every item written to
+	// the queue with AES-256-GCM.  Unlike Compression, it is not recorded:
+	// new segments are encrypted only when a key is given, and a queue
+	// holding encrypted segments can only be opened with the key it was
+	// written with.  Keep the key somewhere other than the queue's disk.
+	EncryptionKey []byte
+
+	// RetainConsumed keeps the file of each segment whose items have all
+	// been dequeued, renaming it with a ".done" suffix instead of deleting
+	// it.  Retained files are not loaded again, but they are left for
+	// auditing or replay until something else removes them.
+	RetainConsumed bool
+
+	// Builders makes a multi-type queue, holding items of several types in
+	// one order.  Each item is stored with the tag its type is given here,
+	// and is decoded with the builder for that tag, so tags must stay the
+	// same every time the queue is opened.  Each builder must build a
+	// different type, and tags are at most 255 bytes.  The builder passed
+	// to the constructor, which may then be nil, is only used for items
+	// enqueued before the queue had Builders.  See NewMultiType.
+	Builders map[string]func() interface{}
+
+	// LazyDecode keeps only the position of each item of a segment in
+	// memory, along with when it was enqueued, and decodes an item from
+	// disk each time it is peeked at or dequeued, at the cost of a read per
+	// item, which suits very large items.  The index of positions, a few
+	// dozen bytes per item, is still kept for every item in the first and
+	// last segments.  Dequeued items are never kept, with or without this
+	// option.  A record that can't be decoded fails the Dequeue or Peek that
+	// reaches it, with ErrUnableToDecode, rather than the load of its
+	// segment, so OnPoison is not called for it.  It is not recorded, so
+	// give it every time the queue is opened.
+	LazyDecode bool
+
+	// SyncTimeout, when greater than zero, limits how long an operation
+	// waits for a segment file to be synced to disk, so a hung network
+	// filesystem can't wedge the queue.  A sync that takes longer fails the
+	// operation with ErrSyncTimeout, but the sync itself can't be stopped
+	// and carries on in the background, so the change may still reach the
+	// disk.  An item enqueued when this happens stays in the queue and is
+	// counted by SizeUnsafe.  An item dequeued when this happens has been
+	// removed from the queue, so it is returned along with the error and
+	// must be handled by the caller.  It is not recorded, so give it every
+	// time the queue is opened.
+	SyncTimeout time.Duration
+
+	// FallibleBuilder builds the items of the queue like the builder passed
+	// to the constructor, which must then be nil, for item types whose
+	// construction can fail.  An error it returns while a segment is loaded
+	// fails the load, and one returned while an item is decoded later,
+	// with LazyDecode, fails the Dequeue or Peek that needed the item.
+	// Either way it is wrapped, so errors.Cause returns it.
+	FallibleBuilder func() (interface{}, error)
+
+	// WriteOnly opens the queue for a producer that never reads from it.
+	// Segments are loaded as with LazyDecode, so the items already in the
+	// queue are counted without being decoded, and Dequeue, Peek, and the
+	// other methods that read items return ErrWriteOnly.  The queue is
+	// still locked, so no other process can have it open at the same time.
+	WriteOnly bool
+
+	// CheckpointEvery, when greater than zero, records dequeued items with
+	// a checkpoint written after every CheckpointEvery dequeues from a
+	// segment, rather than with a removal marker for each item, which
+	// cuts the bytes written when many items are dequeued.  A checkpoint
+	// is also written when the queue is closed, but after a crash the
+	// items dequeued since the last checkpoint are dequeued again, so
+	// consumers must be able to handle an item more than once.  Only new
+	// segments use checkpoints, and versions of dque from before this
+	// option can't open them.  It is not recorded, so give it every time
+	// the queue is opened.  Segments are read the same way either way.
+	CheckpointEvery int
+
+	// IdleTimeout, when greater than zero, closes the files of the first
+	// and last segments once they have gone unused for that long, and
+	// opens them again when the queue next needs them, so many idle queues
+	// can be open without running out of file descriptors.  Size, Stats,
+	// and the other methods that don't touch the files work from memory as
+	// usual.  The queue's lock file stays open.  It is not recorded, so
+	// give it every time the queue is opened.
+	IdleTimeout time.Duration
+
+	// PersistDedup keeps the dedup window of EnqueueUnique in a file in the
+	// queue's directory, so a producer that retries after the queue was
+	// closed and opened again, even after a crash, still has its duplicate
+	// skipped.  The file is rewritten and synced by every EnqueueUnique
+	// that enqueues, which costs a write of the whole window.  It is not
+	// recorded, so give it every time the queue is opened.
+	PersistDedup bool
+
+	// Clock is what the time-based features of the queue, such as TTLs,
+	// EnqueueAt, and EnqueueUnique's window, take the time from.  It
+	// defaults to the system clock.  Timeouts always run on real time.
+	Clock Clock
+}
+
+// Logger is the interface dque logs through.  A *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// validate returns an error if any of the options can't be used.
+func (opts Options) validate() error {
+	if strings.ContainsAny(opts.SegmentPrefix, `/\`) {
+		return errors.New("the segment prefix must not contain a path separator")
+	}
+	if opts.Codec > CodecBytes {
+		return errors.Errorf("unknown codec %d", opts.Codec)
+	}
+	if opts.MaxSegmentBytes < 0 {
+		return errors.New("the maximum segment size must not be negative")
+	}
+	if opts.CheckpointEvery < 0 {
+		return errors.New("the checkpoint interval must not be negative")
+	}
+	if opts.IdleTimeout < 0 {
+		return errors.New("the idle timeout must not be negative")
+	}
+	if opts.SyncTimeout < 0 {
+		return errors.New("the sync timeout must not be negative")
+	}
+	if opts.SegmentWidth < 0 {
+		return errors.New("the segment width must not be negative")
+	}
+	if opts.EncryptionKey != nil && len(opts.EncryptionKey) != EncryptionKeySize {
+		return errors.Errorf("the encryption key must be %d bytes, not %d", EncryptionKeySize, len(opts.EncryptionKey))
+	}
+	if opts.Builders != nil && opts.Codec == CodecBytes {
+		return errors.New("a queue using CodecBytes can't have Builders")
+	}
+	for tag := range opts.Builders {
+		if tag == "" || len(tag) > maxTagSize {
+			return errors.Errorf("type tags must be 1 to %d bytes, not %d", maxTagSize, len(tag))
+		}
+	}
+	for _, t := range opts.GobTypes {
+		if t == nil {
+			return errors.New("GobTypes must not contain nil")
+		}
+	}
+	return nil
+}
+
+// registerGobTypes registers the GobTypes with gob.  gob.Register panics
+// on a type it already knows by another name, such as when both T{} and &T{}
+// are given, so the panic is returned as an error instead.
+func (opts Options) registerGobTypes() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("unable to register Options.GobTypes: %v", r)
+		}
+	}()
+	for _, t := range opts.GobTypes {
+		gob.Register(t)
+	}
+	return nil
+}
+
+// builder returns the builder of the queue, which is the one given unless
+// there is a FallibleBuilder.
+func (opts Options) builder(builder func() interface{}) (func() interface{}, error) {
+	if opts.FallibleBuilder == nil {
+		return builder, nil
+	}
+	if builder != nil {
+		return nil, errors.New("a builder and a FallibleBuilder can't both be given")
+	}
+	return func() interface{} {
+		obj, err := opts.FallibleBuilder()
+		if err != nil {
+			return builderError{err}
+		}
+		return obj
+	}, nil
+}
+
+// builderError is what the builder made from a FallibleBuilder returns in
+// place of an item when the FallibleBuilder fails.
+type builderError struct {
+	err error
+}
+
+func (e builderError) Error() string {
+	return "the builder failed: " + e.err.Error()
+}
+
+func (e builderError) Cause() error {
+	return e.err
+}
+
+func (e builderError) Unwrap() error {
+	return e.err
+}
+
+// storage returns the Storage to use, which is the local filesystem unless
+// another one is given.
+func (opts Options) storage() Storage {
+	if opts.Storage == nil {
+		return osStorage{}
+	}
+	return opts.Storage
+}
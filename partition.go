@@ -0,0 +1,251 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// partitionPrefix starts the directory name of every partition, so the
+// empty key has a name and other directories are never taken for one.
+const partitionPrefix = "p-"
+
+// maxPartitionDirLen is the longest directory name a partition may have,
+// the limit of most filesystems.
+const maxPartitionDirLen = 255
+
+// Partitioned is a set of queues, one per partition key, kept in
+// subdirectories of one directory.  Items are routed to a partition by the
+// key function given to NewPartitioned, and each partition is a DQue of its
+// own, so items with the same key are dequeued in the order they were
+// enqueued, while items with different keys are unordered.
+type Partitioned struct {
+	dirPath         string
+	itemsPerSegment int
+	builder         func() interface{}
+	keyFn           func(obj interface{}) string
+	opts            Options // given to every partition
+	mutex           sync.Mutex
+	queues          map[string]*DQue // nil once closed
+}
+
+// NewPartitioned creates a partitioned queue with the given name in
+// dirPath, or opens it and every partition in it if it already exists.
+// Each partition holds itemsPerSegment items per segment file and is made
+// on the first Enqueue of an item with its key.
+//
+// A key is stored as the name of its partition's directory: "p-" followed by
+// the key with every byte that isn't a lowercase ASCII letter, a digit,
+// '-', or '_' written as '%' and two uppercase hex digits.  Keys such as
+// "", "..", or "a/b" are therefore safe, and keys differing only in case get
+// different directories even on a case-insensitive filesystem.  Keys whose
+// directory name would be longer than 255 bytes are refused.
+func NewPartitioned(name string, dirPath string, itemsPerSegment int, builder func() interface{}, keyFn func(obj interface{}) string) (*Partitioned, error) {
+	return NewPartitionedWithOptions(name, dirPath, itemsPerSegment, builder, keyFn, Options{})
+}
+
+// NewPartitionedWithOptions is NewPartitioned with the given options.  The
+// directory of the partitioned queue is made through Options.Storage with
+// Options.DirMode, and every partition is created or opened with the
+// options.
+func NewPartitionedWithOptions(name string, dirPath string, itemsPerSegment int, builder func() interface{}, keyFn func(obj interface{}) string, opts Options) (*Partitioned, error) {
+
+	// Validation
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if len(dirPath) == 0 {
+		return nil, errors.New("the queue directory requires a value")
+	}
+	if itemsPerSegment < 1 {
+		return nil, errors.New("the number of items per segment must be positive")
+	}
+	if keyFn == nil {
+		return nil, errors.New("the partition key function requires a value")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := opts.storage()
+	if !dirExists(fs, dirPath) {
+		return nil, errors.New("the given queue directory is not valid (" + dirPath + ")")
+	}
+	absPath, err := absDir(fs, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	fullPath := path.Join(absPath, name)
+	cfg := config{DirMode: opts.DirMode}
+	if err := fs.Mkdir(fullPath, cfg.dirPerm()); err != nil && !os.IsExist(err) {
+		return nil, errors.Wrap(err, "error creating partitioned queue directory "+fullPath)
+	}
+
+	p := &Partitioned{
+		dirPath:         fullPath,
+		itemsPerSegment: itemsPerSegment,
+		builder:         builder,
+		keyFn:           keyFn,
+		opts:            opts,
+		queues:          make(map[string]*DQue),
+	}
+
+	// Open the partitions made before
+	files, err := fs.ReadDir(fullPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read partitioned queue directory "+fullPath)
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		key, ok := partitionKey(f.Name())
+		if !ok {
+			continue
+		}
+		q, err := NewOrOpenWithOptions(f.Name(), fullPath, itemsPerSegment, builder, opts)
+		if err != nil {
+			_ = p.Close()
+			return nil, errors.Wrapf(err, "error opening partition %q", key)
+		}
+		p.queues[key] = q
+	}
+	return p, nil
+}
+
+// Enqueue adds an item to the end of the partition of its key, creating the
+// partition if it doesn't exist yet.
+func (p *Partitioned) Enqueue(obj interface{}) error {
+	q, err := p.partition(p.keyFn(obj), true)
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(obj)
+}
+
+// DequeuePartition removes and returns the first item of the partition with
+// the given key.  When the partition is empty or doesn't exist, nil and
+// dque.ErrEmpty are returned.
+func (p *Partitioned) DequeuePartition(key string) (interface{}, error) {
+	q, err := p.partition(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		return nil, ErrEmpty
+	}
+	return q.Dequeue()
+}
+
+// Partitions returns the keys of the partitions, sorted.
+func (p *Partitioned) Partitions() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	keys := make([]string, 0, len(p.queues))
+	for key := range p.queues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close closes every partition.  Every partition is closed even if closing
+// one of them fails, and every failure is reported.
+func (p *Partitioned) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.queues == nil {
+		return ErrQueueClosed
+	}
+	var errs closeErrors
+	for key, q := range p.queues {
+		if err := q.Close(); err != nil {
+			errs.add(errors.Wrapf(err, "error closing partition %q", key))
+		}
+	}
+	p.queues = nil
+	return errs.err()
+}
+
+// partition returns the queue of the partition with the given key, creating
+// it if create is true.  Nil is returned if it doesn't exist and create is
+// false.
+func (p *Partitioned) partition(key string, create bool) (*DQue, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.queues == nil {
+		return nil, ErrQueueClosed
+	}
+	if q, ok := p.queues[key]; ok || !create {
+		return q, nil
+	}
+
+	name := partitionDir(key)
+	if len(name) > maxPartitionDirLen {
+		return nil, errors.Errorf("the partition key %q is too long", key)
+	}
+	q, err := NewOrOpenWithOptions(name, p.dirPath, p.itemsPerSegment, p.builder, p.opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating partition %q", key)
+	}
+	p.queues[key] = q
+	return q, nil
+}
+
+// partitionDir returns the name of the directory of the partition with the
+// given key.
+func partitionDir(key string) string {
+	var b strings.Builder
+	b.WriteString(partitionPrefix)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// partitionKey returns the key of the partition kept in the directory with
+// the given name.  False is returned if the name isn't one partitionDir
+// returns.
+func partitionKey(name string) (string, bool) {
+	if !strings.HasPrefix(name, partitionPrefix) {
+		return "", false
+	}
+	name = name[len(partitionPrefix):]
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", false
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	key := b.String()
+	return key, partitionDir(key) == partitionPrefix+name
+}
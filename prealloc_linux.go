@@ -0,0 +1,30 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which allocates blocks without
+// changing the size of the file, so appends still land at the end of the
+// data.
+const fallocKeepSize = 0x01
+
+// preallocate reserves size bytes of disk for the file.  False is returned
+// if the file or the filesystem doesn't support it.
+func preallocate(f File, size int64) (bool, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return false, nil
+	}
+	err := syscall.Fallocate(int(fd.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,56 @@
+// prealloc_linux_test.go
+package dque
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// allocated returns the bytes of disk allocated to the file.
+func allocated(t *testing.T, file string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		t.Fatalf("Error getting the size of %s: %s\n", file, err)
+	}
+	return st.Blocks * 512
+}
+
+func TestSegment_Preallocate(t *testing.T) {
+	testDir := "./TestSegmentPreallocate"
+	os.RemoveAll(testDir)
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory: %s\n", err)
+	}
+
+	cfg := &config{preallocate: 1 << 20}
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, cfg)
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	if !seg.preallocated {
+		seg.close()
+		os.RemoveAll(testDir)
+		t.Skip("The filesystem doesn't support fallocate")
+	}
+
+	// The space is reserved without changing the size of the file
+	assert(t, seg.add(&item1{Name: "Number 1"}) == nil, "failed to add item1")
+	assert(t, allocated(t, seg.filePath()) >= 1<<20, "Expected 1MB to be allocated")
+	assert(t, seg.fileBytes == fileSize(osStorage{}, seg.filePath()), "Expected the size to be what was written")
+
+	// Closing gives the space back
+	assert(t, seg.close() == nil, "failed to close the segment")
+	assert(t, allocated(t, seg.filePath()) < 1<<20, "Expected the preallocated space to be released")
+
+	seg, err = openQueueSegment(testDir, 1, false, item1Builder, cfg)
+	if err != nil {
+		t.Fatalf("openQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, 1 == seg.size(), "Expected size of 1")
+	seg.close()
+
+	if err := os.RemoveAll(testDir); err != nil {
+		t.Fatalf("Error removing directory: %s\n", err)
+	}
+}
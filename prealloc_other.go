@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+// preallocate does nothing where fallocate isn't available.
+func preallocate(f File, size int64) (bool, error) {
+	return false, nil
+}
@@ -10,29 +10,80 @@ package dque
 //
 
 import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gofrs/flock"
 	"github.com/pkg/errors"
 
-	"io/ioutil"
-	"math"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 )
 
 const lockFile = "lock.lock"
 
-// ErrQueueClosed is the error returned when a queue is closed.
+// maxSegmentNumber is the largest segment number a file may have, so that
+// numbers fit in an int and the next one doesn't overflow.  It is
+// math.MaxInt - 1, spelled out for Go versions before math.MaxInt.
+const maxSegmentNumber = 1<<(strconv.IntSize-1) - 2
+
+// ErrQueueClosed is the error returned by every method of a queue after it
+// has been closed.  Compare with errors.Is rather than the error message.
 var ErrQueueClosed = errors.New("queue is closed")
 
+// ErrQueueLocked is returned when opening a queue that is already open,
+// whether in this process or another one.  Compare with errors.Is.
+var ErrQueueLocked = errors.New("queue is already open")
+
 var (
 	filePattern *regexp.Regexp
 
 	// ErrEmpty is returned when attempting to dequeue from an empty queue.
 	ErrEmpty = errors.New("dque is empty")
+
+	// ErrReadOnly is returned by the methods that would change a queue
+	// opened with OpenReadOnly.
+	ErrReadOnly = errors.New("queue is read-only")
+
+	// ErrTimeout is returned when no item becomes available before the
+	// timeout of DequeueBlockTimeout or PeekBlockTimeout.
+	ErrTimeout = errors.New("timed out waiting for an item")
+
+	// ErrInvalidBuilder is returned when opening a queue whose builder
+	// doesn't return a non-nil pointer for gob to decode items into.  Queues
+	// that use CodecBytes don't need a builder.
+	ErrInvalidBuilder = errors.New("the builder must return a non-nil pointer")
+
+	// ErrNoMatch is returned by DequeueMatching when the first item in the
+	// queue doesn't match and non-matching items aren't to be skipped.
+	ErrNoMatch = errors.New("the first item doesn't match")
+
+	// ErrShuttingDown is returned when enqueueing to a queue that Shutdown
+	// is draining.
+	ErrShuttingDown = errors.New("queue is shutting down")
+
+	// ErrDiskFull is returned when the disk holding the queue has no space
+	// left.  A record that couldn't be written is truncated from its
+	// segment file, so the call can be retried once space is freed.
+	ErrDiskFull = errors.New("no space left on the queue's disk")
+
+	// ErrSyncTimeout is returned when syncing a segment file to disk takes
+	// longer than the SyncTimeout option allows.
+	ErrSyncTimeout = errors.New("timed out syncing to disk")
+
+	// ErrWriteOnly is returned by the methods that would read items from a
+	// queue opened with OpenWriteOnly.
+	ErrWriteOnly = errors.New("queue is write-only")
 )
 
 func init() {
@@ -41,6 +92,92 @@ func init() {
 
 type config struct {
 	ItemsPerSegment int
+	Compression     Compression
+	Codec           Codec
+	DirMode         os.FileMode
+	FileMode        os.FileMode
+	SegmentPrefix   string
+	SegmentWidth    int
+	observer        observerValue
+	syncer          *turboSyncer // set by TurboInterval
+	readOnly        bool         // set by OpenReadOnly
+	logger          Logger
+	onPoison        func(raw []byte, err error) bool
+	maxSegmentBytes int64
+	preallocate     int64 // set by PreallocateSegments
+	retainConsumed  bool
+	encryption      *encryption                   // set when Options.EncryptionKey is given
+	clock           Clock                         // nil for the system clock
+	syncs           *int64                        // counts the fsyncs of segment files, if not nil
+	builders        map[string]func() interface{} // by type tag, set by Options.Builders
+	lazyDecode      bool
+	writeOnly       bool // set by Options.WriteOnly
+	syncTimeout     time.Duration
+	checkpointEvery int                     // set by Options.CheckpointEvery
+	idleTimeout     time.Duration           // set by Options.IdleTimeout
+	tags            map[reflect.Type]string // the type tag of what each builder builds
+	persistDedup    bool                    // set by Options.PersistDedup
+	Storage         Storage
+}
+
+// dirPerm returns the permission for new directories
+func (c *config) dirPerm() os.FileMode {
+	if c.DirMode == 0 {
+		return defaultDirMode
+	}
+	return c.DirMode
+}
+
+// filePerm returns the permission for new files
+func (c *config) filePerm() os.FileMode {
+	if c.FileMode == 0 {
+		return defaultFileMode
+	}
+	return c.FileMode
+}
+
+// synced counts an fsync of a segment file and reports it to the observer.
+func (c *config) synced() {
+	if c.syncs != nil {
+		atomic.AddInt64(c.syncs, 1)
+	}
+	c.observer.synced()
+}
+
+// fs returns the Storage of the queue, which is the local filesystem unless
+// another one was given.
+func (c *config) fs() Storage {
+	if c.Storage == nil {
+		return osStorage{}
+	}
+	return c.Storage
+}
+
+// logf logs a message through the configured Logger or the standard logger.
+func (c *config) logf(format string, v ...interface{}) {
+	if c.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	c.logger.Printf(format, v...)
+}
+
+// segmentFileName returns the name of the file for the given segment number.
+func (c *config) segmentFileName(number int) string {
+	width := c.SegmentWidth
+	if width == 0 {
+		width = defaultSegmentWidth
+	}
+	return fmt.Sprintf("%s%0*d.dque", c.SegmentPrefix, width, number)
+}
+
+// segmentPattern returns the pattern matched by the names of segment files.
+// The number is the first submatch.
+func (c *config) segmentPattern() *regexp.Regexp {
+	if c.SegmentPrefix == "" {
+		return filePattern
+	}
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(c.SegmentPrefix) + `([0-9]+)\.dque$`)
 }
 
 // DQue is the in-memory representation of a queue on disk.  You must never have
@@ -48,383 +185,2164 @@ type config struct {
 // acceptable to reconstitute a new instance from disk, but make sure the old
 // instance is never enqueued to (or dequeued from) again.
 type DQue struct {
+	// count is the number of items in the queue, syncs the number of fsyncs
+	// of its segment files, and enqueues and dequeues the number of items
+	// enqueued and dequeued since it was opened, all updated atomically.
+	// They are first so they are 64-bit aligned on 32-bit platforms.
+	count    int64
+	syncs    int64
+	enqueues int64
+	dequeues int64
+
 	Name    string
 	DirPath string
 	config  config
 
 	fullPath     string
-	fileLock     *flock.Flock
+	fileLock     io.Closer
+	leak         *leakDetector // warns if the queue is never closed
 	firstSegment *qSegment
 	lastSegment  *qSegment
 	builder      func() interface{} // builds a structure to load via gob
+	itemType     reflect.Type       // what the builder builds, nil for CodecBytes
 
-	mutex sync.Mutex
+	// mutex guards the head of the queue (firstSegment) and tailMutex
+	// guards the tail (lastSegment), so a producer and a consumer working
+	// on different segments don't wait on each other.  When both are
+	// needed, mutex is always taken first.
+	mutex     sync.Mutex
+	tailMutex sync.Mutex
 
 	emptyCond *sync.Cond
+	waiters   int32      // goroutines blocked in emptyCond.Wait(), updated atomically
+	waitQueue *list.List // of the blocked callers in the order they arrived, guarded by mutex
+
+	emptyMutex sync.Mutex
+	emptyC     chan struct{} // closed when the queue becomes empty, guarded by emptyMutex
+
+	inflight       map[int]interface{} // items checked out by DequeueWithAck
+	lastInflightID int
+
+	cursors map[string]*Cursor
+
+	dedup *dedupWindow // keys recently given to EnqueueUnique
+
+	nextDue int64 // when the next scheduled item is due, guarded by mutex
+
+	ttl     time.Duration // set by SetTTL, guarded by mutex
+	expired int           // items dropped because they outlived the ttl
+
+	maxSegments int // set by SetMaxSegments, guarded by both locks
+	readAhead   readAhead
+	rates       rateSampler
+	dropped     int // items discarded to keep within maxSegments
+
+	onSegmentComplete func(path string, number int) // set by OnSegmentComplete, guarded by tailMutex
+	completed         []int                         // segments not yet passed to onSegmentComplete, guarded by tailMutex
 
 	turbo bool
+
+	shuttingDown bool // set by Shutdown, guarded by both locks
 }
 
 // New creates a new durable queue
 func New(name string, dirPath string, itemsPerSegment int, builder func() interface{}) (*DQue, error) {
+	return NewWithOptions(name, dirPath, itemsPerSegment, builder, Options{})
+}
+
+// NewWithOptions creates a new durable queue with the given options.
+func NewWithOptions(name string, dirPath string, itemsPerSegment int, builder func() interface{}, opts Options) (*DQue, error) {
 
 	// Validation
-	if len(name) == 0 {
-		return nil, errors.New("the queue name requires a value")
+	if err := checkName(name); err != nil {
+		return nil, err
 	}
 	if len(dirPath) == 0 {
 		return nil, errors.New("the queue directory requires a value")
 	}
-	if !dirExists(dirPath) {
+	if itemsPerSegment < 1 {
+		return nil, errors.New("the number of items per segment must be positive")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := opts.storage()
+	if !dirExists(fs, dirPath) {
 		return nil, errors.New("the given queue directory is not valid: " + dirPath)
 	}
-	fullPath := path.Join(dirPath, name)
-	if dirExists(fullPath) {
-		return nil, errors.New("the given queue directory already exists: " + fullPath + ". Use Open instead")
+	absPath, err := absDir(fs, dirPath)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := os.Mkdir(fullPath, 0755); err != nil {
-		return nil, errors.Wrap(err, "error creating queue directory "+fullPath)
+	fullPath := path.Join(absPath, name)
+	if dirExists(fs, fullPath) {
+		return nil, errors.New("the given queue directory already exists: " + fullPath + ". Use Open instead")
 	}
 
 	q := DQue{Name: name, DirPath: dirPath}
 	q.fullPath = fullPath
-	q.config.ItemsPerSegment = itemsPerSegment
-	q.builder = builder
-	q.emptyCond = sync.NewCond(&q.mutex)
+	if err := q.applyOptions(itemsPerSegment, builder, opts); err != nil {
+		return nil, err
+	}
+
+	// Check the builder before anything is created
+	if err := q.checkBuilder(); err != nil {
+		return nil, err
+	}
+
+	if err := fs.Mkdir(fullPath, q.config.dirPerm()); err != nil {
+		return nil, errors.Wrap(err, "error creating queue directory "+fullPath)
+	}
 
 	if err := q.lock(); err != nil {
 		return nil, err
 	}
 
 	if err := q.load(); err != nil {
-		er := q.fileLock.Unlock()
+		er := q.fileLock.Close()
 		if er != nil {
 			return nil, er
 		}
 		return nil, err
 	}
 
+	q.rates.start(q.config.now())
+	q.leak = newLeakDetector(&q)
 	return &q, nil
 }
 
-// Open opens an existing durable queue.
+// applyOptions sets up the configuration of a queue being created or
+// opened from the arguments given to its constructor.  The options must
+// already be validated.
+func (q *DQue) applyOptions(itemsPerSegment int, builder func() interface{}, opts Options) error {
+	var err error
+	q.config.ItemsPerSegment = itemsPerSegment
+	q.config.Compression = opts.Compression
+	q.config.Codec = opts.Codec
+	q.config.DirMode = opts.DirMode
+	q.config.FileMode = opts.FileMode
+	q.config.SegmentPrefix = opts.SegmentPrefix
+	q.config.SegmentWidth = opts.SegmentWidth
+	q.config.logger = opts.Logger
+	q.config.onPoison = opts.OnPoison
+	q.config.builders = opts.Builders
+	q.config.lazyDecode = opts.LazyDecode || opts.WriteOnly
+	q.config.writeOnly = opts.WriteOnly
+	q.config.syncTimeout = opts.SyncTimeout
+	q.config.checkpointEvery = opts.CheckpointEvery
+	q.config.idleTimeout = opts.IdleTimeout
+	q.config.maxSegmentBytes = opts.MaxSegmentBytes
+	q.config.retainConsumed = opts.RetainConsumed
+	q.config.clock = opts.Clock
+	q.config.persistDedup = opts.PersistDedup
+	if opts.EncryptionKey != nil {
+		if q.config.encryption, err = newEncryption(opts.EncryptionKey); err != nil {
+			return err
+		}
+	}
+	q.config.Storage = opts.storage()
+	q.config.observer.set(opts.Observer)
+	if err := opts.registerGobTypes(); err != nil {
+		return err
+	}
+	if q.builder, err = opts.builder(builder); err != nil {
+		return err
+	}
+	q.emptyCond = sync.NewCond(&q.mutex)
+	q.config.syncs = &q.syncs
+	return nil
+}
+
+// Open opens an existing durable queue.  The itemsPerSegment recorded when
+// the queue was created is used rather than the given value.
 func Open(name string, dirPath string, itemsPerSegment int, builder func() interface{}) (*DQue, error) {
+	return OpenWithOptions(name, dirPath, itemsPerSegment, builder, Options{})
+}
+
+// OpenWithOptions opens an existing durable queue with the given options.
+// Settings recorded on disk when the queue was created, including
+// itemsPerSegment, take precedence.
+func OpenWithOptions(name string, dirPath string, itemsPerSegment int, builder func() interface{}, opts Options) (*DQue, error) {
 
 	// Validation
-	if len(name) == 0 {
-		return nil, errors.New("the queue name requires a value")
+	if err := checkName(name); err != nil {
+		return nil, err
 	}
 	if len(dirPath) == 0 {
 		return nil, errors.New("the queue directory requires a value")
 	}
-	if !dirExists(dirPath) {
+	if itemsPerSegment < 1 {
+		return nil, errors.New("the number of items per segment must be positive")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := opts.storage()
+	if !dirExists(fs, dirPath) {
 		return nil, errors.New("the given queue directory is not valid (" + dirPath + ")")
 	}
-	fullPath := path.Join(dirPath, name)
-	if !dirExists(fullPath) {
+	absPath, err := absDir(fs, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	fullPath := path.Join(absPath, name)
+	if !dirExists(fs, fullPath) {
 		return nil, errors.New("the given queue does not exist (" + fullPath + ")")
 	}
 
 	q := DQue{Name: name, DirPath: dirPath}
 	q.fullPath = fullPath
-	q.config.ItemsPerSegment = itemsPerSegment
-	q.builder = builder
-	q.emptyCond = sync.NewCond(&q.mutex)
+	if err := q.applyOptions(itemsPerSegment, builder, opts); err != nil {
+		return nil, err
+	}
 
 	if err := q.lock(); err != nil {
 		return nil, err
 	}
 
 	if err := q.load(); err != nil {
-		er := q.fileLock.Unlock()
+		er := q.fileLock.Close()
 		if er != nil {
 			return nil, er
 		}
 		return nil, err
 	}
 
+	q.rates.start(q.config.now())
+	q.leak = newLeakDetector(&q)
+	return &q, nil
+}
+
+// OpenWriteOnly opens an existing durable queue for a process that only
+// enqueues.  The items already in the queue are counted but not decoded,
+// so the queue opens quickly however large it is.  Dequeue, Peek, and the
+// other methods that read items return ErrWriteOnly.  See
+// Options.WriteOnly.
+func OpenWriteOnly(name string, dirPath string, itemsPerSegment int, builder func() interface{}) (*DQue, error) {
+	return OpenWithOptions(name, dirPath, itemsPerSegment, builder, Options{WriteOnly: true})
+}
+
+// OpenReadOnly opens an existing durable queue for inspection.  The queue
+// isn't locked, so it can be opened while another process owns it, and its
+// files are never written to.  Enqueue, Dequeue, and the other methods that
+// would change the queue return ErrReadOnly, while Peek, PeekN, Iterate,
+// and Size work.  The queue holds the items that were on disk when it was
+// opened; open it again to see later changes.
+func OpenReadOnly(name string, dirPath string, itemsPerSegment int, builder func() interface{}) (*DQue, error) {
+	return OpenReadOnlyWithOptions(name, dirPath, itemsPerSegment, builder, Options{})
+}
+
+// OpenReadOnlyWithOptions opens an existing durable queue for inspection
+// with the given options, such as the Storage or EncryptionKey the queue's
+// owner uses.  See OpenReadOnly.  A read-only queue can't be WriteOnly.
+func OpenReadOnlyWithOptions(name string, dirPath string, itemsPerSegment int, builder func() interface{}, opts Options) (*DQue, error) {
+
+	// Validation
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if len(dirPath) == 0 {
+		return nil, errors.New("the queue directory requires a value")
+	}
+	if itemsPerSegment < 1 {
+		return nil, errors.New("the number of items per segment must be positive")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.WriteOnly {
+		return nil, errors.New("a read-only queue can't be write-only")
+	}
+	fs := opts.storage()
+	absPath, err := absDir(fs, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	fullPath := path.Join(absPath, name)
+	if !dirExists(fs, fullPath) {
+		return nil, errors.New("the given queue does not exist (" + fullPath + ")")
+	}
+
+	q := DQue{Name: name, DirPath: dirPath}
+	q.fullPath = fullPath
+	if err := q.applyOptions(itemsPerSegment, builder, opts); err != nil {
+		return nil, err
+	}
+	q.config.readOnly = true
+
+	// The lock is never taken, but Close expects one
+	q.fileLock = nopLock{}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	q.rates.start(q.config.now())
+	q.leak = newLeakDetector(&q)
 	return &q, nil
 }
 
 // NewOrOpen either creates a new queue or opens an existing durable queue.
 func NewOrOpen(name string, dirPath string, itemsPerSegment int, builder func() interface{}) (*DQue, error) {
+	return NewOrOpenWithOptions(name, dirPath, itemsPerSegment, builder, Options{})
+}
+
+// NewOrOpenWithOptions either creates a new queue or opens an existing
+// durable queue with the given options.
+func NewOrOpenWithOptions(name string, dirPath string, itemsPerSegment int, builder func() interface{}, opts Options) (*DQue, error) {
 
 	// Validation
-	if len(name) == 0 {
-		return nil, errors.New("the queue name requires a value")
+	if err := checkName(name); err != nil {
+		return nil, err
 	}
 	if len(dirPath) == 0 {
 		return nil, errors.New("the queue directory requires a value")
 	}
-	if !dirExists(dirPath) {
+	if itemsPerSegment < 1 {
+		return nil, errors.New("the number of items per segment must be positive")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := opts.storage()
+	if !dirExists(fs, dirPath) {
 		return nil, errors.New("the given queue directory is not valid (" + dirPath + ")")
 	}
-	fullPath := path.Join(dirPath, name)
-	if dirExists(fullPath) {
-		return Open(name, dirPath, itemsPerSegment, builder)
+	absPath, err := absDir(fs, dirPath)
+	if err != nil {
+		return nil, err
 	}
+	fullPath := path.Join(absPath, name)
+	if dirExists(fs, fullPath) {
+		return OpenWithOptions(name, dirPath, itemsPerSegment, builder, opts)
+	}
+
+	return NewWithOptions(name, dirPath, itemsPerSegment, builder, opts)
+}
 
-	return New(name, dirPath, itemsPerSegment, builder)
+// NewOrOpenFallible is NewOrOpen for a builder that can fail.  See
+// Options.FallibleBuilder.
+func NewOrOpenFallible(name string, dirPath string, itemsPerSegment int, builder func() (interface{}, error)) (*DQue, error) {
+	return NewOrOpenWithOptions(name, dirPath, itemsPerSegment, nil, Options{FallibleBuilder: builder})
 }
 
 // Close releases the lock on the queue rendering it unusable for further usage by this instance.
 // Close will return an error if it has already been called.
+//
+// Changes not yet synced, such as those made with turbo on, are synced
+// first.  Close carries on past a step that fails, so the segment files and
+// the lock are always released and the queue is always closed.  The errors
+// of every step that failed are returned together.
 func (q *DQue) Close() error {
 	// only allow Close while no other function is active
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.lockAll()
+	defer q.unlockAll()
 
 	if q.fileLock == nil {
 		return ErrQueueClosed
 	}
 
-	err := q.fileLock.Close()
-	if err != nil {
-		return err
+	var errs closeErrors
+
+	// Record the items dequeued since the last checkpoint
+	errs.add(q.firstSegment.checkpoint())
+
+	// Sync whatever may not be on disk yet
+	segments := []*qSegment{q.firstSegment}
+	if q.firstSegment != q.lastSegment {
+		segments = append(segments, q.lastSegment)
+	}
+	for _, seg := range segments {
+		errs.add(seg.flush())
 	}
 
 	// Finally mark this instance as closed to prevent any further access
+	errs.add(q.fileLock.Close())
 	q.fileLock = nil
+	atomic.StoreInt64(&q.count, 0)
+	q.signalEmpty()
+	q.leak.stop()
+	q.stopTurboSyncer()
+	q.rates.stop()
+
+	// Don't leave a read-ahead running with files open
+	q.invalidateReadAhead()
+	q.readAhead.wg.Wait()
 
 	// Wake-up any waiting goroutines for blocking queue access - they should get a ErrQueueClosed
 	q.emptyCond.Broadcast()
 
 	// Close the first and last segments' file handles
-	if err = q.firstSegment.close(); err != nil {
-		return err
-	}
-	if q.firstSegment != q.lastSegment {
-		if err = q.lastSegment.close(); err != nil {
-			return err
-		}
+	for _, seg := range segments {
+		errs.add(seg.close())
 	}
 
 	// Safe-guard ourself from accidentally using segments after closing the queue
 	q.firstSegment = nil
 	q.lastSegment = nil
 
-	return nil
+	return errs.err()
 }
 
-// Enqueue adds an item to the end of the queue
-func (q *DQue) Enqueue(obj interface{}) error {
-	// This is heavy-handed but its safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
-
+// shutdownPollInterval is how often Shutdown checks whether the queue has
+// been drained.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown closes the queue once its items have been dequeued.  New items
+// are refused with ErrShuttingDown from the moment it is called, while
+// dequeues carry on until the queue is empty or ctx is done, and then the
+// queue is closed.  Items left when ctx is done stay on disk and ctx.Err()
+// is returned.  Goroutines blocked in DequeueBlock get ErrQueueClosed.
+func (q *DQue) Shutdown(ctx context.Context) error {
+	q.lockAll()
 	if q.fileLock == nil {
+		q.unlockAll()
 		return ErrQueueClosed
 	}
+	q.shuttingDown = true
+	q.unlockAll()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var ctxErr error
+	for ctxErr == nil && atomic.LoadInt64(&q.count) > 0 {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		case <-ticker.C:
+		}
+	}
 
-	// If this segment is full then create a new one
-	if q.lastSegment.sizeOnDisk() >= q.config.ItemsPerSegment {
+	if err := q.Close(); err != nil {
+		return err
+	}
+	return ctxErr
+}
 
-		// We have filled our last segment to capacity, so create a new one
-		seg, err := newQueueSegment(q.fullPath, q.lastSegment.number+1, q.turbo, q.builder)
-		if err != nil {
-			return errors.Wrapf(err, "error creating new queue segment: %d.", q.lastSegment.number+1)
-		}
+// IsClosed returns true if Close has been called on the queue.
+func (q *DQue) IsClosed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-		// If the last segment is not the first segment
-		// then we need to close the file.
-		if q.firstSegment != q.lastSegment {
-			var err = q.lastSegment.close()
-			if err != nil {
-				return errors.Wrapf(err, "error closing previous segment file #%d.", q.lastSegment.number)
-			}
-		}
+	return q.fileLock == nil
+}
 
-		// Replace the last segment with the new one
-		q.lastSegment = seg
+// leakDetector logs a warning if it is garbage-collected along with a queue
+// that was never closed, which leaks the queue's file handles and its lock.
+// The finalizer is set on the detector rather than on the queue because the
+// queue refers to itself, and a cycle with a finalizer is never collected.
+// The queue is not closed for the caller.
+type leakDetector struct {
+	fullPath string
+	logger   Logger
+}
+
+func newLeakDetector(q *DQue) *leakDetector {
+	d := &leakDetector{fullPath: q.fullPath, logger: q.config.logger}
+	runtime.SetFinalizer(d, func(d *leakDetector) {
+		cfg := config{logger: d.logger}
+		cfg.logf("dque: queue %s was garbage-collected without being closed", d.fullPath)
+	})
+	return d
+}
 
+// stop is called when the queue is closed.  It does nothing on a nil
+// detector.
+func (d *leakDetector) stop() {
+	if d != nil {
+		runtime.SetFinalizer(d, nil)
 	}
+}
 
-	// Add the object to the last segment
-	if err := q.lastSegment.add(obj); err != nil {
-		return errors.Wrap(err, "error adding item to the last segment")
+// Enqueue adds an item to the end of the queue.  The item must be of the
+// pointer type returned by the queue's builder, which is the type Dequeue
+// returns, whether the item is still in memory or is read back from disk.
+func (q *DQue) Enqueue(obj interface{}) error {
+	if err := q.checkItem(obj); err != nil {
+		return err
 	}
+	added, err := q.enqueue(obj)
+	if added {
+		// Wakeup any goroutine that is currently waiting for an item to be enqueued
+		q.signalNotEmpty()
 
-	// Wakeup any goroutine that is currently waiting for an item to be enqueued
-	q.emptyCond.Broadcast()
+		q.observeEnqueue()
+	}
+	return err
+}
 
-	return nil
+// EnqueueContext is Enqueue for callers that must not wait once ctx is done.
+// A write or sync already under way can't be interrupted, but ctx is checked
+// before the item is written, and if the queue's files implement
+// ContextSyncer they are synced with ctx.  ctx.Err() is returned if ctx is
+// done before the item is written.  An error from a sync that gave up
+// leaves the item in the queue, though it may not have reached the disk.
+func (q *DQue) EnqueueContext(ctx context.Context, obj interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := q.checkItem(obj); err != nil {
+		return err
+	}
+	added, err := q.enqueueContext(ctx, obj)
+	if added {
+		// Wakeup any goroutine that is currently waiting for an item to be enqueued
+		q.signalNotEmpty()
+
+		q.observeEnqueue()
+	}
+	return err
 }
 
-// Dequeue removes and returns the first item in the queue.
-// When the queue is empty, nil and dque.ErrEmpty are returned.
-func (q *DQue) Dequeue() (interface{}, error) {
-	// This is heavy-handed but its safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+// EnqueueN adds an item to the end of the queue and returns the size of the
+// queue just after, without another goroutine getting in between.  Unlike
+// Enqueue, it blocks dequeues while it runs.
+func (q *DQue) EnqueueN(obj interface{}) (int, error) {
+	if err := q.checkItem(obj); err != nil {
+		return 0, err
+	}
+	size, err := q.enqueueN(obj)
+	if size > 0 {
+		// Wakeup any goroutine that is currently waiting for an item to be enqueued
+		q.signalNotEmpty()
 
-	return q.dequeueLocked()
+		q.observeEnqueue()
+	}
+	return size, err
 }
 
-func (q *DQue) dequeueLocked() (interface{}, error) {
+func (q *DQue) enqueueN(obj interface{}) (int, error) {
+	defer q.notifySegmentsComplete()
+
+	// The head lock keeps the size from changing before it is read
+	q.lockAll()
+	defer q.unlockAll()
+
 	if q.fileLock == nil {
-		return nil, ErrQueueClosed
+		return 0, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return 0, ErrReadOnly
+	}
+	if q.shuttingDown {
+		return 0, ErrShuttingDown
 	}
 
-	// Remove the first object from the first segment
-	obj, err := q.firstSegment.remove()
-	if err == errEmptySegment {
-		return nil, ErrEmpty
+	// If this segment is full then create a new one
+	if err := q.rollLastSegment(); err != nil {
+		return 0, err
+	}
+
+	// Add the object to the last segment.  An item whose sync failed is
+	// still counted, along with the error.
+	added, err := q.lastSegment.addContext(context.Background(), obj)
+	if !added {
+		return 0, errors.Wrap(err, "error adding item to the last segment")
 	}
+	size := int(atomic.AddInt64(&q.count, 1))
 	if err != nil {
-		return nil, errors.Wrap(err, "error removing item from the first segment")
+		return size, errors.Wrap(err, "error syncing item added to the last segment")
 	}
+	return size, nil
+}
 
-	// If this segment is empty and we've reached the max for this segment
-	// then delete the file and open the next one.
-	if q.firstSegment.size() == 0 &&
-		q.firstSegment.sizeOnDisk() >= q.config.ItemsPerSegment {
-
-		// Delete the segment file
-		if err := q.firstSegment.delete(); err != nil {
-			return obj, errors.Wrap(err, "error deleting queue segment "+q.firstSegment.filePath()+". Queue is in an inconsistent state")
-		}
+// EnqueueBytes adds a byte slice to the end of a queue created with
+// CodecBytes.  The slice must not be modified after it is enqueued.
+func (q *DQue) EnqueueBytes(b []byte) error {
+	if q.config.Codec != CodecBytes {
+		return errors.New("DQue.EnqueueBytes() requires a queue created with CodecBytes")
+	}
+	return q.Enqueue(b)
+}
 
-		// We have only one segment and it's now empty so destroy it and
-		// create a new one.
-		if q.firstSegment.number == q.lastSegment.number {
+// EnqueueFront adds an item to the head of the queue so it is the next item
+// dequeued.
+func (q *DQue) EnqueueFront(obj interface{}) error {
+	return q.Prepend([]interface{}{obj})
+}
 
-			// Create the next segment
-			seg, err := newQueueSegment(q.fullPath, q.firstSegment.number+1, q.turbo, q.builder)
-			if err != nil {
-				return obj, errors.Wrap(err, "error creating new segment. Queue is in an inconsistent state")
-			}
-			q.firstSegment = seg
-			q.lastSegment = seg
+// PrependOrdered adds the items to the head of the queue so that items[0] is
+// the next item dequeued, items[1] the one after it, and so on, followed by
+// every item already in the queue.  It is the same as Prepend, whose items
+// have always been dequeued in the order given; the name spells out the
+// order for readers of the calling code.
+func (q *DQue) PrependOrdered(items []interface{}) error {
+	return q.Prepend(items)
+}
 
-		} else {
+// Prepend adds the items to the head of the queue.  They are dequeued in the
+// order given, before every item already in the queue.  The items are added
+// to the first segment when they fit, which is the common case, and to new
+// segments before it when they don't.
+//
+// An error is returned if no items are given or if one of them is nil.
+func (q *DQue) Prepend(objects []interface{}) error {
+	if len(objects) == 0 {
+		return errors.New("DQue.Prepend() requires at least one item")
+	}
+	for i, obj := range objects {
+		if obj == nil {
+			return errors.Errorf("DQue.Prepend() can't add a nil item (index %d)", i)
+		}
+		if err := q.checkItem(obj); err != nil {
+			return errors.Wrapf(err, "DQue.Prepend() can't add item %d", i)
+		}
+	}
 
-			if q.firstSegment.number+1 == q.lastSegment.number {
-				// We have 2 segments, moving down to 1 shared segment
-				q.firstSegment = q.lastSegment
-			} else {
+	written, err := q.prepend(objects)
+	if written > 0 {
+		atomic.AddInt64(&q.count, int64(written))
 
-				// Open the next segment
-				seg, err := openQueueSegment(q.fullPath, q.firstSegment.number+1, q.turbo, q.builder)
-				if err != nil {
-					return obj, errors.Wrap(err, "error creating new segment. Queue is in an inconsistent state")
-				}
-				q.firstSegment = seg
-			}
+		// Wakeup any goroutine that is currently waiting for an item to be enqueued
+		q.signalNotEmpty()
 
-		}
+		q.observeEnqueueN(written)
 	}
-
-	return obj, nil
+	return err
 }
 
-// Peek returns the first item in the queue without dequeueing it.
-// When the queue is empty, nil and dque.ErrEmpty are returned.
-// Do not use this method with multiple dequeueing threads or you may regret it.
-func (q *DQue) Peek() (interface{}, error) {
+// prepend adds the objects to the head of the queue and returns how many of
+// them are in the queue, which is some of them if an error is returned part
+// way through.
+func (q *DQue) prepend(objects []interface{}) (int, error) {
 	// This is heavy-handed but it is safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
-
-	return q.peekLocked()
-}
+	q.lockAll()
+	defer q.unlockAll()
 
-func (q *DQue) peekLocked() (interface{}, error) {
 	if q.fileLock == nil {
-		return nil, ErrQueueClosed
+		return 0, ErrQueueClosed
 	}
-
-	// Return the first object from the first segment
-	obj, err := q.firstSegment.peek()
-	if err == errEmptySegment {
-		return nil, ErrEmpty
+	if q.config.readOnly {
+		return 0, ErrReadOnly
 	}
-	if err != nil {
-		// In reality this will (i.e. should not) never happen
-		return nil, errors.Wrap(err, "error getting item from the first segment")
+	if q.shuttingDown {
+		return 0, ErrShuttingDown
 	}
 
-	return obj, nil
-}
+	// The first segment takes as many of the last items as it has room for
+	perSegment := q.config.ItemsPerSegment
+	room := perSegment - q.firstSegment.size()
+	if room < 0 {
+		room = 0
+	}
+	rest := len(objects) - room
+	if rest <= 0 || !q.segmentsFreeBefore((rest+perSegment-1)/perSegment) {
+		// Everything fits, or there's nowhere to put the rest, so rewrite the
+		// first segment with all of the items at its head
+		if err := q.firstSegment.prepend(objects); err != nil {
+			return 0, errors.Wrap(err, "error adding items to the first segment")
+		}
+		return len(objects), nil
+	}
+	written := 0
+	if room > 0 {
+		if err := q.firstSegment.prepend(objects[rest:]); err != nil {
+			return 0, errors.Wrap(err, "error adding items to the first segment")
+		}
+		written = room
+	}
 
-// DequeueBlock behaves similar to Dequeue, but is a blocking call until an item is available.
+	// Fill full segments before the first one, working backwards so the
+	// partial one ends up first
+	for end := rest; end > 0; end -= perSegment {
+		start := end - perSegment
+		if start < 0 {
+			start = 0
+		}
+		number := q.firstSegment.number - 1
+		seg, err := newQueueSegment(q.fullPath, number, q.turbo, q.builder, &q.config)
+		if err != nil {
+			return written, errors.Wrapf(err, "error creating new queue segment: %d.", number)
+		}
+		q.config.observer.segmentCreated(seg.number)
+		var addErr error
+		for _, obj := range objects[start:end] {
+			added, err := seg.addContext(context.Background(), obj)
+			if added {
+				written++
+			}
+			if err != nil {
+				addErr = errors.Wrap(err, "error adding item to the first segment")
+				break
+			}
+		}
+		if seg.size() == 0 {
+			// Nothing made it in, so the segment isn't needed
+			if err := seg.delete(); err != nil {
+				q.config.logf("dque: unable to delete unused segment %d: %v", seg.number, err)
+			}
+			return written, addErr
+		}
+
+		// Replace the first segment with the new one, even if it holds only
+		// some of its items.  Only the first and last segments are kept open.
+		old := q.firstSegment
+		q.firstSegment = seg
+		if old != q.lastSegment {
+			if err := old.close(); err != nil && addErr == nil {
+				addErr = errors.Wrapf(err, "error closing previous segment file #%d.", old.number)
+			}
+		}
+		if addErr != nil {
+			return written, addErr
+		}
+	}
+	return written, nil
+}
+
+// segmentsFreeBefore returns true if the given number of segments can be
+// created before the first segment.
+func (q *DQue) segmentsFreeBefore(count int) bool {
+	for number := q.firstSegment.number - count; number < q.firstSegment.number; number++ {
+		if number < 0 || fileExists(q.config.fs(), path.Join(q.fullPath, q.config.segmentFileName(number))) {
+			return false
+		}
+	}
+	return true
+}
+
+// enqueue adds an item to the last segment.  Only the tail lock is held
+// unless the last segment is full.  added is true if the item is in the
+// queue, which it can be along with an error if its sync failed.  The
+// caller then signals waiting consumers.
+func (q *DQue) enqueue(obj interface{}) (added bool, err error) {
+	return q.enqueueContext(context.Background(), obj)
+}
+
+// enqueueContext is enqueue, giving up if ctx is done by the time the tail
+// lock is taken.
+func (q *DQue) enqueueContext(ctx context.Context, obj interface{}) (added bool, err error) {
+	defer q.notifySegmentsComplete()
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	if q.fileLock == nil {
+		return false, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return false, ErrReadOnly
+	}
+	if q.shuttingDown {
+		return false, ErrShuttingDown
+	}
+
+	// If this segment is full then create a new one
+	if q.segmentFull(q.lastSegment) {
+
+		// Rolling over needs to know whether the last segment is also the
+		// first, so take the head lock too (always before the tail lock).
+		q.tailMutex.Unlock()
+		q.mutex.Lock()
+		q.tailMutex.Lock()
+		err := q.rollLastSegment()
+		q.mutex.Unlock()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Add the object to the last segment.  An item whose sync failed is
+	// still counted, along with the error.
+	added, err = q.lastSegment.addContext(ctx, obj)
+	if !added {
+		return false, errors.Wrap(err, "error adding item to the last segment")
+	}
+	atomic.AddInt64(&q.count, 1)
+	if err != nil {
+		return true, errors.Wrap(err, "error syncing item added to the last segment")
+	}
+
+	return true, nil
+}
+
+// enqueueLocked adds obj to the end of the queue as enqueue does, for a
+// caller that already holds both locks.  The caller signals and observes
+// the item if it was added.
+func (q *DQue) enqueueLocked(obj interface{}) (added bool, err error) {
+	if q.fileLock == nil {
+		return false, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return false, ErrReadOnly
+	}
+	if q.shuttingDown {
+		return false, ErrShuttingDown
+	}
+	if err := q.rollLastSegment(); err != nil {
+		return false, err
+	}
+
+	added, err = q.lastSegment.addContext(context.Background(), obj)
+	if !added {
+		return false, errors.Wrap(err, "error adding item to the last segment")
+	}
+	atomic.AddInt64(&q.count, 1)
+	if err != nil {
+		return true, errors.Wrap(err, "error syncing item added to the last segment")
+	}
+	return true, nil
+}
+
+// rollLastSegment replaces a full last segment with a new one.  Both locks
+// must be held.
+func (q *DQue) rollLastSegment() error {
+	// Things may have changed while the locks were released
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if !q.segmentFull(q.lastSegment) {
+		return nil
+	}
+
+	// We have filled our last segment to capacity, so create a new one
+	seg, err := newQueueSegment(q.fullPath, q.lastSegment.number+1, q.turbo, q.builder, &q.config)
+	if err != nil {
+		return errors.Wrapf(err, "error creating new queue segment: %d.", q.lastSegment.number+1)
+	}
+	q.config.observer.segmentCreated(seg.number)
+
+	// Replace the last segment with the new one before closing the old
+	// one, so a failed close can't leave us trying to recreate it
+	old := q.lastSegment
+	q.lastSegment = seg
+	if q.onSegmentComplete != nil {
+		q.completed = append(q.completed, old.number)
+	}
+
+	// If the old last segment is not the first segment
+	// then we need to close the file.
+	if q.firstSegment != old {
+		if err := old.close(); err != nil {
+			return errors.Wrapf(err, "error closing previous segment file #%d.", old.number)
+		}
+	}
+
+	// In ring mode the oldest segments make room for the new one
+	for q.maxSegments > 0 && q.lastSegment.number-q.firstSegment.number+1 > q.maxSegments {
+		n := q.firstSegment.size()
+		if err := q.advanceFirstSegment(); err != nil {
+			return err
+		}
+		q.countRemoved(int64(n))
+		q.dropped += n
+	}
+	return nil
+}
+
+// SetMaxSegments turns the queue into a ring buffer of at most n segments.
+// When enqueueing starts a new segment that would make more than n, the
+// items of the first segment are discarded and its file is deleted, so the
+// queue keeps the newest items instead of growing.  Discarded items are
+// counted in Stats.  Zero, the default, lets the queue grow without limit.
+// The limit is not recorded, so set it every time the queue is opened.
+func (q *DQue) SetMaxSegments(n int) {
+	q.lockAll()
+	defer q.unlockAll()
+
+	if n < 0 {
+		n = 0
+	}
+	q.maxSegments = n
+}
+
+// OnSegmentComplete sets a function called each time enqueueing fills the
+// last segment and starts a new one, with the path and number of the
+// segment that was filled.  No more items are written to that segment
+// file, so it can be copied elsewhere, such as for archival, though it may
+// already have been dequeued and deleted by the time fn runs.  fn is called
+// on the goroutine that enqueued the item, after the queue's locks are
+// released, so it may block without holding up the queue.  Passing nil
+// removes the function.
+func (q *DQue) OnSegmentComplete(fn func(path string, number int)) {
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
+
+	q.onSegmentComplete = fn
+	q.completed = nil
+}
+
+// notifySegmentsComplete passes the segments filled since it was last
+// called to the OnSegmentComplete function.  No lock may be held.
+func (q *DQue) notifySegmentsComplete() {
+	q.tailMutex.Lock()
+	fn, completed := q.onSegmentComplete, q.completed
+	q.completed = nil
+	q.tailMutex.Unlock()
+
+	for _, num := range completed {
+		fn(path.Join(q.fullPath, q.config.segmentFileName(num)), num)
+	}
+}
+
+// signalNotEmpty wakes the goroutines blocked waiting for an item.  The head
+// lock is only taken when somebody is actually waiting.
+func (q *DQue) signalNotEmpty() {
+	if atomic.LoadInt32(&q.waiters) > 0 {
+		q.mutex.Lock()
+		q.emptyCond.Broadcast()
+		q.mutex.Unlock()
+	}
+}
+
+// EmptyC returns a channel that is closed when the queue next becomes empty,
+// so a coordinator can wait for consumers to drain it without polling Size.
+// The channel is closed when a Dequeue, or anything else that removes items,
+// takes the last one, and when the queue is cleared or closed.  A new
+// channel is handed out after that.  If the queue is already empty, the
+// channel returned is already closed.
+func (q *DQue) EmptyC() <-chan struct{} {
+	q.emptyMutex.Lock()
+	defer q.emptyMutex.Unlock()
+
+	if atomic.LoadInt64(&q.count) == 0 {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	if q.emptyC == nil {
+		q.emptyC = make(chan struct{})
+	}
+	return q.emptyC
+}
+
+// countRemoved takes n removed items off the count and signals EmptyC if
+// that leaves the queue empty.
+func (q *DQue) countRemoved(n int64) {
+	if atomic.AddInt64(&q.count, -n) == 0 {
+		q.signalEmpty()
+	}
+}
+
+// signalEmpty closes the channel handed out by EmptyC.
+func (q *DQue) signalEmpty() {
+	q.emptyMutex.Lock()
+	defer q.emptyMutex.Unlock()
+
+	if q.emptyC != nil {
+		close(q.emptyC)
+		q.emptyC = nil
+	}
+}
+
+// Dequeue removes and returns the first item in the queue.
+// When the queue is empty, nil and dque.ErrEmpty are returned.  Once the
+// queue is closed, dque.ErrQueueClosed is returned instead, so a consumer
+// loop can wait and retry on ErrEmpty but stop on ErrQueueClosed.  If the
+// item is removed but the removal can't be synced to disk, such as with
+// ErrSyncTimeout, the item is returned along with the error, as it is no
+// longer in the queue.
+func (q *DQue) Dequeue() (interface{}, error) {
+	// This is heavy-handed but its safe
+	q.mutex.Lock()
+	obj, err := q.dequeueLocked()
+	q.mutex.Unlock()
+
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return obj, err
+}
+
+// DequeueContext is Dequeue for callers that must not wait once ctx is
+// done.  ctx.Err() is returned, and nothing is dequeued, if ctx is done
+// before or while waiting for other callers to finish with the queue.
+func (q *DQue) DequeueContext(ctx context.Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	if err := ctx.Err(); err != nil {
+		q.mutex.Unlock()
+		return nil, err
+	}
+	obj, err := q.dequeueLocked()
+	q.mutex.Unlock()
+
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return obj, err
+}
+
+// ItemMeta tells where a dequeued item was kept, to help find it on disk.
+type ItemMeta struct {
+	Segment  int    // number of the segment that held the item
+	Path     string // path of the segment file
+	Position int    // place of the item among the records of the segment file, counting from zero
+}
+
+// DequeueWithMeta is Dequeue, also returning which segment file the item
+// was in and where in it.  The position counts the items written to the
+// file before this one, including those since removed, but not removal
+// markers.  Compacting or otherwise rewriting a segment renumbers the
+// positions of the items left in it.
+func (q *DQue) DequeueWithMeta() (interface{}, ItemMeta, error) {
+	var meta ItemMeta
+	as := func(seg *qSegment, index int, object interface{}) (interface{}, error) {
+		meta = ItemMeta{Segment: seg.number, Path: seg.filePath(), Position: seg.removeCount + index}
+		return seg.item(object)
+	}
+
+	q.mutex.Lock()
+	obj, err := q.dequeueAsLocked(as)
+	q.mutex.Unlock()
+
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return obj, meta, err
+}
+
+// DequeueBytes removes and returns the first byte slice in a queue created
+// with CodecBytes.
+// When the queue is empty, nil and dque.ErrEmpty are returned.
+func (q *DQue) DequeueBytes() ([]byte, error) {
+	if q.config.Codec != CodecBytes {
+		return nil, errors.New("DQue.DequeueBytes() requires a queue created with CodecBytes")
+	}
+	obj, err := q.Dequeue()
+	if obj == nil {
+		return nil, err
+	}
+	return obj.([]byte), err
+}
+
+// TryDequeue removes and returns the first item in the queue.  False is
+// returned when the queue is empty, without the cost of an error, and also
+// when Dequeue would have returned an error, such as after Close.  Use
+// Dequeue to find out why.
+func (q *DQue) TryDequeue() (interface{}, bool) {
+	q.mutex.Lock()
+	var obj interface{}
+	if q.fileLock != nil && q.firstSegment.size() > 0 {
+		// An item is returned even if moving to the next segment failed
+		obj, _ = q.dequeueLocked()
+	}
+	q.mutex.Unlock()
+
+	if obj == nil {
+		return nil, false
+	}
+	q.observeDequeue()
+	return obj, true
+}
+
+// TryPeek returns the first item in the queue without dequeueing it.  Like
+// TryDequeue, false is returned when the queue is empty or Peek would have
+// returned an error.
+func (q *DQue) TryPeek() (interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.fileLock == nil || q.firstSegment.size() == 0 {
+		return nil, false
+	}
+	obj, err := q.peekLocked()
+	return obj, err == nil
+}
+
+// DequeueMatching removes and returns the first item in the queue for which
+// pred returns true.  When skipNonMatching is true, the items before it are
+// removed and discarded, and ErrEmpty is returned if the queue runs out of
+// items without a match.  When it is false, only the first item is
+// considered and ErrNoMatch is returned, leaving the queue unchanged, if it
+// doesn't match.  pred is called while the queue is locked, so it must not
+// use the queue.
+func (q *DQue) DequeueMatching(pred func(obj interface{}) bool, skipNonMatching bool) (interface{}, error) {
+	q.mutex.Lock()
+	var removed int
+	obj, err := func() (interface{}, error) {
+		for {
+			obj, err := q.peekLocked()
+			if err != nil {
+				return nil, err
+			}
+			match := pred(obj)
+			if !match && !skipNonMatching {
+				return nil, ErrNoMatch
+			}
+			if _, err := q.dequeueLocked(); err != nil {
+				return nil, err
+			}
+			removed++
+			if match {
+				return obj, nil
+			}
+		}
+	}()
+	q.mutex.Unlock()
+
+	for i := 0; i < removed; i++ {
+		q.observeDequeue()
+	}
+	return obj, err
+}
+
+func (q *DQue) dequeueLocked() (interface{}, error) {
+	return q.dequeueAsLocked(byObject((*qSegment).item))
+}
+
+// itemConverter converts an object of a segment, at the given index among
+// the segment's objects in memory, to what is returned to the caller.  The
+// segment mutex is held while it is called.
+type itemConverter func(seg *qSegment, index int, object interface{}) (interface{}, error)
+
+// byObject returns an itemConverter that converts an object with the given
+// method of the segment holding it.
+func byObject(as func(seg *qSegment, object interface{}) (interface{}, error)) itemConverter {
+	return func(seg *qSegment, _ int, object interface{}) (interface{}, error) {
+		return as(seg, object)
+	}
+}
+
+// dequeueAsLocked removes the first item in the queue that is due and
+// returns it converted by as.  An item is returned along with an error if it
+// was removed but the removal couldn't be synced, or moving to the next
+// segment failed.  The head lock must be held.
+func (q *DQue) dequeueAsLocked(as itemConverter) (interface{}, error) {
+	if q.fileLock == nil {
+		return nil, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return nil, ErrReadOnly
+	}
+	if q.config.writeOnly {
+		return nil, ErrWriteOnly
+	}
+
+	// Expired items are dropped rather than returned
+	if err := q.dropExpiredLocked(); err != nil {
+		return nil, err
+	}
+
+	// Items scheduled for later are passed over
+	if !q.firstSegment.firstDue(q.config.now().UnixNano()) {
+		obj, err := q.removeDueLocked(as)
+		if err == nil {
+			q.countRemoved(1)
+		}
+		return obj, err
+	}
+
+	// Remove the first object from the first segment
+	seg := q.firstSegment
+	obj, err := seg.removeAs(func(object interface{}) (interface{}, error) { return as(seg, 0, object) })
+	if err == errEmptySegment {
+		return nil, ErrEmpty
+	}
+	if err != nil && obj == nil {
+		return nil, errors.Wrap(err, "error removing item from the first segment")
+	}
+	q.countRemoved(1)
+	var syncErr error
+	if err != nil {
+		// The item is gone from the segment, so it must be handed over
+		syncErr = errors.Wrap(err, "error syncing the removal of an item from the first segment")
+	}
+
+	// If this segment is now empty, and it's either full or not the last
+	// segment, then delete the file and open the next one.  Nothing can be
+	// added to the first segment while the tail lock is held.
+	if q.firstSegment.size() == 0 {
+		q.tailMutex.Lock()
+		err := q.skipEmptyFirstSegments()
+		q.tailMutex.Unlock()
+		if err != nil {
+			return obj, err
+		}
+	}
+
+	return obj, syncErr
+}
+
+// skipEmptyFirstSegments advances past the first segment for as long as it
+// is empty and exhausted.  A segment after the first one can be empty if
+// RemoveWhere took all of its items.  Both locks must be held.
+func (q *DQue) skipEmptyFirstSegments() error {
+	for q.firstSegment.size() == 0 && q.firstSegmentExhausted() {
+		if err := q.advanceFirstSegment(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveWhere removes and returns the first item, searching from the head of
+// the queue, for which pred returns true.  The returned bool is false if no
+// item matched.  pred is called with the queue locked, so it must not call
+// methods on the queue.
+//
+// This is an O(n) operation: segments between the first and the last are
+// read from disk, and the segment holding the item is rewritten without it.
+func (q *DQue) RemoveWhere(pred func(obj interface{}) bool) (interface{}, bool, error) {
+	obj, ok, err := q.removeWhere(pred)
+	if ok {
+		q.countRemoved(1)
+	}
+	if ok && err == nil {
+		q.observeDequeue()
+	}
+	return obj, ok, err
+}
+
+// errFound stops forEachItem once what is looked for has been found.
+var errFound = errors.New("found")
+
+// Contains returns true if pred returns true for any item in the queue,
+// such as to check whether a job is already queued before enqueueing it.
+// The queue is left as it is.  Items are checked in order until one
+// matches, reading the segments between the first and the last from disk,
+// so it is an O(n) operation best kept to small queues.  The queue is
+// locked throughout, so pred sees a consistent view of it but must not call
+// methods on the queue.
+func (q *DQue) Contains(pred func(obj interface{}) bool) (bool, error) {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return false, ErrQueueClosed
+	}
+	if q.config.writeOnly {
+		return false, ErrWriteOnly
+	}
+
+	err := q.forEachItem(func(item interface{}) error {
+		if pred(item) {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// Iterate calls fn with each item in the queue, in order, until fn returns
+// false.  The queue is left as it is, so it works on a read-only queue.
+// Like Contains, it reads the segments between the first and the last from
+// disk and holds the queue locked throughout, so fn must not call methods on
+// the queue.
+func (q *DQue) Iterate(fn func(obj interface{}) bool) error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.writeOnly {
+		return ErrWriteOnly
+	}
+
+	err := q.forEachItem(func(item interface{}) error {
+		if !fn(item) {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return nil
+	}
+	return err
+}
+
+func (q *DQue) removeWhere(pred func(obj interface{}) bool) (interface{}, bool, error) {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return nil, false, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return nil, false, ErrReadOnly
+	}
+	if q.config.writeOnly {
+		return nil, false, ErrWriteOnly
+	}
+
+	// Search the first segment
+	obj, ok, err := q.firstSegment.removeWhere(pred)
+	if err != nil || ok {
+		if err == nil {
+			err = q.skipEmptyFirstSegments()
+		}
+		return obj, ok, err
+	}
+
+	// Search the segments that are only on disk
+	for num := q.firstSegment.number + 1; num < q.lastSegment.number; num++ {
+		seg, err := openQueueSegment(q.fullPath, num, q.turbo, q.builder, &q.config)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "error opening queue segment %d", num)
+		}
+		obj, ok, err := seg.removeWhere(pred)
+		if closeErr := seg.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil || ok {
+			q.invalidateReadAhead()
+			return obj, ok, err
+		}
+	}
+
+	// Search the last segment
+	if q.lastSegment != q.firstSegment {
+		return q.lastSegment.removeWhere(pred)
+	}
+	return nil, false, nil
+}
+
+// firstSegmentExhausted returns true if nothing more will be added to the
+// first segment, either because it is full or because it is not also the
+// last segment (a rewritten segment can hold fewer items than a full one).
+// The tail lock must be held.
+func (q *DQue) firstSegmentExhausted() bool {
+	return q.firstSegment != q.lastSegment ||
+		q.segmentFull(q.firstSegment)
+}
+
+// segmentFull returns true if no more items can be enqueued to the segment,
+// either because it has held ItemsPerSegment of them or because its file has
+// grown to MaxSegmentBytes.
+func (q *DQue) segmentFull(seg *qSegment) bool {
+	if seg.sizeOnDisk() >= q.config.ItemsPerSegment {
+		return true
+	}
+	return q.config.maxSegmentBytes > 0 && seg.bytesOnDisk() >= q.config.maxSegmentBytes
+}
+
+// advanceFirstSegment moves past the exhausted first segment.  Both locks
+// must be held.  The next segment is opened (or created) and swapped in
+// before the old file is deleted, so a failure or crash at any step never leaves the queue
+// referencing a segment file that does not exist.  An exhausted segment file
+// left behind is deleted the next time the queue is loaded.
+func (q *DQue) advanceFirstSegment() error {
+	old := q.firstSegment
+
+	if old.number == q.lastSegment.number {
+		// We have only one segment and it's now empty so create the next one
+		seg, err := newQueueSegment(q.fullPath, old.number+1, q.turbo, q.builder, &q.config)
+		if err != nil {
+			return errors.Wrap(err, "error creating new segment")
+		}
+		q.config.observer.segmentCreated(seg.number)
+		q.firstSegment = seg
+		q.lastSegment = seg
+	} else if old.number+1 == q.lastSegment.number {
+		// We have 2 segments, moving down to 1 shared segment
+		q.firstSegment = q.lastSegment
+	} else {
+		// Open the next segment, unless it was read ahead
+		seg, err := q.takeReadAhead(old.number + 1)
+		if seg == nil && err == nil {
+			seg, err = openQueueSegment(q.fullPath, old.number+1, q.turbo, q.builder, &q.config)
+		}
+		if err != nil {
+			return errors.Wrap(err, "error opening next segment")
+		}
+		q.firstSegment = seg
+	}
+	q.startReadAhead()
+
+	// Keep the exhausted segment file if a cursor still needs it
+	if q.segmentRetained(old.number) {
+		return old.close()
+	}
+
+	// Delete the exhausted segment file
+	if err := old.delete(); err != nil {
+		return errors.Wrap(err, "error deleting queue segment "+old.filePath())
+	}
+	q.config.observer.segmentDeleted(old.number)
+	return nil
+}
+
+// Peek returns the first item in the queue without dequeueing it.
+// When the queue is empty, nil and dque.ErrEmpty are returned, and once it
+// is closed, dque.ErrQueueClosed, as with Dequeue.
+// Do not use this method with multiple dequeueing threads or you may regret it.
+func (q *DQue) Peek() (interface{}, error) {
+	// This is heavy-handed but it is safe
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.peekLocked()
+}
+
+// PeekAvailable returns the first item in the queue without dequeueing it,
+// along with the number of items, including that one, held in memory by the
+// first segment.  That many items can be dequeued without reading another
+// segment from disk.  Like Peek, nothing is removed except expired items.
+// When the queue is empty, nil, 0, and dque.ErrEmpty are returned.
+func (q *DQue) PeekAvailable() (interface{}, int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	obj, err := q.peekLocked()
+	if err != nil {
+		return nil, 0, err
+	}
+	return obj, q.firstSegment.size(), nil
+}
+
+// PeekN returns up to the first n items in the queue without dequeueing
+// them, fewer if the queue holds fewer.  The items are returned in the order
+// Iterate visits them.  When the queue is empty, nil and dque.ErrEmpty are
+// returned.
+func (q *DQue) PeekN(n int) ([]interface{}, error) {
+	if n < 1 {
+		return nil, errors.New("the number of items to peek at must be positive")
+	}
+
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return nil, ErrQueueClosed
+	}
+	if q.config.writeOnly {
+		return nil, ErrWriteOnly
+	}
+
+	var objects []interface{}
+	err := q.forEachItem(func(item interface{}) error {
+		objects = append(objects, item)
+		if len(objects) == n {
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, ErrEmpty
+	}
+	return objects, nil
+}
+
+func (q *DQue) peekLocked() (interface{}, error) {
+	if q.fileLock == nil {
+		return nil, ErrQueueClosed
+	}
+	if q.config.writeOnly {
+		return nil, ErrWriteOnly
+	}
+
+	// Expired items are dropped rather than returned
+	if err := q.dropExpiredLocked(); err != nil {
+		return nil, err
+	}
+
+	// Items scheduled for later are passed over
+	if !q.firstSegment.firstDue(q.config.now().UnixNano()) {
+		return q.peekDueLocked()
+	}
+
+	// Return the first object from the first segment
+	obj, err := q.firstSegment.peek()
+	if err == errEmptySegment {
+		return nil, ErrEmpty
+	}
+	if err != nil {
+		// In reality this will (i.e. should not) never happen
+		return nil, errors.Wrap(err, "error getting item from the first segment")
+	}
+
+	return obj, nil
+}
+
+// DequeueBlock behaves similar to Dequeue, but is a blocking call until an item is available.
+// Callers blocked at the same time get items in the order they started
+// waiting.
 func (q *DQue) DequeueBlock() (interface{}, error) {
+	obj, err := q.block(q.dequeueLocked, forever)
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return obj, err
+}
+
+// DequeueBlockTimeout behaves similar to DequeueBlock, but gives up and
+// returns ErrTimeout if no item is available within the given duration.
+func (q *DQue) DequeueBlockTimeout(d time.Duration) (interface{}, error) {
+	if d < 0 {
+		d = 0
+	}
+	obj, err := q.block(q.dequeueLocked, d)
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return obj, err
+}
+
+// PeekBlock behaves similar to Peek, but is a blocking call until an item is available.
+func (q *DQue) PeekBlock() (interface{}, error) {
+	return q.block(q.peekLocked, forever)
+}
+
+// PeekBlockTimeout behaves similar to PeekBlock, but gives up and returns
+// ErrTimeout if no item is available within the given duration.
+func (q *DQue) PeekBlockTimeout(d time.Duration) (interface{}, error) {
+	if d < 0 {
+		d = 0
+	}
+	return q.block(q.peekLocked, d)
+}
+
+// forever is the timeout of block for waiting until an item is available.
+const forever time.Duration = -1
+
+// block calls fn (with the head lock held) until it finds an item, waiting
+// for an enqueue each time the queue is empty.  Unless the timeout is
+// forever, ErrTimeout is returned if there is still no item once it passes.
+func (q *DQue) block(fn func() (interface{}, error), timeout time.Duration) (interface{}, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+
+	timedOut := false
+	if timeout != forever {
+		timer := time.AfterFunc(timeout, func() {
+			q.mutex.Lock()
+			timedOut = true
+			q.emptyCond.Broadcast()
+			q.mutex.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	return q.waitLocked(fn, &timedOut, ErrTimeout)
+}
+
+// waitLocked calls fn until it finds an item, waiting for an enqueue each
+// time the queue is empty.  stopErr is returned if the queue is empty once
+// *stop is true.  Whoever sets *stop must hold the head lock and broadcast
+// emptyCond.  The head lock must be held.
+//
+// Blocked callers are served first come, first served: only the one that
+// has waited longest calls fn, and the next one takes its place when it
+// returns.  Callers that don't block, such as Dequeue, can still take an
+// item before them.
+func (q *DQue) waitLocked(fn func() (interface{}, error), stop *bool, stopErr error) (interface{}, error) {
+	// Count ourselves as waiting before checking for an item so that
+	// an enqueue can't slip in between the check and the Wait().
+	atomic.AddInt32(&q.waiters, 1)
+	defer atomic.AddInt32(&q.waiters, -1)
+
+	// Take our place in line, and let the next caller in line try once we
+	// are done
+	if q.waitQueue == nil {
+		q.waitQueue = list.New()
+	}
+	place := q.waitQueue.PushBack(nil)
+	defer func() {
+		q.waitQueue.Remove(place)
+		q.emptyCond.Broadcast()
+	}()
+
 	for {
-		obj, err := q.dequeueLocked()
+		if q.waitQueue.Front() != place {
+			if q.fileLock == nil {
+				return nil, ErrQueueClosed
+			}
+			if *stop {
+				return nil, stopErr
+			}
+			q.emptyCond.Wait()
+			continue
+		}
+
+		q.nextDue = 0
+		obj, err := fn()
 		if err == ErrEmpty {
+			if *stop {
+				return nil, stopErr
+			}
+			if q.nextDue != 0 {
+				// Wake up when the next scheduled item is due
+				wake := time.AfterFunc(time.Unix(0, q.nextDue).Sub(q.config.now()), func() {
+					q.mutex.Lock()
+					q.emptyCond.Broadcast()
+					q.mutex.Unlock()
+				})
+				q.emptyCond.Wait()
+				wake.Stop()
+				continue
+			}
 			q.emptyCond.Wait()
 			// Wait() atomically unlocks mutexEmptyCond and suspends execution of the calling goroutine.
 			// Receiving the signal does not guarantee an item is available, let's loop and check again.
 			continue
-		} else if err != nil {
-			return nil, err
+		} else if err != nil {
+			return obj, err
+		}
+		return obj, nil
+	}
+}
+
+// Clear removes every item from the queue by deleting all of its segment files.
+// Segment numbering continues after the last segment rather than restarting
+// at 1, so a new segment file never reuses the name of a deleted one.
+// Every cursor is moved past the removed items.
+func (q *DQue) Clear() error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return ErrReadOnly
+	}
+	return q.clearLocked()
+}
+
+// DequeueAll removes and returns every item in the queue, in order, leaving
+// it empty.  Nothing can be enqueued or dequeued until it returns.  Rather
+// than marking each item removed, it reads the segments and then deletes
+// them like Clear, so it is much faster than calling Dequeue in a loop.
+// Items scheduled with EnqueueAt are returned whether or not they are due,
+// and expired items are returned too.  The items are held in memory all at
+// once, so take care with a large queue.  If reading a segment fails,
+// nothing is removed.  The observer is told of each item dequeued.
+func (q *DQue) DequeueAll() ([]interface{}, error) {
+	objects, err := q.dequeueAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for range objects {
+		q.observeDequeue()
+	}
+	return objects, nil
+}
+
+func (q *DQue) dequeueAll() ([]interface{}, error) {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return nil, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return nil, ErrReadOnly
+	}
+	if q.config.writeOnly {
+		return nil, ErrWriteOnly
+	}
+
+	var objects []interface{}
+	err := q.forEachItem(func(item interface{}) error {
+		objects = append(objects, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.clearLocked(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// forEachItem calls fn with every item in the queue, in order, reading the
+// segments between the first and the last from disk one at a time.  Both
+// locks must be held.
+func (q *DQue) forEachItem(fn func(item interface{}) error) error {
+	each := func(seg *qSegment) error {
+		for _, object := range seg.objects {
+			item, err := seg.item(object)
+			if err != nil {
+				return err
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := each(q.firstSegment); err != nil {
+		return err
+	}
+	for num := q.firstSegment.number + 1; num < q.lastSegment.number; num++ {
+		seg, err := openQueueSegment(q.fullPath, num, q.turbo, q.builder, &q.config)
+		if err != nil {
+			return errors.Wrapf(err, "error opening queue segment %d", num)
+		}
+		err = each(seg)
+		if closeErr := seg.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if q.lastSegment != q.firstSegment {
+		return each(q.lastSegment)
+	}
+	return nil
+}
+
+// clearLocked deletes every segment file, leaving one new empty segment.
+// Both locks must be held.
+func (q *DQue) clearLocked() error {
+	// Create the new segment first.  If we crash part way through, the old
+	// segments that remain are still contiguous and load normally.
+	seg, err := newQueueSegment(q.fullPath, q.lastSegment.number+1, q.turbo, q.builder, &q.config)
+	if err != nil {
+		return errors.Wrapf(err, "error creating new queue segment: %d.", q.lastSegment.number+1)
+	}
+	q.config.observer.segmentCreated(seg.number)
+
+	// Delete the old segments from first to last
+	for num := q.firstSegment.number; num <= q.lastSegment.number; num++ {
+		switch num {
+		case q.firstSegment.number:
+			err = q.firstSegment.delete()
+		case q.lastSegment.number:
+			err = q.lastSegment.delete()
+		default:
+			err = q.config.removeSegmentFile(path.Join(q.fullPath, q.config.segmentFileName(num)))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error deleting queue segment %d. Queue is in an inconsistent state", num)
+		}
+		q.config.observer.segmentDeleted(num)
+	}
+
+	q.firstSegment = seg
+	q.lastSegment = seg
+	atomic.StoreInt64(&q.count, 0)
+	q.signalEmpty()
+	q.invalidateReadAhead()
+
+	// Cursors have nothing left to read, so move them to the new segment
+	// and delete the segment files they were keeping
+	if err := q.resetCursors(seg.number); err != nil {
+		return err
+	}
+	return q.releaseSegments()
+}
+
+// Compact reclaims the space held by dequeued items.  Items are only marked
+// as removed in a segment file until every item in it has been dequeued, so
+// a segment that is consumed about as fast as it is filled can grow large.
+// Compact rewrites each segment holding removal markers into a new file with
+// just its remaining items, then swaps the files.
+//
+// Only the first segment is ever dequeued from, so segments between the first
+// and the last never need compacting.  After compaction a segment file holds
+// fewer records than ItemsPerSegment, so when it is also the last segment it
+// accepts more items before a new segment is created.
+func (q *DQue) Compact() error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return ErrReadOnly
+	}
+
+	for _, seg := range []*qSegment{q.firstSegment, q.lastSegment} {
+		if err := q.compactSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactSegment reclaims the space held by dequeued items in just the
+// numbered segment, as Compact does for the whole queue, so the I/O of
+// compacting can be spread out.  Only the first segment is dequeued from,
+// and the last is still being written, so compacting any other segment, or
+// the first when it is also the last, does nothing.
+func (q *DQue) CompactSegment(number int) error {
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return ErrReadOnly
+	}
+	if number < q.firstSegment.number || number > q.lastSegment.number {
+		return errors.Errorf("queue segment %d is not in the queue", number)
+	}
+	if number != q.firstSegment.number || q.firstSegment == q.lastSegment {
+		return nil
+	}
+	return q.compactSegment(q.firstSegment)
+}
+
+// compactSegment rewrites a segment holding removal markers.  Both locks
+// must be held.
+func (q *DQue) compactSegment(seg *qSegment) error {
+	if seg.removeCount == 0 {
+		return nil
+	}
+	if err := seg.rewrite(seg.objects); err != nil {
+		return errors.Wrapf(err, "error compacting queue segment %d", seg.number)
+	}
+	return nil
+}
+
+// TrimTail removes up to n of the most recently enqueued items, such as a
+// batch that turned out to be invalid, and returns how many were removed.
+// The last segment is rewritten without them.  A last segment left with no
+// items is deleted, and the segment before it becomes the last one and is
+// trimmed in turn, but the first segment is never deleted.
+func (q *DQue) TrimTail(n int) (int, error) {
+	if n < 0 {
+		return 0, errors.New("the number of items to trim must not be negative")
+	}
+
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return 0, ErrQueueClosed
+	}
+	if q.config.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	q.invalidateReadAhead()
+	removed := 0
+	defer func() { q.countRemoved(int64(removed)) }()
+
+	for removed < n {
+		seg := q.lastSegment
+		size := seg.size()
+		if size <= n-removed && seg != q.firstSegment {
+			// Every item of the last segment goes
+			if err := q.dropLastSegment(); err != nil {
+				return removed, err
+			}
+			removed += size
+			continue
 		}
-		return obj, nil
+
+		trim := n - removed
+		if trim > size {
+			trim = size
+		}
+		if trim == 0 {
+			break
+		}
+		seg.mutex.Lock()
+		objects := seg.objects[:size-trim]
+		seg.mutex.Unlock()
+		if err := seg.rewrite(objects); err != nil {
+			return removed, errors.Wrapf(err, "error trimming queue segment %d", seg.number)
+		}
+		removed += trim
+		break
 	}
+	return removed, nil
 }
 
-// PeekBlock behaves similar to Peek, but is a blocking call until an item is available.
-func (q *DQue) PeekBlock() (interface{}, error) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+// dropLastSegment deletes the last segment, which must not be the first,
+// and makes the segment before it the last one.  Both locks must be held.
+func (q *DQue) dropLastSegment() error {
+	old := q.lastSegment
+	if err := old.close(); err != nil {
+		return errors.Wrapf(err, "error closing queue segment %d", old.number)
+	}
+	if err := q.config.fs().Remove(old.filePath()); err != nil {
+		return errors.Wrapf(err, "error deleting queue segment %d", old.number)
+	}
+	q.config.observer.segmentDeleted(old.number)
+	if !q.turbo {
+		if err := syncDir(q.config.fs(), q.fullPath); err != nil {
+			return err
+		}
+	}
+
+	if old.number-1 == q.firstSegment.number {
+		q.lastSegment = q.firstSegment
+		return nil
+	}
+	seg, err := openQueueSegment(q.fullPath, old.number-1, q.turbo, q.builder, &q.config)
+	if err != nil {
+		return errors.Wrapf(err, "error opening queue segment %d", old.number-1)
+	}
+	q.lastSegment = seg
+	return nil
+}
+
+// DrainTo moves every item of the queue, in order, to the end of dst and
+// returns the number of items moved.  It is the way to re-segment a queue or
+// to change its codec or compression.
+//
+// Each item is enqueued to dst before it is dequeued from this queue, so if
+// DrainTo is interrupted the items already moved stay moved and calling it
+// again continues with the rest.  A crash between the two steps can leave
+// the item in both queues, but never in neither.
+func (q *DQue) DrainTo(dst *DQue) (int, error) {
+	if dst == q {
+		return 0, errors.New("DQue.DrainTo() can't drain a queue into itself")
+	}
+
+	count := 0
 	for {
-		obj, err := q.peekLocked()
+		err := q.drainOne(dst)
 		if err == ErrEmpty {
-			q.emptyCond.Wait()
-			// Wait() atomically unlocks mutexEmptyCond and suspends execution of the calling goroutine.
-			// Receiving the signal does not guarantee an item is available, let's loop and check again.
-			continue
-		} else if err != nil {
-			return nil, err
+			return count, nil
 		}
-		return obj, nil
+		if err != nil {
+			return count, err
+		}
+		count++
+		q.observeDequeue()
+	}
+}
+
+// drainOne moves the first item of the queue to the end of dst.  The head
+// lock is held throughout so no other consumer can take the item between
+// the peek and the dequeue.  It is taken along with both locks of dst in
+// the order of the queues' paths, as Batch does, so two queues draining
+// into each other can't deadlock.
+func (q *DQue) drainOne(dst *DQue) error {
+	if q.fullPath < dst.fullPath {
+		q.mutex.Lock()
+		dst.lockAll()
+	} else {
+		dst.lockAll()
+		q.mutex.Lock()
+	}
+	added, err := q.drainOneLocked(dst)
+	dst.unlockAll()
+	q.mutex.Unlock()
+
+	dst.notifySegmentsComplete()
+	if added {
+		dst.signalNotEmpty()
+		dst.observeEnqueue()
+	}
+	return err
+}
+
+// drainOneLocked is drainOne with the locks held.  It returns true if the
+// item was added to dst.
+func (q *DQue) drainOneLocked(dst *DQue) (bool, error) {
+	obj, err := q.peekLocked()
+	if err != nil {
+		return false, err
+	}
+	if q.config.readOnly {
+		return false, ErrReadOnly
 	}
+	if err := dst.checkItem(obj); err != nil {
+		return false, errors.Wrap(err, "error enqueueing item to the destination queue")
+	}
+	if added, err := dst.enqueueLocked(obj); err != nil {
+		return added, errors.Wrap(err, "error enqueueing item to the destination queue")
+	}
+	if _, err := q.dequeueLocked(); err != nil {
+		return true, errors.Wrap(err, "error dequeueing item that was moved")
+	}
+	return true, nil
 }
 
-// Size locks things up while calculating so you are guaranteed an accurate
-// size... unless you have changed the itemsPerSegment value since the queue
-// was last empty.  Then it could be wildly inaccurate.
+// Size returns the number of items in the queue.  It locks things up while
+// reading the item counter, so no enqueue or dequeue is part way through
+// and you are guaranteed an accurate size.  Zero is returned once the queue
+// is closed.
 func (q *DQue) Size() int {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
 	if q.fileLock == nil {
 		return 0
 	}
+	return int(atomic.LoadInt64(&q.count))
+}
+
+// SizeUnsafe returns the number of items in the queue from a counter that is
+// kept up to date as items are enqueued and dequeued.  Unlike Size, it takes
+// no locks, so it is cheap enough to call as often as you like and safe to
+// call from any goroutine at any time.  The counter starts at the number of
+// items counted in the segments when the queue is opened, and is reset to 0
+// by Close.
+//
+// Because this method is not synchronized, the size may be stale by the
+// time it is returned when other goroutines are enqueueing or dequeueing.
+func (q *DQue) SizeUnsafe() int {
+	return int(atomic.LoadInt64(&q.count))
+}
 
+// Verify checks the invariants the queue relies on and returns an error
+// describing the first one that doesn't hold: the first segment comes no
+// later than the last, the file of every segment between them exists, the
+// first and last segments are open and their files are as long as the
+// queue thinks they are, and the size isn't negative.  It is cheap enough to
+// call periodically as a health check.  ErrQueueClosed is returned if the
+// queue is closed.
+func (q *DQue) Verify() error {
 	// This is heavy-handed but it is safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+
+	first, last := q.firstSegment, q.lastSegment
+	if first.number > last.number {
+		return errors.Errorf("the first segment %d comes after the last segment %d", first.number, last.number)
+	}
+	for num := first.number; num <= last.number; num++ {
+		if !fileExists(q.config.fs(), path.Join(q.fullPath, q.config.segmentFileName(num))) {
+			return errors.Errorf("the file of segment %d is missing", num)
+		}
+	}
+	for _, seg := range []*qSegment{first, last} {
+		if seg.file == nil {
+			return errors.Errorf("segment %d is not open", seg.number)
+		}
+		// The owner of a read-only queue may be appending to it
+		if size := fileSize(q.config.fs(), seg.filePath()); size != seg.fileBytes && !q.config.readOnly {
+			return errors.Errorf("the file of segment %d is %d bytes but %d were written", seg.number, size, seg.fileBytes)
+		}
+	}
+	if n := atomic.LoadInt64(&q.count); n < 0 {
+		return errors.Errorf("the queue has a negative size of %d", n)
+	}
+	return nil
+}
+
+// DiskUsage returns the number of bytes used by the queue's segment files.
+// Removed items use space until their segment file is deleted or compacted,
+// so this can grow while Size stays the same.
+func (q *DQue) DiskUsage() (int64, error) {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return 0, ErrQueueClosed
+	}
+
+	files, err := q.config.fs().ReadDir(q.fullPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to read files in "+q.fullPath)
+	}
 
-	return q.SizeUnsafe()
+	pattern := q.config.segmentPattern()
+	var total int64
+	for _, f := range files {
+		if !f.IsDir() && pattern.MatchString(f.Name()) {
+			total += f.Size()
+		}
+	}
+	return total, nil
 }
 
-// SizeUnsafe returns the approximate number of items in the queue.  Use Size() if
-// having the exact size is important to your use-case.
-//
-// The return value could be wildly inaccurate if the itemsPerSegment value has
-// changed since the queue was last empty.
-// Also, because this method is not synchronized, the size may change after
-// entering this method.
-func (q *DQue) SizeUnsafe() int {
+// SegmentCount returns the number of segment files in the queue.
+func (q *DQue) SegmentCount() int {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
 	if q.fileLock == nil {
 		return 0
 	}
-	if q.firstSegment.number == q.lastSegment.number {
-		return q.firstSegment.size()
-	}
-	numSegmentsBetween := q.lastSegment.number - q.firstSegment.number - 1
-	return q.firstSegment.size() + (numSegmentsBetween * q.config.ItemsPerSegment) + q.lastSegment.size()
+	return q.lastSegment.number - q.firstSegment.number + 1
 }
 
 // SegmentNumbers returns the number of both the first last segmment.
 // There is likely no use for this information other than testing.
 func (q *DQue) SegmentNumbers() (int, int) {
+	q.lockAll()
+	defer q.unlockAll()
+
 	if q.fileLock == nil {
 		return 0, 0
 	}
 	return q.firstSegment.number, q.lastSegment.number
 }
 
+// Stats is a snapshot of the state of a queue.
+type Stats struct {
+	Items          int  // number of items in the queue, as returned by Size
+	FirstSegment   int  // number of the first segment
+	LastSegment    int  // number of the last segment
+	SegmentCount   int  // number of segment files
+	TombstoneCount int  // removed items still taking space in the open segment files
+	ExpiredCount   int  // items dropped since the queue was opened because they outlived the TTL
+	DroppedCount   int  // items discarded since the queue was opened to keep within SetMaxSegments
+	Turbo          bool // whether turbo is on
+}
+
+// Stats returns a snapshot of the state of the queue.  Everything is gathered
+// while the queue is locked, so the values are consistent with each other.
+// The zero Stats is returned if the queue is closed.
+func (q *DQue) Stats() Stats {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return Stats{}
+	}
+
+	tombstones := q.firstSegment.sizeOnDisk() - q.firstSegment.size()
+	if q.firstSegment != q.lastSegment {
+		tombstones += q.lastSegment.sizeOnDisk() - q.lastSegment.size()
+	}
+	return Stats{
+		Items:          int(atomic.LoadInt64(&q.count)),
+		FirstSegment:   q.firstSegment.number,
+		LastSegment:    q.lastSegment.number,
+		SegmentCount:   q.lastSegment.number - q.firstSegment.number + 1,
+		TombstoneCount: tombstones,
+		ExpiredCount:   q.expired,
+		DroppedCount:   q.dropped,
+		Turbo:          q.turbo,
+	}
+}
+
+// PreallocateSegments reserves the given number of bytes of disk for each
+// segment file created from now on, such as the number of items per segment
+// times the average size of an item.  Growing a file that already has its
+// blocks is less work for the filesystem, which makes syncs faster and more
+// predictable.  The space a segment doesn't use is given back when it is
+// closed.  Zero turns preallocation off.
+//
+// Preallocation uses fallocate, so it only happens on Linux with a
+// filesystem that supports it and the default Storage.  Elsewhere this does
+// nothing.
+func (q *DQue) PreallocateSegments(bytes int) error {
+	if bytes < 0 {
+		return errors.New("DQue.PreallocateSegments() requires a size that isn't negative")
+	}
+
+	q.lockAll()
+	defer q.unlockAll()
+
+	q.config.preallocate = int64(bytes)
+	return nil
+}
+
 // Turbo returns true if the turbo flag is on.  Having turbo on speeds things
 // up significantly.
 func (q *DQue) Turbo() bool {
@@ -437,8 +2355,8 @@ func (q *DQue) Turbo() bool {
 // If turbo is already on an error is returned
 func (q *DQue) TurboOn() error {
 	// This is heavy-handed but it is safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.lockAll()
+	defer q.unlockAll()
 
 	if q.fileLock == nil {
 		return ErrQueueClosed
@@ -458,8 +2376,8 @@ func (q *DQue) TurboOn() error {
 // If turbo is already off an error is returned
 func (q *DQue) TurboOff() error {
 	// This is heavy-handed but it is safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.lockAll()
+	defer q.unlockAll()
 
 	if q.fileLock == nil {
 		return ErrQueueClosed
@@ -468,6 +2386,7 @@ func (q *DQue) TurboOff() error {
 	if !q.turbo {
 		return errors.New("DQue.TurboOff() is not valid when turbo is off")
 	}
+	q.stopTurboSyncer()
 	if err := q.firstSegment.turboOff(); err != nil {
 		return err
 	}
@@ -478,12 +2397,26 @@ func (q *DQue) TurboOff() error {
 	return nil
 }
 
+// SyncCount returns the number of times the queue's segment files have been
+// synced to disk since it was opened, whether after each change or, with
+// turbo on, in batches.  Comparing it before and after some work shows how
+// much turbo saves.
+func (q *DQue) SyncCount() int64 {
+	return atomic.LoadInt64(&q.syncs)
+}
+
+// ResetSyncCount sets the count returned by SyncCount back to zero and
+// returns what it was.
+func (q *DQue) ResetSyncCount() int64 {
+	return atomic.SwapInt64(&q.syncs, 0)
+}
+
 // TurboSync allows you to fsync changes to disk, but only if turbo is on.
 // If turbo is off an error is returned
 func (q *DQue) TurboSync() error {
 	// This is heavy-handed but it is safe
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.lockAll()
+	defer q.unlockAll()
 
 	if q.fileLock == nil {
 		return ErrQueueClosed
@@ -500,92 +2433,334 @@ func (q *DQue) TurboSync() error {
 	return nil
 }
 
+// Flush makes sure every change to the queue is synced to disk, whether or
+// not turbo is on.  Nothing is done if there are no unsynced changes.
+func (q *DQue) Flush() error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+	if err := q.firstSegment.flush(); err != nil {
+		return errors.Wrap(err, "unable to sync changes to disk")
+	}
+	if err := q.lastSegment.flush(); err != nil {
+		return errors.Wrap(err, "unable to sync changes to disk")
+	}
+	return nil
+}
+
+// lockAll takes both the head and the tail locks, in that order.
+func (q *DQue) lockAll() {
+	q.mutex.Lock()
+	q.tailMutex.Lock()
+}
+
+// unlockAll releases the locks taken by lockAll.
+func (q *DQue) unlockAll() {
+	q.tailMutex.Unlock()
+	q.mutex.Unlock()
+}
+
 // load populates the queue from disk
 func (q *DQue) load() error {
+	q.dedup = newDedupWindow()
+	if q.config.persistDedup {
+		if err := q.loadDedup(); err != nil {
+			return err
+		}
+	}
+
+	// Segment files still needed by a cursor must not be deleted
+	if err := q.loadCursors(); err != nil {
+		return err
+	}
 
 	// Find all queue files
-	files, err := ioutil.ReadDir(q.fullPath)
+	numbers, err := listSegmentNumbers(q.config.fs(), q.fullPath, q.config.segmentPattern(), q.config.logf)
 	if err != nil {
-		return errors.Wrap(err, "unable to read files in "+q.fullPath)
+		return err
 	}
 
-	// Find the smallest and the largest file numbers
-	minNum := math.MaxInt32
-	maxNum := 0
-	for _, f := range files {
-		if !f.IsDir() && filePattern.MatchString(f.Name()) {
-			// Extract number out of the filename
-			fileNumStr := filePattern.FindStringSubmatch(f.Name())[1]
-			fileNum, _ := strconv.Atoi(fileNumStr)
-			if fileNum > maxNum {
-				maxNum = fileNum
-			}
-			if fileNum < minNum {
-				minNum = fileNum
-			}
+	// New segments must be written the same way as the existing ones
+	if len(numbers) > 0 {
+		if err := q.loadConfig(numbers[len(numbers)-1]); err != nil {
+			return err
 		}
 	}
 
+	// The builder can only be checked once the codec is known
+	if err := q.checkBuilder(); err != nil {
+		return err
+	}
+
 	// If files were found, set q.firstSegment and q.lastSegment
-	if maxNum > 0 {
+	if len(numbers) > 0 {
 
-		// We found files
-		for {
-			seg, err := openQueueSegment(q.fullPath, minNum, q.turbo, q.builder)
+		// We found files.  Skip past (and delete) any segments that are
+		// empty and complete, which a crash during a dequeue can leave behind.
+		maxNum := numbers[len(numbers)-1]
+		for _, num := range numbers {
+			seg, err := openQueueSegment(q.fullPath, num, q.turbo, q.builder, &q.config)
 			if err != nil {
 				return errors.Wrap(err, "unable to create queue segment in "+q.fullPath)
 			}
-			// Make sure the first segment is not empty or it's not complete (i.e. is current)
-			if seg.size() > 0 || seg.sizeOnDisk() < q.config.ItemsPerSegment {
+			// Make sure the first segment is not empty or it's the last one and
+			// not complete (i.e. is current)
+			if seg.size() > 0 || (num == maxNum && !q.segmentFull(seg)) {
 				q.firstSegment = seg
 				break
 			}
+
+			// A read-only queue leaves the exhausted segments alone
+			if q.config.readOnly {
+				if num == maxNum {
+					q.firstSegment = seg
+					break
+				}
+				if err := seg.close(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if num == maxNum {
+				// Every segment is exhausted, so the next one was never
+				// created.  Create it before deleting this one.
+				next, err := newQueueSegment(q.fullPath, num+1, q.turbo, q.builder, &q.config)
+				if err != nil {
+					return errors.Wrap(err, "unable to create queue segment in "+q.fullPath)
+				}
+				q.config.observer.segmentCreated(next.number)
+				q.firstSegment = next
+				maxNum = next.number
+			}
+
+			// Keep the segment if a cursor still needs it
+			if q.segmentRetained(num) {
+				if err := seg.close(); err != nil {
+					return err
+				}
+				continue
+			}
+
 			// Delete the segment as it's empty and complete
-			seg.delete()
-			// Try the next one
-			minNum++
+			if err := seg.delete(); err != nil {
+				return errors.Wrap(err, "unable to delete queue segment in "+q.fullPath)
+			}
+			q.config.observer.segmentDeleted(num)
 		}
 
-		if minNum == maxNum {
+		if q.firstSegment.number == maxNum {
 			// We have only one segment so the
 			// first and last are the same instance (in this case)
 			q.lastSegment = q.firstSegment
 		} else {
 			// We have multiple segments
-			seg, err := openQueueSegment(q.fullPath, maxNum, q.turbo, q.builder)
+			seg, err := openQueueSegment(q.fullPath, maxNum, q.turbo, q.builder, &q.config)
 			if err != nil {
 				return errors.Wrap(err, "unable to create segment for "+q.fullPath)
 			}
 			q.lastSegment = seg
 		}
 
+	} else if q.config.readOnly {
+		return errors.New("the queue has no segment files (" + q.fullPath + ")")
 	} else {
 		// We found no files so build a new queue starting with segment 1
-		seg, err := newQueueSegment(q.fullPath, 1, q.turbo, q.builder)
+		seg, err := newQueueSegment(q.fullPath, 1, q.turbo, q.builder, &q.config)
 		if err != nil {
 			return errors.Wrap(err, "unable to create queue segment in "+q.fullPath)
 		}
+		q.config.observer.segmentCreated(seg.number)
 
 		// The first and last are the same instance (in this case)
 		q.firstSegment = seg
 		q.lastSegment = seg
 	}
 
+	// Items checked out by the process that owns a read-only queue are
+	// still in its hands
+	if !q.config.readOnly {
+		if err := q.requeueInflight(); err != nil {
+			return err
+		}
+	}
+	q.countItems()
+	return nil
+}
+
+// countItems sets the item counter from the segments of a queue being
+// loaded.  The first and last segments are counted from memory.  The
+// segments between them can hold fewer than ItemsPerSegment items, such as
+// when MaxSegmentBytes rolled them early or RemoveWhere rewrote them, so
+// their files are read to count their records, without decoding any items.
+func (q *DQue) countItems() {
+	count := q.firstSegment.size()
+	if q.lastSegment != q.firstSegment {
+		count += q.lastSegment.size()
+	}
+	for num := q.firstSegment.number + 1; num < q.lastSegment.number; num++ {
+		filePath := path.Join(q.fullPath, q.config.segmentFileName(num))
+		live, _, _, err := countRecords(q.config.fs(), filePath)
+		if err != nil {
+			// The segment fails to load once it is reached
+			q.config.logf("dque: unable to count the items in %s, so it is counted as full: %v", filePath, err)
+			live = q.config.ItemsPerSegment
+		}
+		count += live
+	}
+	atomic.StoreInt64(&q.count, int64(count))
+}
+
+// checkBuilder makes sure the builder can be used to decode items and
+// records the type it builds.
+func (q *DQue) checkBuilder() error {
+	if q.config.Codec == CodecBytes {
+		return nil
+	}
+	if q.config.builders != nil {
+		if err := q.checkBuilders(); err != nil {
+			return err
+		}
+		if q.builder == nil {
+			// Every item is tagged
+			return nil
+		}
+	}
+	if q.builder == nil {
+		return errors.Wrap(ErrInvalidBuilder, "no builder was given")
+	}
+	t, err := builtType(q.builder)
+	if err != nil {
+		return err
+	}
+	q.itemType = t
+	return nil
+}
+
+// checkBuilders checks the builders of a multi-type queue and records the
+// type tag of what each one builds.
+func (q *DQue) checkBuilders() error {
+	q.config.tags = make(map[reflect.Type]string, len(q.config.builders))
+	for tag, builder := range q.config.builders {
+		if builder == nil {
+			return errors.Wrapf(ErrInvalidBuilder, "no builder was given for type tag %q", tag)
+		}
+		t, err := builtType(builder)
+		if err != nil {
+			return errors.Wrapf(err, "type tag %q", tag)
+		}
+		if other, ok := q.config.tags[t]; ok {
+			return errors.Wrapf(ErrInvalidBuilder, "type tags %q and %q both build %s", other, tag, t)
+		}
+		q.config.tags[t] = tag
+	}
 	return nil
 }
 
-func (q *DQue) lock() error {
-	l := path.Join(q.DirPath, q.Name, lockFile)
-	fileLock := flock.New(l)
+// builtType returns the type of what a builder builds, which must be a
+// non-nil pointer.
+func builtType(builder func() interface{}) (reflect.Type, error) {
+	obj := builder()
+	if failed, ok := obj.(builderError); ok {
+		return nil, errors.Wrap(failed.err, "the builder failed")
+	}
+	v := reflect.ValueOf(obj)
+	if obj == nil || v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, errors.Wrapf(ErrInvalidBuilder, "the builder returned %#v", obj)
+	}
+	return v.Type(), nil
+}
+
+// checkItem returns an error if the item isn't of the type the builder
+// builds.  Items of another type may be encoded, but gob may not decode them
+// the same way.
+func (q *DQue) checkItem(obj interface{}) error {
+	if q.config.tags != nil {
+		if _, ok := q.config.tags[reflect.TypeOf(obj)]; ok {
+			return nil
+		}
+		if q.itemType == nil {
+			return errors.Errorf("no builder was given for items of type %T", obj)
+		}
+	}
+	if q.itemType != nil && reflect.TypeOf(obj) != q.itemType {
+		return errors.Errorf("the queue holds items of type %s, not %T", q.itemType, obj)
+	}
+	return nil
+}
+
+// loadConfig adopts the settings recorded in the header of the given
+// segment.  A segment file that is still empty has no header to read.
+func (q *DQue) loadConfig(number int) error {
+	filePath := path.Join(q.fullPath, q.config.segmentFileName(number))
+	f, err := q.config.fs().OpenFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "error opening file: "+filePath)
+	}
+	defer f.Close()
 
-	locked, err := fileLock.TryLock()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "error reading file: "+filePath)
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	header, err := readSegmentHeader(f, filePath)
 	if err != nil {
 		return err
 	}
-	if !locked {
-		return errors.New("failed to acquire flock")
+
+	if header.itemsPerSegment > 0 {
+		q.config.ItemsPerSegment = header.itemsPerSegment
+	}
+	q.config.Compression = header.compression
+	q.config.Codec = header.codec
+	return nil
+}
+
+func (q *DQue) lock() error {
+	fileLock, err := acquireLock(q.config.fs(), q.fullPath)
+	if err != nil {
+		return err
 	}
 
 	q.fileLock = fileLock
 	return nil
 }
+
+// acquireLock takes the lock file of the queue in the given directory
+func acquireLock(fs Storage, fullPath string) (io.Closer, error) {
+	return fs.Lock(path.Join(fullPath, lockFile))
+}
+
+// listSegmentNumbers returns the numbers of all segment files in the given
+// directory in ascending order.  Segment file names match the given pattern.
+// Files whose number is out of range are skipped with a warning passed to
+// logf.
+func listSegmentNumbers(fs Storage, fullPath string, pattern *regexp.Regexp, logf func(format string, v ...interface{})) ([]int, error) {
+	files, err := fs.ReadDir(fullPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read files in "+fullPath)
+	}
+
+	var numbers []int
+	for _, f := range files {
+		if !f.IsDir() && pattern.MatchString(f.Name()) {
+			// Extract number out of the filename
+			fileNumStr := pattern.FindStringSubmatch(f.Name())[1]
+			fileNum, err := strconv.ParseInt(fileNumStr, 10, strconv.IntSize)
+			if err != nil || fileNum > maxSegmentNumber {
+				logf("dque: skipping %s in %s, whose segment number is out of range", f.Name(), fullPath)
+				continue
+			}
+			numbers = append(numbers, int(fileNum))
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
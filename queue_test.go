@@ -2,11 +2,20 @@
 package dque_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -188,15 +197,9 @@ func testQueue_Add9Remove8(t *testing.T, turbo bool) {
 
 		// Check the Size calculation
 		assert(t, 8-i == q.Size(), "the size is calculated wrong.")
-		item, ok := iface.(item2)
-		if ok {
-			fmt.Printf("Dequeued %T %t %#v\n", item, ok, item)
-			assert(t, i == item.Id, "Unexpected itemId")
-		} else {
-			item, ok := iface.(*item2)
-			assert(t, ok, "Dequeued object is not of type *item2")
-			assert(t, i == item.Id, "Unexpected itemId")
-		}
+		item, ok := iface.(*item2)
+		assert(t, ok, "Dequeued object is not of type *item2")
+		assert(t, i == item.Id, "Unexpected itemId")
 	}
 
 	firstSegNum, lastSegNum = q.SegmentNumbers()
@@ -355,6 +358,7 @@ func TestQueue_NewFlock(t *testing.T) {
 	if err == nil {
 		t.Fatal("No error during double-open dque")
 	}
+	assert(t, errors.Is(err, dque.ErrQueueLocked), "Expected ErrQueueLocked but got %v", err)
 	err = q.Close()
 	if err != nil {
 		t.Fatal("Error closing dque:", err)
@@ -399,19 +403,17 @@ func TestQueue_UseAfterClose(t *testing.T) {
 		t.Fatal("Error closing dque:", err)
 	}
 
-	queueClosedError := "queue is closed"
-
 	err = q.Close()
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	err = q.Enqueue(&item2{0})
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	_, err = q.Dequeue()
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	_, err = q.Peek()
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	s := q.Size()
 	assert(t, s == 0, "Expected error")
@@ -420,13 +422,25 @@ func TestQueue_UseAfterClose(t *testing.T) {
 	assert(t, s == 0, "Expected error")
 
 	err = q.TurboOn()
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	err = q.TurboOff()
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	err = q.TurboSync()
-	assert(t, err.Error() == queueClosedError, "Expected error not found", err)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
+
+	_, err = q.DequeueBlock()
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
+
+	_, err = q.PeekBlock()
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
+
+	_, err = q.DequeueBlockTimeout(time.Second)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
+
+	_, err = q.PeekBlockTimeout(time.Second)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected error not found", err)
 
 	// Cleanup
 	if err := os.RemoveAll(qName); err != nil {
@@ -524,6 +538,49 @@ func TestQueue_BlockingWithClose(t *testing.T) {
 	}
 }
 
+func TestQueue_BlockingTimeout(t *testing.T) {
+	qName := "testBlockingTimeout"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+
+	// Nothing arrives in time
+	start := time.Now()
+	_, err := q.PeekBlockTimeout(50 * time.Millisecond)
+	assert(t, errors.Is(err, dque.ErrTimeout), "Expected ErrTimeout but got %v", err)
+	_, err = q.DequeueBlockTimeout(50 * time.Millisecond)
+	assert(t, errors.Is(err, dque.ErrTimeout), "Expected ErrTimeout but got %v", err)
+	assert(t, time.Since(start) >= 100*time.Millisecond, "Expected to wait for the timeouts")
+
+	// An item arrives in time
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		err := q.Enqueue(&item2{1})
+		assert(t, err == nil, "Expected no error")
+	}()
+	iface, err := q.PeekBlockTimeout(3 * time.Second)
+	assert(t, err == nil, "Expected no error but got %v", err)
+	assert(t, 1 == iface.(*item2).Id, "Unexpected itemId")
+	iface, err = q.DequeueBlockTimeout(0)
+	assert(t, err == nil, "Expected no error but got %v", err)
+	assert(t, 1 == iface.(*item2).Id, "Unexpected itemId")
+
+	// The queue is closed while waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		err := q.Close()
+		assert(t, err == nil, "Expected no error")
+	}()
+	_, err = q.DequeueBlockTimeout(3 * time.Second)
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected ErrQueueClosed but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+}
+
 func TestQueue_BlockingAggresive(t *testing.T) {
 	rand.Seed(0) // ensure we have reproducible sleeps
 
@@ -589,6 +646,4049 @@ func TestQueue_BlockingAggresive(t *testing.T) {
 	}
 }
 
+func TestQueue_Compression(t *testing.T) {
+	qName := "testCompression"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, dque.Options{Compression: dque.CompressionGzip})
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Open without options; the compression recorded on disk must be used
+	q = openQ(t, qName, false)
+	for i := 5; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 7; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Unexpected itemId")
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_MigrateLegacySegments(t *testing.T) {
+	qName := "testMigrateLegacySegments"
+	for _, opts := range []dque.Options{{}, {SegmentPrefix: "jobs-", Logger: &recordingLogger{}}} {
+		if err := os.RemoveAll(qName); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+
+		q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, opts)
+		if err != nil {
+			t.Fatal("Error creating dque:", err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := q.Enqueue(&item2{i}); err != nil {
+				t.Fatal("Error enqueueing:", err)
+			}
+		}
+		q.Close()
+
+		// Strip the 16-byte header from each segment, and the 9-byte envelope
+		// from each item, to simulate files written by an older version of dque
+		files, err := filepath.Glob(filepath.Join(qName, "*.dque"))
+		if err != nil {
+			t.Fatal("Error listing segment files:", err)
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal("Error reading segment file:", err)
+			}
+			var legacy []byte
+			for rec := data[16:]; len(rec) > 0; {
+				n := int(binary.LittleEndian.Uint32(rec))
+				if n == 0 {
+					legacy = append(legacy, rec[:4]...)
+					rec = rec[4:]
+					continue
+				}
+				lenBytes := make([]byte, 4)
+				binary.LittleEndian.PutUint32(lenBytes, uint32(n-9))
+				legacy = append(append(legacy, lenBytes...), rec[4+9:4+n]...)
+				rec = rec[4+n:]
+			}
+			if err := ioutil.WriteFile(file, legacy, 0644); err != nil {
+				t.Fatal("Error writing segment file:", err)
+			}
+		}
+
+		_, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+		var incompatible dque.ErrIncompatibleSegment
+		assert(t, errors.As(err, &incompatible), "Expected ErrIncompatibleSegment but got %v", err)
+
+		var n int
+		if opts.SegmentPrefix == "" {
+			n, err = dque.MigrateLegacySegments(qName, ".", 3)
+		} else {
+			// A file that isn't a segment is skipped and logged
+			stray := filepath.Join(qName, opts.SegmentPrefix+"99999999999999999999.dque")
+			if err := ioutil.WriteFile(stray, nil, 0644); err != nil {
+				t.Fatal("Error writing file:", err)
+			}
+			n, err = dque.MigrateLegacySegmentsWithOptions(qName, ".", 3, opts)
+			os.Remove(stray)
+			logger := opts.Logger.(*recordingLogger)
+			assert(t, 1 == len(logger.messages), "Expected the stray file to be logged but got %q", logger.messages)
+		}
+		if err != nil {
+			t.Fatal("Error migrating segments:", err)
+		}
+		assert(t, 2 == n, "Expected 2 migrated segments but got %d", n)
+
+		q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+		if err != nil {
+			t.Fatal("Error opening dque:", err)
+		}
+		for i := 0; i < 5; i++ {
+			iface, err := q.Dequeue()
+			if err != nil {
+				t.Fatal("Error dequeueing:", err)
+			}
+			assert(t, i == iface.(*item2).Id, "Unexpected itemId")
+		}
+		q.Close()
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Clear(t *testing.T) {
+	qName := "testClear"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	if err := q.Clear(); err != nil {
+		t.Fatal("Error clearing queue:", err)
+	}
+	assert(t, 0 == q.Size(), "Expected an empty queue")
+	firstSegNum, lastSegNum := q.SegmentNumbers()
+	assert(t, 4 == firstSegNum && 4 == lastSegNum, "Expected segment numbering to continue at 4")
+
+	files, _ := filepath.Glob(filepath.Join(qName, "*.dque"))
+	assert(t, 1 == len(files), "Expected 1 segment file but found %d", len(files))
+
+	// The queue must still be usable
+	if err := q.Enqueue(&item2{7}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+
+	q = openQ(t, qName, false)
+	assert(t, 1 == q.Size(), "Expected 1 item after reopening")
+	iface, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 7 == iface.(*item2).Id, "Unexpected itemId")
+	q.Close()
+
+	if err := q.Clear(); !errors.Is(err, dque.ErrQueueClosed) {
+		t.Fatal("Expected ErrQueueClosed but got", err)
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// Simulates crashes part way through a segment rollover by writing removal
+// markers directly to the segment files.
+func TestQueue_CrashDuringRollover(t *testing.T) {
+	qName := "testCrashDuringRollover"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Crash after the last item of the only segment was dequeued, but before
+	// the next segment was created
+	q := newQ(t, qName, false)
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+	appendRemovalMarkers(t, filepath.Join(qName, "0000000000001.dque"), 3)
+
+	q = openQ(t, qName, false)
+	assert(t, 0 == q.Size(), "Expected an empty queue")
+	firstSegNum, lastSegNum := q.SegmentNumbers()
+	assert(t, 2 == firstSegNum && 2 == lastSegNum, "Expected only segment 2")
+	_, err := os.Stat(filepath.Join(qName, "0000000000001.dque"))
+	assert(t, os.IsNotExist(err), "Expected the exhausted segment file to be deleted")
+
+	// Crash after moving on to the next segment, but before the exhausted
+	// segment file was deleted
+	for i := 3; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+	appendRemovalMarkers(t, filepath.Join(qName, "0000000000002.dque"), 3)
+
+	q = openQ(t, qName, false)
+	assert(t, 1 == q.Size(), "Expected 1 item")
+	iface, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 6 == iface.(*item2).Id, "Unexpected itemId")
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// appendRemovalMarkers appends n zero-length removal markers to a segment file
+func appendRemovalMarkers(t *testing.T, file string, n int) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal("Error opening segment file:", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, 4*n)); err != nil {
+		t.Fatal("Error writing to segment file:", err)
+	}
+}
+
+// One producer and one consumer run concurrently across many segment
+// boundaries and the consumer must see every item in order.
+func TestQueue_ProducerConsumerOrder(t *testing.T) {
+	testQueue_ProducerConsumerOrder(t, true /* true=turbo */)
+	testQueue_ProducerConsumerOrder(t, false /* true=turbo */)
+}
+
+func testQueue_ProducerConsumerOrder(t *testing.T, turbo bool) {
+	qName := "testProducerConsumerOrder"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, turbo)
+	numItems := 300
+
+	go func() {
+		for i := 0; i < numItems; i++ {
+			err := q.Enqueue(&item2{i})
+			assert(t, err == nil, "Expected no error", err)
+		}
+	}()
+
+	for i := 0; i < numItems; i++ {
+		iface, err := q.DequeueBlock()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	assert(t, 0 == q.Size(), "Expected an empty queue")
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_DequeueWithAck(t *testing.T) {
+	qName := "testDequeueWithAck"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Ack permanently removes the item
+	iface, token, err := q.DequeueWithAck()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 0 == iface.(*item2).Id, "Unexpected itemId")
+	assert(t, 3 == q.Size(), "Expected 3 items while the item is checked out")
+	if err := token.Ack(); err != nil {
+		t.Fatal("Error acknowledging item:", err)
+	}
+	assert(t, errors.Is(token.Ack(), dque.ErrAlreadyAcknowledged), "Expected ErrAlreadyAcknowledged")
+
+	// Nack returns the item to the head of the queue
+	iface, token, err = q.DequeueWithAck()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 1 == iface.(*item2).Id, "Unexpected itemId")
+	if err := token.Nack(); err != nil {
+		t.Fatal("Error returning item:", err)
+	}
+	assert(t, 3 == q.Size(), "Expected 3 items after Nack")
+	iface, err = q.Peek()
+	if err != nil {
+		t.Fatal("Error peeking:", err)
+	}
+	assert(t, 1 == iface.(*item2).Id, "Expected the returned item at the head of the queue")
+
+	// Items still checked out when the queue closes come back when it opens
+	_, _, err = q.DequeueWithAck()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	_, _, err = q.DequeueWithAck()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 1 == q.Size(), "Expected 1 item while 2 are checked out")
+	q.Close()
+
+	q = openQ(t, qName, false)
+	assert(t, 3 == q.Size(), "Expected 3 items after reopening")
+	for i := 1; i < 4; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Compact(t *testing.T) {
+	qName := "testCompact"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	file := filepath.Join(qName, "0000000000001.dque")
+	before := fileSize(t, file)
+	if err := q.Compact(); err != nil {
+		t.Fatal("Error compacting:", err)
+	}
+	after := fileSize(t, file)
+	assert(t, after < before, "Expected compaction to shrink the file from %d bytes but it is %d", before, after)
+	assert(t, 1 == q.Size(), "Expected 1 item but got %d", q.Size())
+
+	// The compacted segment has room for 2 more items before rolling over
+	for i := 2; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	firstSegNum, lastSegNum := q.SegmentNumbers()
+	assert(t, 1 == firstSegNum && 2 == lastSegNum, "Expected segments 1 and 2 but got %d and %d", firstSegNum, lastSegNum)
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for i := 1; i < 5; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	assert(t, 0 == q.Size(), "Expected an empty queue")
+	q.Close()
+
+	if err := q.Compact(); !errors.Is(err, dque.ErrQueueClosed) {
+		t.Fatal("Expected ErrQueueClosed but got", err)
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_CompactSegment(t *testing.T) {
+	qName := "testCompactSegment"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Segment 1 is full and segment 2 holds items 3 and 4
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+
+	// The last segment is left alone
+	last := filepath.Join(qName, "0000000000002.dque")
+	before := fileSize(t, last)
+	if err := q.CompactSegment(2); err != nil {
+		t.Fatal("Error compacting the last segment:", err)
+	}
+	assert(t, fileSize(t, last) == before, "Expected the last segment not to be compacted")
+
+	first := filepath.Join(qName, "0000000000001.dque")
+	before = fileSize(t, first)
+	if err := q.CompactSegment(1); err != nil {
+		t.Fatal("Error compacting the first segment:", err)
+	}
+	after := fileSize(t, first)
+	assert(t, after < before, "Expected compaction to shrink the first segment from %d bytes but it is %d", before, after)
+
+	if err := q.CompactSegment(3); err == nil {
+		t.Fatal("Expected an error compacting a segment that isn't in the queue")
+	}
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for i := 2; i < 5; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	assert(t, 0 == q.Size(), "Expected an empty queue")
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func fileSize(t *testing.T, file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal("Error reading file size:", err)
+	}
+	return info.Size()
+}
+
+func TestQueue_FileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not support Unix permissions")
+	}
+	qName := "testFileModes"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	opts := dque.Options{DirMode: 0700, FileMode: 0600}
+	q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, _, err := q.DequeueWithAck(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	if err := q.Compact(); err != nil {
+		t.Fatal("Error compacting:", err)
+	}
+
+	for _, dir := range []string{qName, filepath.Join(qName, "inflight")} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal("Error reading directory:", err)
+		}
+		assert(t, 0700 == info.Mode().Perm(), "Expected %s to have mode 0700 but it has %o", dir, info.Mode().Perm())
+	}
+	files, _ := filepath.Glob(filepath.Join(qName, "*", "*.dque"))
+	segFiles, _ := filepath.Glob(filepath.Join(qName, "*.dque"))
+	files = append(files, segFiles...)
+	assert(t, 3 == len(files), "Expected 3 files but found %d", len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal("Error reading file:", err)
+		}
+		assert(t, 0600 == info.Mode().Perm(), "Expected %s to have mode 0600 but it has %o", file, info.Mode().Perm())
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_DiskUsage(t *testing.T) {
+	qName := "testDiskUsage"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	assert(t, 1 == q.SegmentCount(), "Expected 1 segment but got %d", q.SegmentCount())
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 3 == q.SegmentCount(), "Expected 3 segments but got %d", q.SegmentCount())
+
+	usage, err := q.DiskUsage()
+	if err != nil {
+		t.Fatal("Error reading disk usage:", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(qName, "*.dque"))
+	var want int64
+	for _, file := range files {
+		want += fileSize(t, file)
+	}
+	assert(t, want == usage, "Expected %d bytes but got %d", want, usage)
+
+	// Removal markers add to the usage until the segment is deleted
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	after, err := q.DiskUsage()
+	if err != nil {
+		t.Fatal("Error reading disk usage:", err)
+	}
+	assert(t, usage+4 == after, "Expected %d bytes but got %d", usage+4, after)
+	q.Close()
+
+	assert(t, 0 == q.SegmentCount(), "Expected no segments after closing")
+	if _, err := q.DiskUsage(); !errors.Is(err, dque.ErrQueueClosed) {
+		t.Fatal("Expected ErrQueueClosed but got", err)
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_SegmentNaming(t *testing.T) {
+	qName := "testSegmentNaming"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	opts := dque.Options{SegmentPrefix: "orders-", SegmentWidth: 4}
+	q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	files, _ := filepath.Glob(filepath.Join(qName, "*.dque"))
+	assert(t, 3 == len(files), "Expected 3 segment files but found %d", len(files))
+	for i, file := range files {
+		want := filepath.Join(qName, fmt.Sprintf("orders-%04d.dque", i+1))
+		assert(t, want == file, "Expected %s but found %s", want, file)
+	}
+
+	q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 7 == q.Size(), "Expected 7 items but got %d", q.Size())
+	q.Close()
+
+	// The segment files aren't found without the prefix
+	q = openQ(t, qName, false)
+	assert(t, 0 == q.Size(), "Expected no items but got %d", q.Size())
+	q.Close()
+
+	_, err = dque.NewWithOptions("testBadPrefix", ".", 3, item2Builder, dque.Options{SegmentPrefix: "a/b"})
+	assert(t, err != nil, "Expected a prefix with a path separator to be rejected")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_DecodeMismatch(t *testing.T) {
+	qName := "testDecodeMismatch"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	if err := q.Enqueue(&item2{1}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+
+	type otherItem struct {
+		Name string
+	}
+	_, err := dque.Open(qName, ".", 3, func() interface{} { return &otherItem{} })
+
+	var mismatch dque.ErrDecodeMismatch
+	assert(t, errors.As(err, &mismatch), "Expected ErrDecodeMismatch but got %v", err)
+	dir, absErr := filepath.Abs(qName)
+	if absErr != nil {
+		t.Fatal("Error finding the absolute path of the queue:", absErr)
+	}
+	assert(t, filepath.Join(dir, "0000000000001.dque") == mismatch.Path, "Unexpected path %s", mismatch.Path)
+	assert(t, 16 == mismatch.Offset, "Expected the first record after the header but got offset %d", mismatch.Offset)
+	assert(t, "*dque_test.otherItem" == mismatch.Type, "Unexpected type %s", mismatch.Type)
+
+	var unableToDecode dque.ErrUnableToDecode
+	assert(t, errors.As(err, &unableToDecode), "Expected ErrUnableToDecode but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_CorruptedRecord(t *testing.T) {
+	qName := "testCorruptedRecord"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Overwrite the payload of the second record with garbage
+	file := filepath.Join(qName, "0000000000001.dque")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("Error reading segment file:", err)
+	}
+	offset := 16 + 4 + int(data[16])
+	for i := offset + 4 + 9; i < len(data); i++ { // past the length and the envelope
+		data[i] = 0xff
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal("Error writing segment file:", err)
+	}
+
+	_, err = dque.Open(qName, ".", 3, item2Builder)
+	assert(t, err != nil, "Expected opening a corrupted segment to fail")
+	var mismatch dque.ErrDecodeMismatch
+	assert(t, errors.As(err, &mismatch), "Expected ErrDecodeMismatch but got %v", err)
+	assert(t, 1 == mismatch.Index, "Expected the second object but got %d", mismatch.Index)
+	assert(t, int64(offset) == mismatch.Offset, "Expected offset %d but got %d", offset, mismatch.Offset)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Bytes(t *testing.T) {
+	for _, compression := range []dque.Compression{dque.CompressionNone, dque.CompressionGzip} {
+		testQueue_Bytes(t, compression)
+	}
+}
+
+func testQueue_Bytes(t *testing.T, compression dque.Compression) {
+	qName := "testBytes"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// No builder is needed for byte slices
+	opts := dque.Options{Codec: dque.CodecBytes, Compression: compression}
+	q, err := dque.NewWithOptions(qName, ".", 3, nil, opts)
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := q.EnqueueBytes([]byte(fmt.Sprintf("item %d", i))); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, q.EnqueueBytes([]byte{}) != nil, "Expected an empty slice to be rejected")
+	assert(t, q.Enqueue("item") != nil, "Expected a string to be rejected")
+	q.Close()
+
+	// The codec is recorded in the segment files
+	q, err = dque.Open(qName, ".", 3, nil)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 7 == q.Size(), "Expected 7 items but got %d", q.Size())
+	for i := 0; i < 7; i++ {
+		b, err := q.DequeueBytes()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		want := fmt.Sprintf("item %d", i)
+		assert(t, want == string(b), "Expected %q but got %q", want, b)
+	}
+	_, err = q.DequeueBytes()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// A gob queue can't store raw bytes
+	q = newQ(t, qName, false)
+	assert(t, q.EnqueueBytes([]byte("item")) != nil, "Expected EnqueueBytes to fail on a gob queue")
+	_, err = q.DequeueBytes()
+	assert(t, err != nil, "Expected DequeueBytes to fail on a gob queue")
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_RemoveWhere(t *testing.T) {
+	qName := "testRemoveWhere"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Segments hold [0 1 2] [3 4 5] [6 7 8] [9]
+	q := newQ(t, qName, false)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Remove from a middle segment, the first segment, and the last segment
+	for _, id := range []int{4, 0, 9} {
+		iface, ok, err := q.RemoveWhere(func(obj interface{}) bool { return obj.(*item2).Id == id })
+		if err != nil {
+			t.Fatal("Error removing:", err)
+		}
+		assert(t, ok, "Expected item %d to be found", id)
+		assert(t, id == iface.(*item2).Id, "Expected item %d but got %d", id, iface.(*item2).Id)
+	}
+	_, ok, err := q.RemoveWhere(func(obj interface{}) bool { return obj.(*item2).Id == 4 })
+	assert(t, err == nil, "Expected no error but got %v", err)
+	assert(t, !ok, "Expected item 4 to be gone")
+	assert(t, 7 == q.Size(), "Expected a size of 7 but got %d", q.Size())
+	assert(t, 7 == q.SizeUnsafe(), "Expected an unsafe size of 7 but got %d", q.SizeUnsafe())
+	q.Close()
+
+	// The removals are persistent, and the items left in the middle segment
+	// are counted when the queue is opened
+	q = openQ(t, qName, false)
+	assert(t, 7 == q.Size(), "Expected a size of 7 after opening but got %d", q.Size())
+	assert(t, 7 == q.SizeUnsafe(), "Expected an unsafe size of 7 after opening but got %d", q.SizeUnsafe())
+	for _, id := range []int{1, 2, 3, 5, 6, 7, 8} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == iface.(*item2).Id, "Expected item %d but got %d", id, iface.(*item2).Id)
+	}
+	_, err = q.Dequeue()
+	assert(t, err == dque.ErrEmpty, "Expected an empty queue but got %v", err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Removing the only item of a segment leaves it empty
+	q, err = dque.New(qName, ".", 1, item2Builder)
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, ok, err := q.RemoveWhere(func(obj interface{}) bool { return obj.(*item2).Id == 1 }); err != nil || !ok {
+		t.Fatal("Error removing:", err)
+	}
+	for _, id := range []int{0, 2} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == iface.(*item2).Id, "Expected item %d but got %d", id, iface.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_StoredItemsPerSegment(t *testing.T) {
+	qName := "testStoredItemsPerSegment"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Open with a different segment size.  The one the queue was created
+	// with is still used.
+	q, err := dque.Open(qName, ".", 10, item2Builder)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 7 == q.Size(), "Expected 7 items but got %d", q.Size())
+	for i := 7; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	firstSegNum, lastSegNum := q.SegmentNumbers()
+	assert(t, 1 == firstSegNum && 4 == lastSegNum, "Expected segments 1 to 4 but got %d to %d", firstSegNum, lastSegNum)
+	assert(t, 10 == q.Size(), "Expected 10 items but got %d", q.Size())
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Flush(t *testing.T) {
+	qName := "testFlush"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, true)
+	obs := &countingObserver{}
+	q.SetObserver(obs)
+
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 0 == obs.syncs, "Expected no syncs in turbo mode but got %d", obs.syncs)
+
+	if err := q.Flush(); err != nil {
+		t.Fatal("Error flushing:", err)
+	}
+	assert(t, 1 == obs.syncs, "Expected 1 sync but got %d", obs.syncs)
+
+	// Nothing more to sync
+	if err := q.Flush(); err != nil {
+		t.Fatal("Error flushing:", err)
+	}
+	assert(t, 1 == obs.syncs, "Expected 1 sync but got %d", obs.syncs)
+
+	// Safe mode syncs every change, so there is never anything to flush
+	if err := q.TurboOff(); err != nil {
+		t.Fatal("Error turning off turbo:", err)
+	}
+	if err := q.Enqueue(&item2{2}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	if err := q.Flush(); err != nil {
+		t.Fatal("Error flushing:", err)
+	}
+	assert(t, 2 == obs.syncs, "Expected 2 syncs but got %d", obs.syncs)
+	q.Close()
+
+	if err := q.Flush(); !errors.Is(err, dque.ErrQueueClosed) {
+		t.Fatal("Expected ErrQueueClosed but got", err)
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Channel(t *testing.T) {
+	qName := "testChannel"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	items, cancel := q.Channel(2)
+	var ids []int
+	for item := range items {
+		ids = append(ids, item.(*item2).Id)
+		if len(ids) == 3 {
+			break
+		}
+	}
+	cancel()
+	cancel()
+
+	// Buffered items are still delivered and the rest are still queued
+	for item := range items {
+		ids = append(ids, item.(*item2).Id)
+	}
+	for {
+		iface, err := q.Dequeue()
+		if err == dque.ErrEmpty {
+			break
+		}
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		ids = append(ids, iface.(*item2).Id)
+	}
+	assert(t, 5 == len(ids), "Expected 5 items but got %v", ids)
+	for i, id := range ids {
+		assert(t, i == id, "Expected the items in order but got %v", ids)
+	}
+
+	// Items enqueued while the channel is waiting are delivered
+	items, cancel = q.Channel(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		err := q.Enqueue(&item2{5})
+		assert(t, err == nil, "Expected no error")
+	}()
+	select {
+	case item := <-items:
+		assert(t, 5 == item.(*item2).Id, "Unexpected itemId")
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for an item")
+	}
+
+	// Closing the queue closes the channel
+	q.Close()
+	select {
+	case _, ok := <-items:
+		assert(t, !ok, "Expected the channel to be closed")
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the channel to close")
+	}
+	cancel()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Cursor(t *testing.T) {
+	qName := "testCursor"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	// New cursors start at the head of the queue
+	a, err := q.NewCursor("a")
+	if err != nil {
+		t.Fatal("Error creating cursor:", err)
+	}
+	b, err := q.NewCursor("b")
+	if err != nil {
+		t.Fatal("Error creating cursor:", err)
+	}
+	iface, err := b.Peek()
+	assert(t, err == nil && 1 == iface.(*item2).Id, "Expected to peek at item 1 but got %v, %v", iface, err)
+	assertCursorReads(t, a, 1, 7)
+	_, err = a.Next()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+
+	// Cursors see items enqueued after they caught up
+	if err := q.Enqueue(&item2{7}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	assertCursorReads(t, a, 7, 8)
+
+	// Dequeueing everything doesn't delete the segments cursor b still needs
+	for i := 1; i < 8; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	firstFile := filepath.Join(qName, "0000000000001.dque")
+	_, err = os.Stat(firstFile)
+	assert(t, err == nil, "Expected the first segment file to be kept for cursor b")
+	q.Close()
+
+	// Cursors continue from where they were after reopening
+	q = openQ(t, qName, false)
+	b, err = q.NewCursor("b")
+	if err != nil {
+		t.Fatal("Error opening cursor:", err)
+	}
+	assertCursorReads(t, b, 1, 8)
+	_, err = os.Stat(firstFile)
+	assert(t, os.IsNotExist(err), "Expected the first segment file to be deleted once every cursor passed it")
+
+	a, err = q.NewCursor("a")
+	if err != nil {
+		t.Fatal("Error opening cursor:", err)
+	}
+	_, err = a.Next()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+
+	// A deleted cursor can't be used
+	if err := q.DeleteCursor("a"); err != nil {
+		t.Fatal("Error deleting cursor:", err)
+	}
+	_, err = a.Next()
+	assert(t, err != nil, "Expected an error from a deleted cursor")
+	_, err = q.NewCursor("a/b")
+	assert(t, err != nil, "Expected a cursor name with a path separator to be rejected")
+	q.Close()
+
+	_, err = b.Next()
+	assert(t, errors.Is(err, dque.ErrQueueClosed), "Expected ErrQueueClosed but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// assertCursorReads asserts that the cursor reads the items with ids from
+// first up to (but not including) last.
+func assertCursorReads(t *testing.T, c *dque.Cursor, first, last int) {
+	for i := first; i < last; i++ {
+		iface, err := c.Next()
+		if err != nil {
+			t.Fatalf("Error reading item %d from cursor %s: %v", i, c.Name(), err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d from cursor %s but got %d", i, c.Name(), iface.(*item2).Id)
+	}
+}
+
+func TestQueue_EnqueueFront(t *testing.T) {
+	qName := "testEnqueueFront"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 1; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	// The first segment has room for item 1 again
+	if err := q.EnqueueFront(&item2{1}); err != nil {
+		t.Fatal("Error enqueueing to the front:", err)
+	}
+	first, _ := q.SegmentNumbers()
+	assert(t, 1 == first, "Expected the first segment to be 1 but got %d", first)
+
+	// The first segment is full so a segment is added before it
+	if err := q.EnqueueFront(&item2{0}); err != nil {
+		t.Fatal("Error enqueueing to the front:", err)
+	}
+	first, _ = q.SegmentNumbers()
+	assert(t, 0 == first, "Expected the first segment to be 0 but got %d", first)
+	assert(t, 5 == q.Size(), "Expected size of 5 but got %d", q.Size())
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_TurboInterval(t *testing.T) {
+	qName := "testTurboInterval"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	obs := &syncObserver{synced: make(chan struct{}, 10)}
+	q.SetObserver(obs)
+
+	// Changes are synced after maxOps of them, well before the interval
+	if err := q.TurboInterval(time.Hour, 2); err != nil {
+		t.Fatal("Error turning on turbo with an interval:", err)
+	}
+	assert(t, q.Turbo(), "Expected turbo to be on")
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	select {
+	case <-obs.synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a sync after 2 changes")
+	}
+
+	// Changes are synced at the interval
+	if err := q.TurboInterval(10*time.Millisecond, 0); err != nil {
+		t.Fatal("Error changing the turbo interval:", err)
+	}
+	if err := q.Enqueue(&item2{2}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	select {
+	case <-obs.synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a sync after the interval")
+	}
+
+	assert(t, q.TurboInterval(0, 1) != nil, "Expected an error for a zero interval")
+	if err := q.TurboOff(); err != nil {
+		t.Fatal("Error turning off turbo:", err)
+	}
+	q.Close()
+	assert(t, errors.Is(q.TurboInterval(time.Second, 0), dque.ErrQueueClosed), "Expected ErrQueueClosed")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// syncObserver reports every sync on a channel
+type syncObserver struct {
+	countingObserver
+	synced chan struct{}
+}
+
+func (o *syncObserver) OnSync() {
+	select {
+	case o.synced <- struct{}{}:
+	default:
+	}
+}
+
+func TestQueue_Repair(t *testing.T) {
+	qName := "testRepair"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Fill two segments and start a third
+	q := newQ(t, qName, false)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Add a record that can't be decoded to the first segment, lose the
+	// second segment, and leave a partial record in the third
+	appendBytes := func(file string, b []byte) {
+		f, err := os.OpenFile(filepath.Join(qName, file), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	appendBytes("0000000000001.dque", []byte{3, 0, 0, 0, 1, 2, 3})
+	appendBytes("0000000000003.dque", []byte{40, 0, 0})
+	if err := os.Remove(filepath.Join(qName, "0000000000002.dque")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := dque.Repair(qName, ".", 3, item2Builder)
+	if err != nil {
+		t.Fatal("Error repairing the queue:", err)
+	}
+	want := dque.RepairReport{FilesScanned: 2, RecordsRecovered: 4, RecordsDropped: 1, BytesTruncated: 3, SegmentsCreated: 1}
+	assert(t, want == report, "Expected report %+v but got %+v", want, report)
+
+	q = openQ(t, qName, false)
+	for _, id := range []int{0, 1, 2, 6} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == iface.(*item2).Id, "Expected item %d but got %d", id, iface.(*item2).Id)
+	}
+	_, err = q.Dequeue()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_ReadOnly(t *testing.T) {
+	qName := "testReadOnly"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Segments hold [0 1 2] [3 4 5] [6 7]
+	q := newQ(t, qName, false)
+	for i := 0; i < 8; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Leave a partial record, as if the owner were part way through an enqueue
+	lastFile := filepath.Join(qName, "0000000000003.dque")
+	f, err := os.OpenFile(lastFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{40, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	size := fileSize(t, lastFile)
+
+	// The queue can be opened while q holds the lock
+	ro, err := dque.OpenReadOnly(qName, ".", 3, item2Builder)
+	if err != nil {
+		t.Fatal("Error opening the queue read-only:", err)
+	}
+	assert(t, 8 == ro.Size(), "Expected size of 8 but got %d", ro.Size())
+	iface, err := ro.Peek()
+	assert(t, err == nil && 0 == iface.(*item2).Id, "Expected to peek at item 0 but got %v, %v", iface, err)
+	assert(t, size == fileSize(t, lastFile), "Expected the partial record to be left alone")
+
+	// Items can be read from every segment
+	objects, err := ro.PeekN(5)
+	if err != nil {
+		t.Fatal("Error peeking:", err)
+	}
+	assert(t, 5 == len(objects), "Expected 5 items but got %d", len(objects))
+	for i, obj := range objects {
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	objects, err = ro.PeekN(20)
+	assert(t, err == nil && 8 == len(objects), "Expected all 8 items but got %d, %v", len(objects), err)
+	var ids []int
+	err = ro.Iterate(func(obj interface{}) bool {
+		ids = append(ids, obj.(*item2).Id)
+		return len(ids) < 7
+	})
+	if err != nil {
+		t.Fatal("Error iterating:", err)
+	}
+	assert(t, 7 == len(ids), "Expected to stop at item 6 but got %v", ids)
+	for i, id := range ids {
+		assert(t, i == id, "Expected item %d but got %d", i, id)
+	}
+	assert(t, 8 == ro.Size(), "Expected size of 8 after reading but got %d", ro.Size())
+
+	// Nothing can change the queue
+	assert(t, ro.Enqueue(&item2{8}) == dque.ErrReadOnly, "Expected ErrReadOnly from Enqueue")
+	err = ro.Prepend([]interface{}{&item2{-1}})
+	assert(t, err == dque.ErrReadOnly, "Expected ErrReadOnly from Prepend but got %v", err)
+	_, err = ro.Dequeue()
+	assert(t, err == dque.ErrReadOnly, "Expected ErrReadOnly from Dequeue but got %v", err)
+	_, err = ro.DequeueBlock()
+	assert(t, err == dque.ErrReadOnly, "Expected ErrReadOnly from DequeueBlock but got %v", err)
+	assert(t, ro.Clear() == dque.ErrReadOnly, "Expected ErrReadOnly from Clear")
+	_, err = ro.NewCursor("reader")
+	assert(t, err == dque.ErrReadOnly, "Expected ErrReadOnly from NewCursor but got %v", err)
+	if err := ro.Close(); err != nil {
+		t.Fatal("Error closing the read-only queue:", err)
+	}
+
+	// The owner is unaffected
+	iface, err = q.Dequeue()
+	assert(t, err == nil && 0 == iface.(*item2).Id, "Expected to dequeue item 0 but got %v, %v", iface, err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Stats(t *testing.T) {
+	qName := "testStats"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, true)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	want := dque.Stats{Items: 6, FirstSegment: 1, LastSegment: 3, SegmentCount: 3, TombstoneCount: 1, Turbo: true}
+	stats := q.Stats()
+	assert(t, want == stats, "Expected %+v but got %+v", want, stats)
+	assert(t, q.Size() == stats.Items, "Expected the items to match a size of %d but got %d", q.Size(), stats.Items)
+	q.Close()
+
+	stats = q.Stats()
+	assert(t, dque.Stats{} == stats, "Expected zero stats after closing but got %+v", stats)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// Types stored in the interface field of an item
+type gobSquare struct{ Side int }
+type gobCircle struct{ Radius int }
+type gobTriangle struct{ Base, Height int }
+
+type shapeItem struct {
+	Shape interface{}
+}
+
+func TestQueue_GobTypes(t *testing.T) {
+	qName := "testGobTypes"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	builder := func() interface{} { return &shapeItem{} }
+	opts := dque.Options{GobTypes: []interface{}{gobSquare{}}}
+	q, err := dque.NewWithOptions(qName, ".", 3, builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	if err := q.Enqueue(&shapeItem{gobSquare{2}}); err != nil {
+		t.Fatal("Error enqueueing a registered type:", err)
+	}
+
+	// An unregistered type fails when it is enqueued, not when it is read
+	err = q.Enqueue(&shapeItem{gobCircle{1}})
+	assert(t, err != nil, "Expected an error enqueueing an unregistered type")
+	assert(t, strings.Contains(err.Error(), "Options.GobTypes"), "Expected the error to mention Options.GobTypes: %v", err)
+	q.Close()
+
+	q, err = dque.OpenWithOptions(qName, ".", 3, builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	iface, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, gobSquare{2} == iface.(*shapeItem).Shape, "Expected a square but got %#v", iface)
+	q.Close()
+
+	_, err = dque.NewOrOpenWithOptions(qName, ".", 3, builder, dque.Options{GobTypes: []interface{}{nil}})
+	assert(t, err != nil, "Expected an error for a nil type")
+
+	// gob can't register a type under two names, which is an error rather
+	// than a panic
+	_, err = dque.OpenWithOptions(qName, ".", 3, builder, dque.Options{GobTypes: []interface{}{gobTriangle{}, &gobTriangle{}}})
+	assert(t, err != nil && strings.Contains(err.Error(), "Options.GobTypes"), "Expected an error registering a type twice but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_DrainTo(t *testing.T) {
+	srcName := "testDrainSource"
+	dstName := "testDrainDestination"
+	for _, name := range []string{srcName, dstName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+	}
+
+	src := newQ(t, srcName, false)
+	for i := 0; i < 7; i++ {
+		if err := src.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Re-segment the queue with a larger segment size
+	dst, err := dque.New(dstName, ".", 5, item2Builder)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	if err := dst.Enqueue(&item2{-1}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	n, err := src.DrainTo(dst)
+	if err != nil {
+		t.Fatal("Error draining:", err)
+	}
+	assert(t, 7 == n, "Expected 7 items moved but got %d", n)
+	assert(t, 0 == src.Size(), "Expected an empty source but got %d items", src.Size())
+	assert(t, 8 == dst.Size(), "Expected 8 items in the destination but got %d", dst.Size())
+	for i := -1; i < 7; i++ {
+		iface, err := dst.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+
+	// Draining an empty queue moves nothing
+	n, err = src.DrainTo(dst)
+	assert(t, err == nil && 0 == n, "Expected nothing to be moved but got %d, %v", n, err)
+	_, err = src.DrainTo(src)
+	assert(t, err != nil, "Expected an error draining a queue into itself")
+
+	// Items stay put when the destination fails
+	if err := src.Enqueue(&item2{7}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	dst.Close()
+	n, err = src.DrainTo(dst)
+	assert(t, errors.Is(err, dque.ErrQueueClosed) && 0 == n, "Expected ErrQueueClosed but got %d, %v", n, err)
+	assert(t, 1 == src.Size(), "Expected the item to stay in the source but got %d items", src.Size())
+	src.Close()
+
+	// Two queues can drain into each other at the same time
+	for _, name := range []string{srcName, dstName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+	}
+	a, b := newQ(t, srcName, true), newQ(t, dstName, true)
+	for i := 0; i < 100; i++ {
+		if err := a.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		if err := b.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	drained := make(chan error, 2)
+	go func() { _, err := a.DrainTo(b); drained <- err }()
+	go func() { _, err := b.DrainTo(a); drained <- err }()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-drained:
+			assert(t, err == nil, "Expected no error draining but got %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Draining two queues into each other deadlocked")
+		}
+	}
+	assert(t, 200 == a.Size()+b.Size(), "Expected 200 items between the queues but got %d", a.Size()+b.Size())
+	a.Close()
+	b.Close()
+
+	for _, name := range []string{srcName, dstName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error cleaning up the queue directory:", err)
+		}
+	}
+}
+
+// recordingLogger keeps every message logged by a queue
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestQueue_Logger(t *testing.T) {
+	qName := "testLogger"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	if err := q.Enqueue(&item2{0}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+
+	// Leave a partial record behind as a crash would
+	f, err := os.OpenFile(filepath.Join(qName, "0000000000001.dque"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{40, 0}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	logger := &recordingLogger{}
+	q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{Logger: logger})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 1 == len(logger.messages), "Expected 1 message but got %q", logger.messages)
+	assert(t, strings.Contains(logger.messages[0], "truncating"), "Expected a truncation message but got %q", logger.messages[0])
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_TTL(t *testing.T) {
+	qName := "testTTL"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Items older than the TTL span the first two segments
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i := 5; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Enqueue times survive reopening the queue
+	q = openQ(t, qName, false)
+	q.SetTTL(150 * time.Millisecond)
+	iface, err := q.Peek()
+	assert(t, err == nil && 5 == iface.(*item2).Id, "Expected to peek at item 5 but got %v, %v", iface, err)
+	assert(t, 5 == q.Stats().ExpiredCount, "Expected 5 expired items but got %d", q.Stats().ExpiredCount)
+	assert(t, 2 == q.Size(), "Expected size of 2 but got %d", q.Size())
+
+	// Everything expires eventually
+	time.Sleep(200 * time.Millisecond)
+	_, err = q.Dequeue()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+	assert(t, 7 == q.Stats().ExpiredCount, "Expected 7 expired items but got %d", q.Stats().ExpiredCount)
+
+	// A TTL of zero keeps items forever
+	if err := q.Enqueue(&item2{7}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.SetTTL(0)
+	time.Sleep(200 * time.Millisecond)
+	iface, err = q.Dequeue()
+	assert(t, err == nil && 7 == iface.(*item2).Id, "Expected to dequeue item 7 but got %v, %v", iface, err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Prepend(t *testing.T) {
+	qName := "testPrepend"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Leave segment 3 as the first segment with room for one more item
+	q := newQ(t, qName, false)
+	for i := 100; i < 110; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+
+	// Two new segments are needed before segment 3
+	var objects []interface{}
+	for i := 0; i < 6; i++ {
+		objects = append(objects, &item2{i})
+	}
+	if err := q.Prepend(objects); err != nil {
+		t.Fatal("Error prepending:", err)
+	}
+	first, _ := q.SegmentNumbers()
+	assert(t, 1 == first, "Expected the first segment to be 1 but got %d", first)
+	assert(t, 9 == q.Size(), "Expected size of 9 but got %d", q.Size())
+
+	// An item that fits goes in the first segment
+	if err := q.Prepend([]interface{}{&item2{-1}}); err != nil {
+		t.Fatal("Error prepending:", err)
+	}
+	first, _ = q.SegmentNumbers()
+	assert(t, 1 == first, "Expected the first segment to be 1 but got %d", first)
+
+	assert(t, q.Prepend(nil) != nil, "Expected an error prepending no items")
+	assert(t, q.Prepend([]interface{}{&item2{-2}, nil}) != nil, "Expected an error prepending a nil item")
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for _, id := range []int{-1, 0, 1, 2, 3, 4, 5, 107, 108, 109} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == iface.(*item2).Id, "Expected item %d but got %d", id, iface.(*item2).Id)
+	}
+	_, err := q.Dequeue()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_IsClosed(t *testing.T) {
+	qName := "testIsClosed"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	assert(t, !q.IsClosed(), "Expected an open queue")
+	if err := q.Close(); err != nil {
+		t.Fatal("Error closing dque:", err)
+	}
+	assert(t, q.IsClosed(), "Expected a closed queue")
+	assert(t, dque.ErrQueueClosed == q.Close(), "Expected ErrQueueClosed from a second Close")
+
+	// A queue that is collected without being closed is reported
+	logger := chanLogger(make(chan string, 1))
+	q, err := dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{Logger: logger})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	q = nil
+	deadline := time.After(5 * time.Second)
+	for done := false; !done; {
+		runtime.GC()
+		select {
+		case msg := <-logger:
+			assert(t, strings.Contains(msg, "without being closed"), "Expected a leak warning but got %q", msg)
+			done = true
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected a warning about the leaked queue")
+		}
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// chanLogger sends every message logged by a queue to the channel
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...interface{}) {
+	select {
+	case l <- fmt.Sprintf(format, v...):
+	default:
+	}
+}
+
+func TestQueue_OnPoison(t *testing.T) {
+	qName := "testOnPoison"
+	dlqName := "testOnPoisonDLQ"
+	for _, name := range []string{qName, dlqName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	q.Close()
+
+	// Poison the second item of the first segment, which comes before a
+	// removal marker, and the last item of the second segment
+	corruptRecord(t, filepath.Join(qName, "0000000000001.dque"), 1)
+	corruptRecord(t, filepath.Join(qName, "0000000000002.dque"), 1)
+
+	// Without OnPoison, or when it refuses to skip, the queue can't be opened
+	_, err := dque.Open(qName, ".", 3, item2Builder)
+	var unableToDecode dque.ErrUnableToDecode
+	assert(t, errors.As(err, &unableToDecode), "Expected ErrUnableToDecode but got %v", err)
+	_, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{
+		OnPoison: func(raw []byte, err error) bool { return false },
+	})
+	assert(t, errors.As(err, &unableToDecode), "Expected ErrUnableToDecode but got %v", err)
+
+	dlq, err := dque.NewWithOptions(dlqName, ".", 3, nil, dque.Options{Codec: dque.CodecBytes})
+	if err != nil {
+		t.Fatal("Error creating dead-letter dque:", err)
+	}
+	opts := dque.Options{
+		OnPoison: func(raw []byte, err error) bool {
+			assert(t, errors.As(err, &unableToDecode), "Expected ErrUnableToDecode but got %v", err)
+			return dlq.Enqueue(raw) == nil
+		},
+	}
+	q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for _, want := range []int{2, 3} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, want == iface.(*item2).Id, "Expected item %d but got %d", want, iface.(*item2).Id)
+	}
+	_, err = q.Dequeue()
+	assert(t, dque.ErrEmpty == err, "Expected an empty queue but got %v", err)
+	assert(t, 2 == dlq.Size(), "Expected 2 dead letters but got %d", dlq.Size())
+	q.Close()
+	dlq.Close()
+
+	// The poison records are gone from the files
+	q = openQ(t, qName, false)
+	assert(t, 0 == q.Size(), "Expected an empty queue but got %d items", q.Size())
+	q.Close()
+
+	for _, name := range []string{qName, dlqName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error cleaning up the queue directory:", err)
+		}
+	}
+}
+
+// corruptRecord overwrites the item of the record at the given index of a
+// segment file with garbage, leaving its envelope alone.
+func corruptRecord(t *testing.T, file string, index int) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("Error reading segment file:", err)
+	}
+	offset := 16
+	for ; index > 0; index-- {
+		offset += 4 + int(binary.LittleEndian.Uint32(data[offset:]))
+	}
+	end := offset + 4 + int(binary.LittleEndian.Uint32(data[offset:]))
+	for i := offset + 4 + 9; i < end; i++ {
+		data[i] = 0xff
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal("Error writing segment file:", err)
+	}
+}
+
+func TestQueue_PeekAvailable(t *testing.T) {
+	qName := "testPeekAvailable"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	_, n, err := q.PeekAvailable()
+	assert(t, dque.ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	assert(t, 0 == n, "Expected nothing available but got %d", n)
+
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	// Only the rest of the first segment is available
+	iface, n, err := q.PeekAvailable()
+	if err != nil {
+		t.Fatal("Error peeking:", err)
+	}
+	assert(t, 1 == iface.(*item2).Id, "Expected item 1 but got %d", iface.(*item2).Id)
+	assert(t, 2 == n, "Expected 2 available but got %d", n)
+	assert(t, 4 == q.Size(), "Expected PeekAvailable to leave 4 items but got %d", q.Size())
+
+	q.Close()
+	_, _, err = q.PeekAvailable()
+	assert(t, dque.ErrQueueClosed == err, "Expected ErrQueueClosed but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Encryption(t *testing.T) {
+	qName := "testEncryption"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	opts := dque.Options{Codec: dque.CodecBytes, EncryptionKey: key}
+
+	_, err := dque.NewWithEncryption(qName, ".", 3, item2Builder, key[:16])
+	assert(t, err != nil, "Expected a short key to be rejected")
+
+	q, err := dque.NewWithOptions(qName, ".", 3, nil, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.EnqueueBytes([]byte(fmt.Sprintf("secret-%d", i))); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.DequeueBytes(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	q.Close()
+
+	// Nothing is stored in the clear
+	file := filepath.Join(qName, "0000000000001.dque")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("Error reading segment file:", err)
+	}
+	assert(t, !strings.Contains(string(data), "secret"), "Expected the items to be encrypted")
+
+	// The queue can't be opened without its key
+	_, err = dque.Open(qName, ".", 3, nil)
+	assert(t, errors.Is(err, dque.ErrWrongKey), "Expected ErrWrongKey without a key but got %v", err)
+	_, err = dque.OpenWithOptions(qName, ".", 3, nil, dque.Options{EncryptionKey: []byte("fedcba9876543210fedcba9876543210")})
+	assert(t, errors.Is(err, dque.ErrWrongKey), "Expected ErrWrongKey with another key but got %v", err)
+
+	q, err = dque.OpenWithOptions(qName, ".", 3, nil, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for i := 1; i < 4; i++ {
+		b, err := q.DequeueBytes()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		want := fmt.Sprintf("secret-%d", i)
+		assert(t, want == string(b), "Expected %s but got %s", want, b)
+	}
+	if err := q.EnqueueBytes([]byte("secret-4")); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+
+	// A damaged record is reported as one that can't be decoded
+	file = filepath.Join(qName, "0000000000002.dque")
+	data, err = ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("Error reading segment file:", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal("Error writing segment file:", err)
+	}
+	_, err = dque.OpenWithOptions(qName, ".", 3, nil, opts)
+	var unableToDecode dque.ErrUnableToDecode
+	assert(t, errors.As(err, &unableToDecode), "Expected ErrUnableToDecode but got %v", err)
+	assert(t, !errors.Is(err, dque.ErrWrongKey), "Expected corruption rather than a wrong key")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_EnqueueN(t *testing.T) {
+	qName := "testEnqueueN"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 7; i++ {
+		size, err := q.EnqueueN(&item2{i})
+		if err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		assert(t, i+1 == size, "Expected size %d but got %d", i+1, size)
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	size, err := q.EnqueueN(&item2{7})
+	if err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	assert(t, 7 == size, "Expected size 7 but got %d", size)
+
+	q.Close()
+	_, err = q.EnqueueN(&item2{8})
+	assert(t, dque.ErrQueueClosed == err, "Expected ErrQueueClosed but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_MaxSegmentBytes(t *testing.T) {
+	qName := "testMaxSegmentBytes"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Two 100 byte items fill a segment long before 10 items do
+	opts := dque.Options{Codec: dque.CodecBytes, MaxSegmentBytes: 200}
+	q, err := dque.NewWithOptions(qName, ".", 10, nil, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := q.EnqueueBytes(bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 5 == q.Size(), "Expected a size of 5 but got %d", q.Size())
+	q.Close()
+
+	files, err := ioutil.ReadDir(qName)
+	if err != nil {
+		t.Fatal("Error reading queue directory:", err)
+	}
+	var segments int
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".dque") {
+			segments++
+			assert(t, f.Size() < 300, "Expected %s to hold at most 2 items but it has %d bytes", f.Name(), f.Size())
+		}
+	}
+	assert(t, 3 == segments, "Expected 3 segments but got %d", segments)
+
+	// The last segment still has room after the queue is opened again
+	q, err = dque.OpenWithOptions(qName, ".", 10, nil, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+
+	// The segment in the middle holds 2 items, not 10
+	assert(t, 5 == q.Size(), "Expected a size of 5 after opening but got %d", q.Size())
+	assert(t, 5 == q.SizeUnsafe(), "Expected an unsafe size of 5 after opening but got %d", q.SizeUnsafe())
+	if err := q.EnqueueBytes(bytes.Repeat([]byte{5}, 100)); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	assert(t, 3 == q.Stats().SegmentCount, "Expected 3 segments but got %d", q.Stats().SegmentCount)
+	for i := 0; i < 6; i++ {
+		b, err := q.DequeueBytes()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, byte(i) == b[0], "Expected item %d but got %d", i, b[0])
+	}
+	q.Close()
+
+	_, err = dque.NewWithOptions(qName+"2", ".", 10, nil, dque.Options{MaxSegmentBytes: -1})
+	assert(t, err != nil, "Expected a negative MaxSegmentBytes to be rejected")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_EnqueueUnique(t *testing.T) {
+	qName := "testEnqueueUnique"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	enqueue := func(key string, id int, want bool) {
+		t.Helper()
+		ok, err := q.EnqueueUnique(key, &item2{id})
+		if err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		assert(t, want == ok, "Expected EnqueueUnique(%q) to return %v", key, want)
+	}
+
+	enqueue("a", 0, true)
+	enqueue("b", 1, true)
+	enqueue("a", 2, false)
+	assert(t, 2 == q.Size(), "Expected 2 items but got %d", q.Size())
+
+	// Only the last 2 keys are remembered
+	assert(t, q.SetDedupWindow(0, 0) != nil, "Expected an empty window to be rejected")
+	if err := q.SetDedupWindow(2, 0); err != nil {
+		t.Fatal("Error setting the dedup window:", err)
+	}
+	enqueue("c", 3, true)
+	enqueue("a", 4, true)
+	enqueue("c", 5, false)
+
+	// Keys are forgotten once they are too old
+	if err := q.SetDedupWindow(0, 50*time.Millisecond); err != nil {
+		t.Fatal("Error setting the dedup window:", err)
+	}
+	enqueue("a", 6, false)
+	time.Sleep(100 * time.Millisecond)
+	enqueue("a", 7, true)
+
+	for _, want := range []int{0, 1, 3, 4, 7} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, want == iface.(*item2).Id, "Expected item %d but got %d", want, iface.(*item2).Id)
+	}
+	q.Close()
+
+	// The window starts empty when the queue is opened again
+	q = openQ(t, qName, false)
+	enqueue("a", 8, true)
+	q.Close()
+
+	// With PersistDedup it is kept in a file, so it survives reopening
+	opts := dque.Options{PersistDedup: true}
+	for _, want := range []bool{true, false} {
+		var err error
+		q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+		if err != nil {
+			t.Fatal("Error opening dque:", err)
+		}
+		enqueue("d", 9, want)
+		q.Close()
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_TryDequeue(t *testing.T) {
+	qName := "testTryDequeue"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	_, ok := q.TryDequeue()
+	assert(t, !ok, "Expected nothing from an empty queue")
+	_, ok = q.TryPeek()
+	assert(t, !ok, "Expected nothing to peek at in an empty queue")
+
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		iface, ok := q.TryPeek()
+		assert(t, ok && i == iface.(*item2).Id, "Expected to peek at item %d", i)
+		iface, ok = q.TryDequeue()
+		assert(t, ok && i == iface.(*item2).Id, "Expected to dequeue item %d", i)
+	}
+	_, ok = q.TryDequeue()
+	assert(t, !ok, "Expected nothing once the queue is drained")
+
+	if err := q.Enqueue(&item2{4}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+	_, ok = q.TryDequeue()
+	assert(t, !ok, "Expected nothing from a closed queue")
+	_, ok = q.TryPeek()
+	assert(t, !ok, "Expected nothing to peek at in a closed queue")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Resegment(t *testing.T) {
+	qName := "testResegment"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	// The in-flight item is carried over and requeued at the head
+	if _, _, err := q.DequeueWithAck(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	err := dque.Resegment(qName, ".", item2Builder, 5)
+	assert(t, errors.Is(err, dque.ErrQueueLocked), "Expected ErrQueueLocked but got %v", err)
+	q.Close()
+
+	if err := dque.Resegment(qName, ".", item2Builder, 5); err != nil {
+		t.Fatal("Error resegmenting:", err)
+	}
+	q = openQ(t, qName, false)
+	assert(t, 9 == q.Size(), "Expected 9 items but got %d", q.Size())
+	assert(t, 2 == q.SegmentCount(), "Expected 2 segments but got %d", q.SegmentCount())
+	for i := 1; i < 10; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_InvalidBuilder(t *testing.T) {
+	qName := "testInvalidBuilder"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	for _, builder := range []func() interface{}{
+		nil,
+		func() interface{} { return nil },
+		func() interface{} { return item2{} },
+		func() interface{} { return (*item2)(nil) },
+	} {
+		_, err := dque.New(qName, ".", 3, builder)
+		assert(t, errors.Is(err, dque.ErrInvalidBuilder), "Expected ErrInvalidBuilder but got %v", err)
+		_, err = os.Stat(qName)
+		assert(t, os.IsNotExist(err), "Expected no queue directory to be created")
+	}
+
+	// Items must be of the type the builder builds
+	q := newQ(t, qName, false)
+	assert(t, q.Enqueue(item2{0}) != nil, "Expected an item that isn't a pointer to be rejected")
+	_, err := q.EnqueueN("0")
+	assert(t, err != nil, "Expected an item of another type to be rejected")
+	assert(t, q.Prepend([]interface{}{&item2{0}, item2{1}}) != nil, "Expected an item that isn't a pointer to be rejected")
+	assert(t, 0 == q.Size(), "Expected nothing to be enqueued but got %d items", q.Size())
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_ItemType(t *testing.T) {
+	qName := "testItemType"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Items come out as the builder's type whether they were held in
+	// memory or read back from disk
+	q := newQ(t, qName, false)
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, q.Enqueue(item2{4}) != nil, "Expected a value item to be rejected")
+	iface, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	_, ok := iface.(*item2)
+	assert(t, ok, "Expected *item2 from memory but got %T", iface)
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for i := 1; i < 4; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		item, ok := iface.(*item2)
+		assert(t, ok, "Expected *item2 from disk but got %T", iface)
+		assert(t, i == item.Id, "Expected item %d but got %d", i, item.Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_SizeCounter(t *testing.T) {
+	qName := "testSizeCounter"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, true)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := q.Enqueue(&item2{g*100 + i}); err != nil {
+					t.Error("Error enqueueing:", err)
+					return
+				}
+				if i%2 == 0 {
+					if _, err := q.Dequeue(); err != nil {
+						t.Error("Error dequeueing:", err)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert(t, 100 == q.SizeUnsafe(), "Expected 100 items but got %d", q.SizeUnsafe())
+	assert(t, q.Size() == q.SizeUnsafe(), "Expected Size %d to match SizeUnsafe %d", q.Size(), q.SizeUnsafe())
+
+	// Items put back and removed from the middle are counted
+	_, token, err := q.DequeueWithAck()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 99 == q.SizeUnsafe(), "Expected 99 items but got %d", q.SizeUnsafe())
+	if err := token.Nack(); err != nil {
+		t.Fatal("Error returning item:", err)
+	}
+	assert(t, 100 == q.SizeUnsafe(), "Expected 100 items but got %d", q.SizeUnsafe())
+	// The last item each goroutine enqueued ends in 49, and whichever was
+	// enqueued last of all can't have been dequeued yet
+	_, ok, err := q.RemoveWhere(func(obj interface{}) bool { return obj.(*item2).Id%100 == 49 })
+	assert(t, ok && err == nil, "Expected an item ending in 49 to be removed: %v", err)
+	assert(t, 99 == q.SizeUnsafe(), "Expected 99 items but got %d", q.SizeUnsafe())
+	if err := q.Prepend([]interface{}{&item2{-2}, &item2{-1}}); err != nil {
+		t.Fatal("Error prepending:", err)
+	}
+	assert(t, 101 == q.SizeUnsafe(), "Expected 101 items but got %d", q.SizeUnsafe())
+
+	// The counter starts from the computed size when the queue is opened
+	q.Close()
+	assert(t, 0 == q.SizeUnsafe(), "Expected a closed queue to have no items")
+	q = openQ(t, qName, true)
+	assert(t, q.Size() == q.SizeUnsafe(), "Expected Size %d to match SizeUnsafe %d", q.Size(), q.SizeUnsafe())
+	if err := q.Clear(); err != nil {
+		t.Fatal("Error clearing:", err)
+	}
+	assert(t, 0 == q.SizeUnsafe(), "Expected no items after Clear but got %d", q.SizeUnsafe())
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Raw(t *testing.T) {
+	qName := "testRaw"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	encode := func(item *item2) []byte {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(item); err != nil {
+			t.Fatal("Error encoding:", err)
+		}
+		return buf.Bytes()
+	}
+
+	q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, dque.Options{Compression: dque.CompressionGzip})
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	assert(t, q.EnqueueRaw(nil) != nil, "Expected an empty item to be rejected")
+	raw := encode(&item2{0})
+	if err := q.EnqueueRaw(raw); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	if err := q.Enqueue(&item2{1}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	if err := q.EnqueueRaw(encode(&item2{2})); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+
+	// Raw items come out as they went in, and other items are encoded
+	b, err := q.DequeueRaw()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, bytes.Equal(raw, b), "Expected the bytes given to EnqueueRaw")
+	b, err = q.DequeueRaw()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	var item item2
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&item); err != nil {
+		t.Fatal("Error decoding:", err)
+	}
+	assert(t, 1 == item.Id, "Expected item 1 but got %d", item.Id)
+
+	// Raw items are decoded by the typed methods
+	iface, err := q.Peek()
+	if err != nil {
+		t.Fatal("Error peeking:", err)
+	}
+	assert(t, 2 == iface.(*item2).Id, "Expected item 2 but got %d", iface.(*item2).Id)
+
+	// Bytes that can't be decoded stay at the head until removed raw
+	if err := q.EnqueueRaw([]byte("garbage")); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+	_, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{})
+	assert(t, err != nil, "Expected the garbage to be found when the queue is opened")
+	q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{
+		OnPoison: func(raw []byte, err error) bool { return true },
+	})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	iface, err = q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 2 == iface.(*item2).Id, "Expected item 2 but got %d", iface.(*item2).Id)
+	if err := q.EnqueueRaw([]byte("garbage")); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	_, err = q.Dequeue()
+	assert(t, err != nil, "Expected an error dequeueing bytes that can't be decoded")
+	assert(t, 1 == q.Size(), "Expected the item to stay in the queue but got %d items", q.Size())
+	b, err = q.DequeueRaw()
+	assert(t, err == nil && "garbage" == string(b), "Expected the garbage back but got %q, %v", b, err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_RetainConsumed(t *testing.T) {
+	qName := "testRetainConsumed"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	opts := dque.Options{RetainConsumed: true}
+	q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+
+	// The first segment is kept under a new name
+	_, err = os.Stat(filepath.Join(qName, "0000000000001.dque.done"))
+	assert(t, err == nil, "Expected the consumed segment to be retained: %v", err)
+	_, err = os.Stat(filepath.Join(qName, "0000000000001.dque"))
+	assert(t, os.IsNotExist(err), "Expected the consumed segment to be renamed")
+	q.Close()
+
+	// Retained segments are not loaded again
+	q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 3 == q.Size(), "Expected 3 items but got %d", q.Size())
+	obj, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 4 == obj.(*item2).Id, "Expected item 4 but got %d", obj.(*item2).Id)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Snapshot(t *testing.T) {
+	qName := "testSnapshot"
+	destDir := "testSnapshotDest"
+	for _, dir := range []string{qName, destDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal("Error removing directory:", err)
+		}
+	}
+	if err := os.Mkdir(destDir, 0755); err != nil {
+		t.Fatal("Error creating snapshot directory:", err)
+	}
+
+	q := newQ(t, qName, true)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	if err := q.Snapshot(destDir); err != nil {
+		t.Fatal("Error taking snapshot:", err)
+	}
+	err := q.Snapshot(destDir)
+	assert(t, err != nil, "Expected an error when the snapshot already exists")
+
+	// Changes after the snapshot don't reach the copy
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	q.Close()
+
+	c, err := dque.Open(qName, destDir, 3, item2Builder)
+	if err != nil {
+		t.Fatal("Error opening snapshot:", err)
+	}
+	assert(t, 6 == c.Size(), "Expected 6 items in the snapshot but got %d", c.Size())
+	for i := 1; i < 7; i++ {
+		obj, err := c.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing from snapshot:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	c.Close()
+
+	for _, dir := range []string{qName, destDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal("Error cleaning up directory:", err)
+		}
+	}
+}
+
+func TestQueue_DequeueMatching(t *testing.T) {
+	qName := "testDequeueMatching"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	even := func(obj interface{}) bool { return obj.(*item2).Id%2 == 0 }
+	four := func(obj interface{}) bool { return obj.(*item2).Id == 4 }
+	none := func(obj interface{}) bool { return false }
+
+	// The head matches
+	obj, err := q.DequeueMatching(even, false)
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 0 == obj.(*item2).Id, "Expected item 0 but got %d", obj.(*item2).Id)
+
+	// The head doesn't match and isn't skipped
+	_, err = q.DequeueMatching(even, false)
+	assert(t, dque.ErrNoMatch == err, "Expected ErrNoMatch but got %v", err)
+	assert(t, 6 == q.Size(), "Expected 6 items but got %d", q.Size())
+
+	// Items 1 to 3 are skipped, across a segment boundary
+	obj, err = q.DequeueMatching(four, true)
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 4 == obj.(*item2).Id, "Expected item 4 but got %d", obj.(*item2).Id)
+	assert(t, 2 == q.Size(), "Expected 2 items but got %d", q.Size())
+
+	// Without a match every item is skipped
+	_, err = q.DequeueMatching(none, true)
+	assert(t, dque.ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	assert(t, 0 == q.Size(), "Expected an empty queue but got %d items", q.Size())
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Shutdown(t *testing.T) {
+	qName := "testShutdown"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// A consumer drains the queue until it is closed
+	release := make(chan struct{})
+	done := make(chan []int)
+	go func() {
+		<-release
+		var ids []int
+		for {
+			obj, err := q.DequeueBlock()
+			if err != nil {
+				assert(t, dque.ErrQueueClosed == err, "Expected ErrQueueClosed but got %v", err)
+				done <- ids
+				return
+			}
+			ids = append(ids, obj.(*item2).Id)
+		}
+	}()
+
+	shutdown := make(chan error)
+	go func() { shutdown <- q.Shutdown(context.Background()) }()
+
+	// Wait for Shutdown to start refusing items before the consumer starts
+	n := 5
+	for {
+		if err := q.Enqueue(&item2{n}); err == dque.ErrShuttingDown {
+			break
+		} else if err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		n++
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatal("Error shutting down:", err)
+	}
+	ids := <-done
+	assert(t, n == len(ids), "Expected %d items to be drained but got %v", n, ids)
+	assert(t, q.IsClosed(), "Expected the queue to be closed")
+
+	// Items left when the context is done stay in the queue
+	q = openQ(t, qName, false)
+	if err := q.Enqueue(&item2{n}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := q.Shutdown(ctx)
+	assert(t, context.DeadlineExceeded == err, "Expected DeadlineExceeded but got %v", err)
+	assert(t, q.IsClosed(), "Expected the queue to be closed")
+
+	q = openQ(t, qName, false)
+	assert(t, 1 == q.Size(), "Expected 1 item but got %d", q.Size())
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_MaxSegments(t *testing.T) {
+	qName := "testMaxSegments"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	q.SetMaxSegments(2)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Only the last two segments are kept: items 6 to 8 and item 9
+	stats := q.Stats()
+	assert(t, 2 == stats.SegmentCount, "Expected 2 segments but got %d", stats.SegmentCount)
+	assert(t, 6 == stats.DroppedCount, "Expected 6 dropped items but got %d", stats.DroppedCount)
+	assert(t, 4 == q.Size(), "Expected 4 items but got %d", q.Size())
+	assert(t, 4 == q.SizeUnsafe(), "Expected 4 items but got %d", q.SizeUnsafe())
+	for i := 6; i < 10; i++ {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_EnqueueAt(t *testing.T) {
+	qName := "testEnqueueAt"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	when := time.Now().Add(300 * time.Millisecond)
+	if err := q.EnqueueAt(&item2{0}, when); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	for i := 1; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// The scheduled item is passed over, leaving the others in order
+	obj, err := q.Peek()
+	if err != nil {
+		t.Fatal("Error peeking:", err)
+	}
+	assert(t, 1 == obj.(*item2).Id, "Expected to peek item 1 but got %d", obj.(*item2).Id)
+	for i := 1; i < 5; i++ {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	_, err = q.Dequeue()
+	assert(t, dque.ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	assert(t, 1 == q.Size(), "Expected 1 item but got %d", q.Size())
+
+	// The delivery time is kept on disk
+	q.Close()
+	q = openQ(t, qName, false)
+	_, err = q.Dequeue()
+	assert(t, dque.ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+
+	// A blocked dequeue wakes up when the item is due
+	obj, err = q.DequeueBlockTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 0 == obj.(*item2).Id, "Expected item 0 but got %d", obj.(*item2).Id)
+	assert(t, !time.Now().Before(when), "Expected the item not to be delivered before it was due")
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_OpenSegment(t *testing.T) {
+	qName := "testOpenSegment"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	// Segments can be read while the queue is open
+	numbers, err := dque.SegmentNumbers(qName)
+	if err != nil {
+		t.Fatal("Error listing segments:", err)
+	}
+	assert(t, 2 == len(numbers), "Expected 2 segments but got %v", numbers)
+	seg, err := dque.OpenSegment(qName, numbers[0], item2Builder)
+	if err != nil {
+		t.Fatal("Error opening segment:", err)
+	}
+	assert(t, 1 == seg.Number(), "Expected segment 1 but got %d", seg.Number())
+	assert(t, 1 == seg.TombstoneCount(), "Expected 1 tombstone but got %d", seg.TombstoneCount())
+	assert(t, 2 == seg.LiveCount(), "Expected 2 live items but got %d", seg.LiveCount())
+	objects := seg.Objects()
+	assert(t, 2 == len(objects), "Expected 2 objects but got %d", len(objects))
+	assert(t, 1 == objects[0].(*item2).Id, "Expected item 1 but got %d", objects[0].(*item2).Id)
+
+	// Reading a segment doesn't change it
+	obj, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 1 == obj.(*item2).Id, "Expected item 1 but got %d", obj.(*item2).Id)
+	q.Close()
+
+	_, err = dque.OpenSegment(qName, 9, item2Builder)
+	assert(t, err != nil, "Expected an error opening a missing segment")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_SizeUnsafeWhileClosing(t *testing.T) {
+	qName := "testSizeUnsafeWhileClosing"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// SizeUnsafe can be called from another goroutine while the queue closes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for q.SizeUnsafe() != 0 {
+		}
+	}()
+	q.Close()
+	<-done
+	assert(t, 0 == q.SizeUnsafe(), "Expected a closed queue to have no items")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_PrependOrdered(t *testing.T) {
+	qName := "testPrependOrdered"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	if err := q.PrependOrdered([]interface{}{&item2{1}, &item2{2}, &item2{3}}); err != nil {
+		t.Fatal("Error prepending:", err)
+	}
+	for i := 1; i <= 3; i++ {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	_, err := q.Dequeue()
+	assert(t, dque.ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Verify(t *testing.T) {
+	qName := "testVerify"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, true)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	if err := q.Verify(); err != nil {
+		t.Fatal("Expected a healthy queue but got:", err)
+	}
+
+	// A segment file deleted behind the queue's back is found
+	if err := os.Remove(filepath.Join(qName, "0000000000002.dque")); err != nil {
+		t.Fatal("Error removing segment file:", err)
+	}
+	err := q.Verify()
+	assert(t, err != nil && strings.Contains(err.Error(), "segment 2"), "Expected segment 2 to be missing but got %v", err)
+	q.Close()
+
+	err = q.Verify()
+	assert(t, dque.ErrQueueClosed == err, "Expected ErrQueueClosed but got %v", err)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_BlockingFairness(t *testing.T) {
+	qName := "testBlockingFairness"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+
+	// Consumers start waiting one after another
+	served := make(chan int)
+	for c := 0; c < 5; c++ {
+		go func(c int) {
+			if _, err := q.DequeueBlock(); err != nil {
+				t.Error("Error dequeueing:", err)
+			}
+			served <- c
+		}(c)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Each item goes to the consumer that has waited longest
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		c := <-served
+		assert(t, i == c, "Expected consumer %d to be served but consumer %d was", i, c)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_ReadAhead(t *testing.T) {
+	qName := "testReadAhead"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 30; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.SetReadAhead(3)
+
+	// Drain the first segment so the next ones are read ahead, then
+	// remove an item from one of them
+	for i := 0; i < 3; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	if _, ok, err := q.RemoveWhere(func(obj interface{}) bool { return obj.(*item2).Id == 10 }); err != nil || !ok {
+		t.Fatal("Error removing item 10:", ok, err)
+	}
+
+	for i := 3; i < 30; i++ {
+		if i == 10 {
+			continue
+		}
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	_, err := q.Dequeue()
+	assert(t, dque.ErrEmpty == err, "Expected an empty queue but got %v", err)
+	if err := q.Verify(); err != nil {
+		t.Fatal("Error verifying the queue:", err)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_SyncCount(t *testing.T) {
+	qName := "testSyncCount"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Every change is synced with turbo off
+	assert(t, 2 == q.SyncCount(), "Expected 2 syncs but got %d", q.SyncCount())
+	assert(t, 2 == q.ResetSyncCount(), "Expected ResetSyncCount to return 2")
+	assert(t, 0 == q.SyncCount(), "Expected 0 syncs after a reset but got %d", q.SyncCount())
+
+	// With turbo on, changes are only synced when asked
+	if err := q.TurboOn(); err != nil {
+		t.Fatal("Error turning turbo on:", err)
+	}
+	for i := 2; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 0 == q.SyncCount(), "Expected no syncs in turbo mode but got %d", q.SyncCount())
+	if err := q.TurboSync(); err != nil {
+		t.Fatal("Error syncing:", err)
+	}
+	assert(t, 2 == q.SyncCount(), "Expected a sync of each segment but got %d", q.SyncCount())
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_MultiType(t *testing.T) {
+	qName := "testMultiType"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	builders := map[string]func() interface{}{
+		"item2": item2Builder,
+		"item3": item3Builder,
+	}
+	q, err := dque.NewMultiType(qName, ".", 3, builders)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.EnqueueTyped("item2", &item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+		if err := q.Enqueue(&item3{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Items must match their tag, and types without a builder are refused
+	err = q.EnqueueTyped("item3", &item2{9})
+	assert(t, err != nil && strings.Contains(err.Error(), "*dque_test.item3, not *dque_test.item2"), "Expected an error enqueueing an item2 as item3 but got %v", err)
+	assert(t, q.EnqueueTyped("item4", &item2{9}) != nil, "Expected an error enqueueing with an unknown tag")
+	assert(t, q.Enqueue(&gobSquare{9}) != nil, "Expected an error enqueueing an item without a builder")
+	q.Close()
+
+	// Each item comes back as its own type, in order
+	q, err = dque.OpenMultiType(qName, ".", 3, builders)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item2 %d but got %v", i, obj)
+		obj, err = q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, fmt.Sprint(i) == obj.(*item3).Name, "Expected item3 %d but got %v", i, obj)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_EmptyC(t *testing.T) {
+	qName := "testEmptyC"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+
+	// An empty queue gives a closed channel
+	select {
+	case <-q.EmptyC():
+	default:
+		t.Fatal("Expected the channel of an empty queue to be closed")
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	empty := q.EmptyC()
+	for i := 0; i < 5; i++ {
+		select {
+		case <-empty:
+			t.Fatalf("Expected the channel to stay open with %d items left", 5-i)
+		default:
+		}
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	select {
+	case <-empty:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the channel to be closed once the queue was drained")
+	}
+
+	// A new channel is handed out for the next time
+	if err := q.Enqueue(&item2{5}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	empty = q.EmptyC()
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	select {
+	case <-empty:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the new channel to be closed once the queue was drained")
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_LazyDecode(t *testing.T) {
+	qName := "testLazyDecode"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	opts := dque.Options{LazyDecode: true}
+	q, err := dque.NewWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 8; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Items read back from disk are decoded when they are reached
+	q, err = dque.OpenWithOptions(qName, ".", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	obj, err := q.Peek()
+	if err != nil {
+		t.Fatal("Error peeking:", err)
+	}
+	assert(t, 0 == obj.(*item2).Id, "Expected to peek item 0 but got %d", obj.(*item2).Id)
+
+	// Rewriting a segment keeps the items that were never decoded
+	if _, ok, err := q.RemoveWhere(func(obj interface{}) bool { return obj.(*item2).Id == 1 }); err != nil || !ok {
+		t.Fatal("Error removing item 1:", ok, err)
+	}
+	if err := q.Prepend([]interface{}{&item2{-1}}); err != nil {
+		t.Fatal("Error prepending:", err)
+	}
+	if err := q.Compact(); err != nil {
+		t.Fatal("Error compacting:", err)
+	}
+
+	for _, id := range []int{-1, 0, 2, 3, 4, 5, 6, 7} {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == obj.(*item2).Id, "Expected item %d but got %d", id, obj.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Rename(t *testing.T) {
+	qName := "testRename"
+	newDir := "testRenameDest"
+	for _, dir := range []string{qName, newDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+	}
+	if err := os.Mkdir(newDir, 0755); err != nil {
+		t.Fatal("Error creating destination directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// An open queue can't be moved
+	err := dque.Rename(qName, ".", "renamed", newDir)
+	assert(t, errors.Is(err, dque.ErrQueueLocked), "Expected ErrQueueLocked but got %v", err)
+	q.Close()
+
+	if err := dque.Rename(qName, ".", "renamed", newDir); err != nil {
+		t.Fatal("Error renaming the queue:", err)
+	}
+	_, err = os.Stat(qName)
+	assert(t, os.IsNotExist(err), "Expected the old queue directory to be gone but got %v", err)
+
+	// Nothing is moved over an existing queue or from something that isn't one
+	assert(t, dque.Rename("renamed", newDir, "renamed", newDir) != nil, "Expected an error renaming onto an existing queue")
+	assert(t, dque.Rename(qName, ".", "other", newDir) != nil, "Expected an error renaming a missing queue")
+
+	q, err = dque.Open("renamed", newDir, 3, item2Builder)
+	if err != nil {
+		t.Fatal("Error opening the renamed queue:", err)
+	}
+	assert(t, 4 == q.Size(), "Expected 4 items but got %d", q.Size())
+	q.Close()
+
+	if err := os.RemoveAll(newDir); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_DequeueAll(t *testing.T) {
+	qName := "testDequeueAll"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	objects, err := q.DequeueAll()
+	if err != nil {
+		t.Fatal("Error dequeueing from an empty queue:", err)
+	}
+	assert(t, 0 == len(objects), "Expected no items but got %d", len(objects))
+
+	// Spread the items over first, middle, and last segments
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	obs := &countingObserver{}
+	q.SetObserver(obs)
+
+	objects, err = q.DequeueAll()
+	if err != nil {
+		t.Fatal("Error dequeueing everything:", err)
+	}
+	assert(t, 9 == len(objects), "Expected 9 items but got %d", len(objects))
+	assert(t, 9 == obs.dequeues, "Expected 9 dequeues to be observed but got %d", obs.dequeues)
+	assert(t, 0 == obs.lastSize, "Expected an observed size of 0 but got %d", obs.lastSize)
+	q.SetObserver(nil)
+	for i, obj := range objects {
+		assert(t, i+1 == obj.(*item2).Id, "Expected item %d but got %d", i+1, obj.(*item2).Id)
+	}
+	assert(t, 0 == q.Size(), "Expected an empty queue but got %d items", q.Size())
+	first, last := q.SegmentNumbers()
+	assert(t, first == last, "Expected a single segment but got %d to %d", first, last)
+
+	// The queue carries on as normal
+	if err := q.Enqueue(&item2{10}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	obj, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 10 == obj.(*item2).Id, "Expected item 10 but got %d", obj.(*item2).Id)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_FallibleBuilder(t *testing.T) {
+	qName := "testFallibleBuilder"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	errNoResource := errors.New("no resource")
+	var failing bool
+	builder := func() (interface{}, error) {
+		if failing {
+			return nil, errNoResource
+		}
+		return &item2{}, nil
+	}
+
+	q, err := dque.NewOrOpenFallible(qName, ".", 3, builder)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// A builder that fails fails the load, with its error
+	failing = true
+	_, err = dque.NewOrOpenFallible(qName, ".", 3, builder)
+	assert(t, errors.Is(err, errNoResource), "Expected the builder's error but got %v", err)
+
+	failing = false
+	q, err = dque.NewOrOpenFallible(qName, ".", 3, builder)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	obj, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 0 == obj.(*item2).Id, "Expected item 0 but got %d", obj.(*item2).Id)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_OpenWriteOnly(t *testing.T) {
+	qName := "testOpenWriteOnly"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Only the builder check builds an item; nothing on disk is decoded
+	var built int
+	builder := func() interface{} {
+		built++
+		return &item2{}
+	}
+	q, err := dque.OpenWriteOnly(qName, ".", 3, builder)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 1 == built, "Expected 1 item to be built but got %d", built)
+	assert(t, 5 == q.Size(), "Expected 5 items but got %d", q.Size())
+
+	if err := q.Enqueue(&item2{5}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	_, err = q.Dequeue()
+	assert(t, dque.ErrWriteOnly == err, "Expected ErrWriteOnly but got %v", err)
+	_, err = q.Peek()
+	assert(t, dque.ErrWriteOnly == err, "Expected ErrWriteOnly but got %v", err)
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for i := 0; i < 6; i++ {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_ItemsPerSegment(t *testing.T) {
+	qName := "testItemsPerSegment"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// A queue can't be made with no room in its segments
+	for _, n := range []int{0, -1} {
+		_, err := dque.New(qName, ".", n, item2Builder)
+		assert(t, err != nil, "Expected an error creating a queue with %d items per segment", n)
+		_, err = dque.NewOrOpen(qName, ".", n, item2Builder)
+		assert(t, err != nil, "Expected an error creating or opening a queue with %d items per segment", n)
+	}
+	_, err := os.Stat(qName)
+	assert(t, os.IsNotExist(err), "Expected no queue directory but got %v", err)
+
+	q := newQ(t, qName, false)
+	q.Close()
+	_, err = dque.Open(qName, ".", 0, item2Builder)
+	assert(t, err != nil, "Expected an error opening a queue with 0 items per segment")
+	_, err = dque.OpenReadOnly(qName, ".", 0, item2Builder)
+	assert(t, err != nil, "Expected an error opening a queue read-only with 0 items per segment")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_OnSegmentComplete(t *testing.T) {
+	qName := "testOnSegmentComplete"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	var numbers []int
+	q.OnSegmentComplete(func(path string, number int) {
+		// The queue's locks are released, so the queue can be used
+		assert(t, q.Size() == 3*number+1, "Expected %d items but got %d", 3*number+1, q.Size())
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal("Expected the completed segment file to exist:", err)
+		}
+		numbers = append(numbers, number)
+	})
+
+	// Segments hold 3 items, so the 4th and 7th items start new segments
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, len(numbers) == 2 && numbers[0] == 1 && numbers[1] == 2, "Expected segments 1 and 2 to be complete but got %v", numbers)
+
+	q.OnSegmentComplete(nil)
+	for i := 7; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, len(numbers) == 2, "Expected no more segments to be reported but got %v", numbers)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_CheckpointEvery(t *testing.T) {
+	qName := "testCheckpointEvery"
+	crashName := "testCheckpointEveryCrash"
+	for _, name := range []string{qName, crashName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+	}
+
+	opts := dque.Options{CheckpointEvery: 3}
+	q, err := dque.NewWithOptions(qName, ".", 10, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Only every third dequeue writes to the file
+	file := filepath.Join(qName, "0000000000001.dque")
+	size := fileSize(t, file)
+	for i := 0; i < 4; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		want := size
+		if i >= 2 {
+			want += 8
+		}
+		assert(t, fileSize(t, file) == want, "Expected the file to be %d bytes after %d dequeues but it is %d", want, i+1, fileSize(t, file))
+	}
+
+	// A crash now would lose the fourth dequeue, so its item comes back
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("Error reading segment file:", err)
+	}
+	if err := os.Mkdir(crashName, 0755); err != nil {
+		t.Fatal("Error creating queue directory:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(crashName, "0000000000001.dque"), data, 0644); err != nil {
+		t.Fatal("Error writing segment file:", err)
+	}
+	crashed, err := dque.OpenWithOptions(crashName, ".", 10, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening the crashed queue:", err)
+	}
+	assert(t, 7 == crashed.Size(), "Expected 7 items after the crash but got %d", crashed.Size())
+	iface, err := crashed.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 3 == iface.(*item2).Id, "Expected item 3 but got %d", iface.(*item2).Id)
+	crashed.Close()
+
+	// Closing the queue records every dequeue, and the checkpoints are
+	// read without the option too
+	q.Close()
+	q, err = dque.Open(qName, ".", 10, item2Builder)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 6 == q.Size(), "Expected 6 items but got %d", q.Size())
+	for i := 4; i < 10; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	q.Close()
+
+	for _, name := range []string{qName, crashName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error cleaning up the queue directory:", err)
+		}
+	}
+}
+
+func TestQueue_Segments(t *testing.T) {
+	qName := "testSegments"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Segments 1 and 2 are full and segment 3 holds items 6 and 7
+	q := newQ(t, qName, false)
+	for i := 0; i < 8; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	infos := q.Segments()
+	assert(t, 3 == len(infos), "Expected 3 segments but got %d", len(infos))
+	want := []struct{ live, tombstones int }{{2, 1}, {3, 0}, {2, 0}}
+	for i, info := range infos {
+		assert(t, i+1 == info.Number, "Expected segment %d but got %d", i+1, info.Number)
+		assert(t, info.Err == nil, "Expected no error for segment %d but got %v", info.Number, info.Err)
+		assert(t, want[i].live == info.Live, "Expected %d items in segment %d but got %d", want[i].live, info.Number, info.Live)
+		assert(t, want[i].tombstones == info.Tombstones, "Expected %d tombstones in segment %d but got %d", want[i].tombstones, info.Number, info.Tombstones)
+		assert(t, fileSize(t, info.Path) == info.Bytes, "Expected segment %d to be %d bytes but got %d", info.Number, fileSize(t, info.Path), info.Bytes)
+	}
+	q.Close()
+
+	assert(t, q.Segments() == nil, "Expected no segments for a closed queue")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_NamePaths(t *testing.T) {
+	qName := "testNamePaths"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	for _, name := range []string{"a/b", `a\b`, "../" + qName, ".", ".."} {
+		if _, err := dque.New(name, ".", 3, item2Builder); err == nil {
+			t.Fatalf("Expected an error creating a queue named %q", name)
+		}
+	}
+
+	// The queue keeps working after the working directory changes
+	q := newQ(t, qName, false)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal("Error getting the working directory:", err)
+	}
+	tmp, err := ioutil.TempDir("", "dque")
+	if err != nil {
+		t.Fatal("Error creating a temporary directory:", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal("Error changing the working directory:", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			os.Chdir(wd)
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			os.Chdir(wd)
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	q.Close()
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal("Error changing the working directory back:", err)
+	}
+
+	_, err = os.Stat(filepath.Join(tmp, qName))
+	assert(t, os.IsNotExist(err), "Expected no queue files under the new working directory")
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_TrimTail(t *testing.T) {
+	qName := "testTrimTail"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// Segments 1 to 3 are full and segment 4 holds item 9
+	q := newQ(t, qName, false)
+	for i := 0; i < 10; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	// Trimming 3 items empties segment 4 and goes back into segment 3
+	n, err := q.TrimTail(3)
+	if err != nil {
+		t.Fatal("Error trimming:", err)
+	}
+	assert(t, 3 == n, "Expected 3 items trimmed but got %d", n)
+	assert(t, 6 == q.Size(), "Expected 6 items but got %d", q.Size())
+	firstSegNum, lastSegNum := q.SegmentNumbers()
+	assert(t, 1 == firstSegNum && 3 == lastSegNum, "Expected segments 1 and 3 but got %d and %d", firstSegNum, lastSegNum)
+
+	// Trimmed segment 3 takes the next item
+	if err := q.Enqueue(&item2{10}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+
+	q = openQ(t, qName, false)
+	for _, id := range []int{1, 2, 3, 4, 5, 6, 10} {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == iface.(*item2).Id, "Expected item %d but got %d", id, iface.(*item2).Id)
+	}
+
+	// The first segment is trimmed but never deleted
+	for i := 11; i < 13; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	n, err = q.TrimTail(5)
+	if err != nil {
+		t.Fatal("Error trimming:", err)
+	}
+	assert(t, 2 == n, "Expected 2 items trimmed but got %d", n)
+	assert(t, 0 == q.Size(), "Expected an empty queue but got %d items", q.Size())
+	if err := q.Enqueue(&item2{13}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	iface, err := q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 13 == iface.(*item2).Id, "Expected item 13 but got %d", iface.(*item2).Id)
+	q.Close()
+
+	if _, err := q.TrimTail(1); !errors.Is(err, dque.ErrQueueClosed) {
+		t.Fatal("Expected ErrQueueClosed but got", err)
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_ExportImport(t *testing.T) {
+	qName := "testExport"
+	importName := "testImport"
+	for _, name := range []string{qName, importName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error removing queue directory:", err)
+		}
+	}
+
+	// The items span three segments
+	q := newQ(t, qName, false)
+	for i := 0; i < 8; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	var buf bytes.Buffer
+	if err := q.Export(&buf); err != nil {
+		t.Fatal("Error exporting:", err)
+	}
+	assert(t, 7 == q.Size(), "Expected the export to leave 7 items but got %d", q.Size())
+
+	var exported []item2
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatal("Error reading the exported JSON:", err)
+	}
+	assert(t, 7 == len(exported) && 1 == exported[0].Id && 7 == exported[6].Id, "Unexpected exported items %v", exported)
+
+	// The items are enqueued to a queue with another format
+	imported, err := dque.NewWithOptions(importName, ".", 5, item2Builder, dque.Options{Compression: dque.CompressionGzip})
+	if err != nil {
+		t.Fatal("Error creating new dque:", err)
+	}
+	if err := imported.Import(&buf); err != nil {
+		t.Fatal("Error importing:", err)
+	}
+	assert(t, 7 == imported.Size(), "Expected 7 imported items but got %d", imported.Size())
+	for i := 1; i < 8; i++ {
+		iface, err := imported.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+
+	// An empty queue exports an empty array
+	buf.Reset()
+	if err := imported.Export(&buf); err != nil {
+		t.Fatal("Error exporting:", err)
+	}
+	assert(t, "[]" == strings.TrimSpace(buf.String()), "Expected an empty array but got %s", buf.String())
+
+	if err := imported.Import(strings.NewReader(`[{"Id": 1}, "oops"]`)); err == nil {
+		t.Fatal("Expected an error importing an item that isn't an object")
+	}
+	assert(t, 1 == imported.Size(), "Expected the item before the bad one to be imported but got %d items", imported.Size())
+
+	q.Close()
+	imported.Close()
+	for _, name := range []string{qName, importName} {
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal("Error cleaning up the queue directory:", err)
+		}
+	}
+}
+
+func TestQueue_Contains(t *testing.T) {
+	qName := "testContains"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	// The items span three segments
+	q := newQ(t, qName, false)
+	for i := 0; i < 8; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	for id, want := range map[int]bool{0: false, 1: true, 4: true, 7: true, 8: false} {
+		id := id
+		found, err := q.Contains(func(obj interface{}) bool { return obj.(*item2).Id == id })
+		if err != nil {
+			t.Fatal("Error searching:", err)
+		}
+		assert(t, want == found, "Expected Contains to return %v for item %d", want, id)
+	}
+	assert(t, 7 == q.Size(), "Expected the search to leave 7 items but got %d", q.Size())
+	q.Close()
+
+	if _, err := q.Contains(func(obj interface{}) bool { return true }); !errors.Is(err, dque.ErrQueueClosed) {
+		t.Fatal("Expected ErrQueueClosed but got", err)
+	}
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_DequeueWithMeta(t *testing.T) {
+	qName := "testDequeueWithMeta"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Item 3 starts the second segment
+	for i := 0; i < 5; i++ {
+		obj, meta, err := q.DequeueWithMeta()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+		assert(t, i/3+1 == meta.Segment, "Expected item %d to be in segment %d but got %d", i, i/3+1, meta.Segment)
+		assert(t, i%3 == meta.Position, "Expected item %d at position %d but got %d", i, i%3, meta.Position)
+		assert(t, fmt.Sprintf("%013d.dque", meta.Segment) == filepath.Base(meta.Path), "Unexpected path %s", meta.Path)
+	}
+
+	// Item 7 is found past items 5 and 6, which aren't due.  Item 5 ends
+	// the second segment and item 6 starts the third.
+	for i := 5; i < 7; i++ {
+		if err := q.EnqueueAt(&item2{i}, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if err := q.Enqueue(&item2{7}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	obj, meta, err := q.DequeueWithMeta()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 7 == obj.(*item2).Id, "Expected item 7 but got %d", obj.(*item2).Id)
+	assert(t, 3 == meta.Segment && 1 == meta.Position, "Expected item 7 at position 1 of segment 3 but got %+v", meta)
+
+	_, _, err = q.DequeueWithMeta()
+	assert(t, errors.Is(err, dque.ErrEmpty), "Expected ErrEmpty but got %v", err)
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+func TestQueue_Partitioned(t *testing.T) {
+	qName := "testPartitioned"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory", err)
+	}
+	defer os.RemoveAll(qName)
+
+	keyFn := func(obj interface{}) string {
+		if obj.(*item2).Id%2 == 0 {
+			return ""
+		}
+		return "Odd/../x"
+	}
+	p, err := dque.NewPartitioned(qName, ".", 3, item2Builder, keyFn)
+	assert(t, err == nil, "Error creating partitioned queue", err)
+	for i := 0; i < 10; i++ {
+		assert(t, p.Enqueue(&item2{i}) == nil, "Error enqueueing", i)
+	}
+	assert(t, strings.Join(p.Partitions(), ",") == ",Odd/../x", "Unexpected partitions", p.Partitions())
+	_, err = os.Stat(filepath.Join(qName, "p-%4Fdd%2F%2E%2E%2Fx"))
+	assert(t, err == nil, "Expected the escaped partition directory", err)
+
+	// Each partition is FIFO
+	for i := 1; i < 5; i += 2 {
+		item, err := p.DequeuePartition("Odd/../x")
+		assert(t, err == nil, "Error dequeueing", err)
+		assert(t, item.(*item2).Id == i, "Expected item", i, "but got", item)
+	}
+	_, err = p.DequeuePartition("missing")
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty for a missing partition", err)
+	assert(t, p.Close() == nil, "Error closing partitioned queue")
+	assert(t, p.Enqueue(&item2{0}) == dque.ErrQueueClosed, "Expected ErrQueueClosed after Close")
+
+	// Reopening finds the partitions and what is left in them
+	p, err = dque.NewPartitioned(qName, ".", 3, item2Builder, keyFn)
+	assert(t, err == nil, "Error reopening partitioned queue", err)
+	defer p.Close()
+	assert(t, len(p.Partitions()) == 2, "Expected the partitions to be reopened", p.Partitions())
+	item, err := p.DequeuePartition("")
+	assert(t, err == nil && item.(*item2).Id == 0, "Expected item 0", item, err)
+	item, err = p.DequeuePartition("Odd/../x")
+	assert(t, err == nil && item.(*item2).Id == 5, "Expected item 5", item, err)
+}
+
+func TestQueue_EmptyVersusClosed(t *testing.T) {
+	qName := "testEmptyVersusClosed"
+	q := newQ(t, qName, false)
+	defer os.RemoveAll(qName)
+
+	// Every non-blocking way to take or look at the first item, so each can
+	// be checked in both states
+	reads := map[string]func() error{
+		"Dequeue": func() error { _, err := q.Dequeue(); return err },
+		"DequeueContext": func() error {
+			_, err := q.DequeueContext(context.Background())
+			return err
+		},
+		"DequeueWithMeta": func() error { _, _, err := q.DequeueWithMeta(); return err },
+		"DequeueMatching": func() error {
+			_, err := q.DequeueMatching(func(interface{}) bool { return true }, true)
+			return err
+		},
+		"Peek":          func() error { _, err := q.Peek(); return err },
+		"PeekAvailable": func() error { _, _, err := q.PeekAvailable(); return err },
+	}
+
+	for name, read := range reads {
+		err := read()
+		assert(t, errors.Is(err, dque.ErrEmpty) && !errors.Is(err, dque.ErrQueueClosed), name, "of an empty queue should return ErrEmpty but got", err)
+	}
+
+	assert(t, q.Close() == nil, "Error closing queue")
+	for name, read := range reads {
+		err := read()
+		assert(t, errors.Is(err, dque.ErrQueueClosed) && !errors.Is(err, dque.ErrEmpty), name, "of a closed queue should return ErrQueueClosed but got", err)
+	}
+}
+
+func TestQueue_MalformedSegmentNames(t *testing.T) {
+	qName := "testMalformedSegmentNames"
+	q := newQ(t, qName, false)
+	defer os.RemoveAll(qName)
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Numbers too large for a segment, and names that aren't segments at all
+	bad := []string{"99999999999999999999.dque", "9223372036854775807.dque", "-1.dque", "1.dque.tmp", "x1.dque"}
+	for _, name := range bad {
+		if err := ioutil.WriteFile(filepath.Join(qName, name), []byte("junk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := &recordingLogger{}
+	q, err := dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{Logger: logger})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	defer q.Close()
+	assert(t, 2 == len(logger.messages), "Expected 2 messages but got %q", logger.messages)
+	for _, msg := range logger.messages {
+		assert(t, strings.Contains(msg, "out of range"), "Expected an out of range message but got %q", msg)
+	}
+	for i := 0; i < 4; i++ {
+		obj, err := q.Dequeue()
+		assert(t, err == nil && i == obj.(*item2).Id, "Expected item %d but got %v, %v", i, obj, err)
+	}
+}
+
+func TestQueue_LastSegmentNumber(t *testing.T) {
+	if strconv.IntSize != 64 {
+		t.Skip("the largest segment number depends on the size of an int")
+	}
+	qName := "testLastSegmentNumber"
+	q := newQ(t, qName, false)
+	defer os.RemoveAll(qName)
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Give the full segment the largest number a segment can have
+	last := filepath.Join(qName, "9223372036854775806.dque")
+	if err := os.Rename(filepath.Join(qName, "0000000000001.dque"), last); err != nil {
+		t.Fatal(err)
+	}
+	q = openQ(t, qName, false)
+	defer q.Close()
+
+	// No segment is created past it
+	err := q.Enqueue(&item2{3})
+	assert(t, err != nil, "Expected an error enqueueing past the largest segment number")
+	assert(t, 3 == q.Size(), "Expected 3 items but got %d", q.Size())
+	obj, err := q.Dequeue()
+	assert(t, err == nil && 0 == obj.(*item2).Id, "Expected item 0 but got %v, %v", obj, err)
+}
+
+// countingObserver records every event reported by a queue
+type countingObserver struct {
+	enqueues, dequeues, creates, deletes, syncs, decodeErrors int
+	lastSize                                                  int
+}
+
+func (o *countingObserver) OnEnqueue(size int)      { o.enqueues++; o.lastSize = size }
+func (o *countingObserver) OnDequeue(size int)      { o.dequeues++; o.lastSize = size }
+func (o *countingObserver) OnSegmentCreate(num int) { o.creates++ }
+func (o *countingObserver) OnSegmentDelete(num int) { o.deletes++ }
+func (o *countingObserver) OnSync()                 { o.syncs++ }
+func (o *countingObserver) OnDecodeError(err error) { o.decodeErrors++ }
+
+func TestQueue_Observer(t *testing.T) {
+	qName := "testObserver"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	obs := &countingObserver{}
+	q.SetObserver(obs)
+
+	// Fill two segments and start a third
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 7 == obs.enqueues, "Expected 7 enqueues but got %d", obs.enqueues)
+	assert(t, 7 == obs.lastSize, "Expected a size of 7 but got %d", obs.lastSize)
+	assert(t, 2 == obs.creates, "Expected 2 segment creations but got %d", obs.creates)
+	assert(t, 7 == obs.syncs, "Expected 7 syncs but got %d", obs.syncs)
+
+	// Empty the first segment
+	for i := 0; i < 3; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	assert(t, 3 == obs.dequeues, "Expected 3 dequeues but got %d", obs.dequeues)
+	assert(t, 4 == obs.lastSize, "Expected a size of 4 but got %d", obs.lastSize)
+	assert(t, 1 == obs.deletes, "Expected 1 segment deletion but got %d", obs.deletes)
+	assert(t, 10 == obs.syncs, "Expected 10 syncs but got %d", obs.syncs)
+
+	// Nothing is reported once the observer is removed
+	q.SetObserver(nil)
+	if err := q.Enqueue(&item2{7}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	assert(t, 7 == obs.enqueues, "Expected no more enqueues but got %d", obs.enqueues)
+	q.Close()
+
+	// Decode errors while opening are reported through Options
+	q, err := dque.OpenWithOptions(qName, ".", 3, func() interface{} { return new(int) }, dque.Options{Observer: obs})
+	assert(t, err != nil, "Expected opening with the wrong builder to fail")
+	assert(t, q == nil, "Expected no queue")
+	assert(t, 1 == obs.decodeErrors, "Expected 1 decode error but got %d", obs.decodeErrors)
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
+// itemObserver also records the sizes of items and how long they took to decode
+type itemObserver struct {
+	countingObserver
+	encoded, decoded []int
+	decodeTime       time.Duration
+}
+
+func (o *itemObserver) OnItemEncoded(bytes int) { o.encoded = append(o.encoded, bytes) }
+func (o *itemObserver) OnItemDecoded(bytes int, dur time.Duration) {
+	o.decoded = append(o.decoded, bytes)
+	o.decodeTime += dur
+}
+
+func TestQueue_ItemObserver(t *testing.T) {
+	qName := "testItemObserver"
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error removing queue directory:", err)
+	}
+
+	q := newQ(t, qName, false)
+	obs := &itemObserver{}
+	q.SetObserver(obs)
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 4 == len(obs.encoded), "Expected 4 encoded items but got %d", len(obs.encoded))
+	assert(t, obs.encoded[0] > 0, "Expected a positive size but got %d", obs.encoded[0])
+	q.Close()
+
+	// Items are decoded as their segments are loaded
+	q, err := dque.OpenWithOptions(qName, ".", 3, item2Builder, dque.Options{Observer: obs})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 4 == len(obs.decoded), "Expected 4 decoded items but got %d", len(obs.decoded))
+	for i := range obs.decoded {
+		assert(t, obs.encoded[i] == obs.decoded[i], "Expected item %d to be decoded from %d bytes but got %d", i, obs.encoded[i], obs.decoded[i])
+	}
+	q.Close()
+
+	if err := os.RemoveAll(qName); err != nil {
+		t.Fatal("Error cleaning up the queue directory:", err)
+	}
+}
+
 func newOrOpenQ(t *testing.T, qName string, turbo bool) *dque.DQue {
 	// Create a new segment with segment size of 3
 	q, err := dque.NewOrOpen(qName, ".", 3, item2Builder)
@@ -0,0 +1,88 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is the time constant of the moving averages returned by
+// Rates.  An item counts for about a third as much after a window as it
+// did when it was enqueued or dequeued.
+const rateWindow = time.Minute
+
+// rateSampler turns the counts of enqueued and dequeued items into moving
+// averages.  The counts are kept by DQue so updating them is a single
+// atomic add; the averages are only worked out when they are read.
+type rateSampler struct {
+	mutex              sync.Mutex
+	last               time.Time // when the averages were last brought up to date, zero once closed
+	enqueues, dequeues int64     // the counts at that time
+	enqueueRate        float64
+	dequeueRate        float64
+	primed             bool // the averages hold at least one sample
+}
+
+// Rates returns the number of items enqueued and dequeued per second,
+// averaged over about the last minute with recent activity counting for
+// more.  Until a minute has passed since the queue was opened, the rates
+// lean towards those since it was opened.  Rates are worked out when
+// Rates is called, so keeping them costs next to nothing.  Zeros are
+// returned once the queue is closed, and opening it again starts afresh.
+func (q *DQue) Rates() (enqueuePerSec, dequeuePerSec float64) {
+	r := &q.rates
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.last.IsZero() {
+		return 0, 0
+	}
+	now := q.config.now()
+	elapsed := now.Sub(r.last).Seconds()
+	if elapsed <= 0 {
+		return r.enqueueRate, r.dequeueRate
+	}
+
+	enqueues := atomic.LoadInt64(&q.enqueues)
+	dequeues := atomic.LoadInt64(&q.dequeues)
+	enqueueRate := float64(enqueues-r.enqueues) / elapsed
+	dequeueRate := float64(dequeues-r.dequeues) / elapsed
+	if r.primed {
+		alpha := 1 - math.Exp(-elapsed/rateWindow.Seconds())
+		enqueueRate = r.enqueueRate + alpha*(enqueueRate-r.enqueueRate)
+		dequeueRate = r.dequeueRate + alpha*(dequeueRate-r.dequeueRate)
+	}
+
+	r.last = now
+	r.enqueues, r.dequeues = enqueues, dequeues
+	r.enqueueRate, r.dequeueRate = enqueueRate, dequeueRate
+	r.primed = true
+	return enqueueRate, dequeueRate
+}
+
+// start begins sampling at the given time.
+func (r *rateSampler) start(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.last = now
+	r.enqueues, r.dequeues = 0, 0
+	r.enqueueRate, r.dequeueRate = 0, 0
+	r.primed = false
+}
+
+// stop makes Rates return zeros.
+func (r *rateSampler) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.last = time.Time{}
+	r.enqueueRate, r.dequeueRate = 0, 0
+}
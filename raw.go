@@ -0,0 +1,58 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"github.com/pkg/errors"
+)
+
+// rawItem is the in-memory form of an item enqueued with EnqueueRaw.  It is
+// kept encoded until it is dequeued, so bytes passed from EnqueueRaw to
+// DequeueRaw are never decoded.
+type rawItem struct {
+	data []byte
+}
+
+// EnqueueRaw adds an item that is already encoded to the end of the queue.
+// The bytes are stored as they are, compressed and encrypted if the queue
+// is, without going through the queue's codec.  For a queue using CodecGob
+// they must be the output of a gob.Encoder that encoded a single item of the
+// type returned by the builder; they are only decoded when a method such as
+// Dequeue or Peek hands the item over as an object, and an error is returned
+// then if they can't be.  DequeueRaw can always remove such an item.  The
+// slice must not be modified after it is enqueued.
+func (q *DQue) EnqueueRaw(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("DQue.EnqueueRaw() can't add an empty item")
+	}
+	added, err := q.enqueue(&rawItem{data: data})
+	if added {
+		// Wakeup any goroutine that is currently waiting for an item to be enqueued
+		q.signalNotEmpty()
+
+		q.observeEnqueue()
+	}
+	return err
+}
+
+// DequeueRaw removes the first item in the queue and returns it encoded by
+// the queue's codec, without compression or encryption.  Items enqueued with
+// EnqueueRaw are returned as they were given, and other items, including
+// every item read back from disk when the queue is opened, are encoded
+// again.
+// When the queue is empty, nil and dque.ErrEmpty are returned.
+func (q *DQue) DequeueRaw() ([]byte, error) {
+	q.mutex.Lock()
+	obj, err := q.dequeueAsLocked(byObject((*qSegment).raw))
+	q.mutex.Unlock()
+
+	data, _ := obj.([]byte)
+	if obj != nil {
+		q.observeDequeue()
+	}
+	return data, err
+}
@@ -0,0 +1,164 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// readAhead holds segments between the first and the last that were read
+// from disk in the background, so moving on to the next segment doesn't
+// wait for it to be loaded.  Cached segments hold no open file.
+type readAhead struct {
+	mutex   sync.Mutex
+	n       int // how many segments past the first to load
+	gen     int // changed whenever cached segments may be out of date
+	segs    map[int]*readAheadSegment
+	loading bool
+	wg      sync.WaitGroup
+}
+
+// readAheadSegment is a segment loaded in the background, or the error
+// loading it.
+type readAheadSegment struct {
+	seg *qSegment
+	err error
+}
+
+// SetReadAhead makes the queue load the n segments after the first one in
+// a background goroutine, so that once the first segment has been dequeued
+// the next one is already in memory.  It helps when segments are large or
+// the disk is slow.  Each preloaded segment costs the memory of its items,
+// but no file handle.  Zero, the default, turns read-ahead off.  The
+// setting is not recorded, so set it every time the queue is opened.
+func (q *DQue) SetReadAhead(n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	q.readAhead.mutex.Lock()
+	q.readAhead.n = n
+	q.readAhead.mutex.Unlock()
+
+	if q.fileLock != nil {
+		q.startReadAhead()
+	}
+}
+
+// startReadAhead loads the segments that should be preloaded and aren't in
+// the background.  The head lock must be held.
+func (q *DQue) startReadAhead() {
+	ra := &q.readAhead
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+
+	// Forget segments that are no longer ahead of the first one
+	for num := range ra.segs {
+		if num <= q.firstSegment.number || num > q.firstSegment.number+ra.n {
+			delete(ra.segs, num)
+		}
+	}
+	if ra.n == 0 || ra.loading {
+		return
+	}
+
+	// Only segments between the first and the last are read from disk
+	var numbers []int
+	for num := q.firstSegment.number + 1; num <= q.firstSegment.number+ra.n && num < q.lastSegment.number; num++ {
+		if _, ok := ra.segs[num]; !ok {
+			numbers = append(numbers, num)
+		}
+	}
+	if len(numbers) == 0 {
+		return
+	}
+
+	ra.loading = true
+	ra.wg.Add(1)
+	go q.loadAhead(numbers, ra.gen)
+}
+
+// loadAhead reads the numbered segments into the cache.  Segments loaded
+// after the cache was invalidated are thrown away.
+func (q *DQue) loadAhead(numbers []int, gen int) {
+	ra := &q.readAhead
+	defer ra.wg.Done()
+
+	for _, num := range numbers {
+		seg := &qSegment{dirPath: q.fullPath, number: num, objectBuilder: q.builder, cfg: &q.config}
+		if fileSize(q.config.fs(), seg.filePath()) == 0 {
+			// Leave giving the file its header to openQueueSegment
+			break
+		}
+		err := seg.load()
+
+		ra.mutex.Lock()
+		if ra.gen != gen {
+			ra.mutex.Unlock()
+			break
+		}
+		if ra.segs == nil {
+			ra.segs = make(map[int]*readAheadSegment)
+		}
+		ra.segs[num] = &readAheadSegment{seg: seg, err: err}
+		ra.mutex.Unlock()
+	}
+
+	ra.mutex.Lock()
+	ra.loading = false
+	ra.mutex.Unlock()
+}
+
+// takeReadAhead returns the numbered segment from the cache, opened as
+// openQueueSegment would, or nil if it isn't there.  The head lock must be
+// held.
+func (q *DQue) takeReadAhead(num int) (*qSegment, error) {
+	ra := &q.readAhead
+	ra.mutex.Lock()
+	cached, ok := ra.segs[num]
+	delete(ra.segs, num)
+	ra.mutex.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	if cached.err != nil {
+		return nil, errors.Wrap(cached.err, "unable to load queue segment in "+q.fullPath)
+	}
+
+	seg := cached.seg
+	seg.turbo = q.turbo
+	flag := os.O_APPEND | os.O_WRONLY
+	if q.config.readOnly {
+		flag = os.O_RDONLY
+	}
+	var err error
+	seg.file, err = q.config.openSegmentFile(seg.filePath(), flag, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening file: "+seg.filePath())
+	}
+	if err := seg.skipPoison(); err != nil {
+		seg.file.Close()
+		return nil, errors.Wrap(err, "unable to load queue segment in "+q.fullPath)
+	}
+	return seg, nil
+}
+
+// invalidateReadAhead empties the cache.  It is called whenever a segment
+// between the first and the last is rewritten or deleted.  A load already
+// under way is thrown away when it finishes.
+func (q *DQue) invalidateReadAhead() {
+	ra := &q.readAhead
+	ra.mutex.Lock()
+	ra.gen++
+	ra.segs = nil
+	ra.mutex.Unlock()
+}
@@ -0,0 +1,67 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"log"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// Rename moves the named queue in oldDir to newName in newDir, where it can
+// be opened with Open.  The source must hold segment files with the default
+// naming, newDir must exist, and nothing may already be at the destination.
+// The queue must not be open; ErrQueueLocked is returned if it is.  The
+// directory is moved with a single rename, so both directories must be on
+// the same filesystem.
+func Rename(oldName, oldDir, newName, newDir string) error {
+	if err := checkName(oldName); err != nil {
+		return err
+	}
+	if err := checkName(newName); err != nil {
+		return err
+	}
+
+	fs := osStorage{}
+	oldPath := path.Join(oldDir, oldName)
+	newPath := path.Join(newDir, newName)
+	if !dirExists(fs, oldPath) {
+		return errors.New("the given queue does not exist (" + oldPath + ")")
+	}
+	if !dirExists(fs, newDir) {
+		return errors.New("the given queue directory is not valid: " + newDir)
+	}
+	if _, err := fs.Stat(newPath); err == nil {
+		return errors.New("the rename destination already exists (" + newPath + ")")
+	}
+
+	fileLock, err := acquireLock(fs, oldPath)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Close()
+
+	numbers, err := listSegmentNumbers(fs, oldPath, filePattern, log.Printf)
+	if err != nil {
+		return err
+	}
+	if len(numbers) == 0 {
+		return errors.New("the queue has no segment files (" + oldPath + ")")
+	}
+
+	if err := fs.Rename(oldPath, newPath); err != nil {
+		return errors.Wrap(err, "error renaming queue directory "+oldPath)
+	}
+	if err := syncDir(fs, newDir); err != nil {
+		return err
+	}
+	if path.Clean(oldDir) != path.Clean(newDir) {
+		return syncDir(fs, oldDir)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// RepairReport summarizes what Repair found and changed.
+type RepairReport struct {
+	FilesScanned     int   // segment files read
+	RecordsRecovered int   // items still in the queue after the repair
+	RecordsDropped   int   // items that could not be decoded and were removed
+	BytesTruncated   int64 // bytes of partial records cut off the end of files
+	SegmentsCreated  int   // empty segment files created to fill gaps
+}
+
+// Repair fixes the segment files of the named queue so it can be opened
+// again after a crash or a disk problem.  It truncates partial records at
+// the end of files, drops records that cannot be decoded with the given
+// builder, and fills gaps in the segment numbers with empty segments.  The
+// records of encrypted segments can't be decoded without the key, so they
+// are never dropped.  The queue must not be open while this runs.
+//
+// Segments written by a version of dque that predates segment headers must
+// first be upgraded with MigrateLegacySegments.
+func Repair(name string, dirPath string, itemsPerSegment int, builder func() interface{}) (RepairReport, error) {
+	var report RepairReport
+
+	if err := checkName(name); err != nil {
+		return report, err
+	}
+	fs := osStorage{}
+	fullPath := path.Join(dirPath, name)
+	if !dirExists(fs, fullPath) {
+		return report, errors.New("the given queue does not exist (" + fullPath + ")")
+	}
+
+	fileLock, err := acquireLock(fs, fullPath)
+	if err != nil {
+		return report, err
+	}
+	defer fileLock.Close()
+
+	numbers, err := listSegmentNumbers(fs, fullPath, filePattern, log.Printf)
+	if err != nil {
+		return report, err
+	}
+
+	cfg := config{ItemsPerSegment: itemsPerSegment}
+	for i, number := range numbers {
+		report.FilesScanned++
+		if err := repairSegment(fullPath, number, builder, &cfg, &report); err != nil {
+			return report, err
+		}
+
+		// Fill any gap before the next segment so the queue can move
+		// from one segment to the next
+		if i+1 < len(numbers) {
+			for missing := number + 1; missing < numbers[i+1]; missing++ {
+				cfg.logf("dque: creating missing segment %d in %s", missing, fullPath)
+				filePath := path.Join(fullPath, cfg.segmentFileName(missing))
+				if err := writeFileSync(fs, filePath, newSegmentHeader(&cfg).bytes(), cfg.filePerm()); err != nil {
+					return report, err
+				}
+				report.SegmentsCreated++
+			}
+		}
+	}
+
+	// A queue needs at least one segment
+	if len(numbers) == 0 {
+		filePath := path.Join(fullPath, cfg.segmentFileName(1))
+		if err := writeFileSync(fs, filePath, newSegmentHeader(&cfg).bytes(), cfg.filePerm()); err != nil {
+			return report, err
+		}
+		report.SegmentsCreated++
+	}
+
+	return report, nil
+}
+
+// repairSegment rewrites a segment file without its partial and undecodable
+// records.  The file is left alone if there is nothing to fix.
+func repairSegment(fullPath string, number int, builder func() interface{}, cfg *config, report *RepairReport) error {
+	seg := qSegment{dirPath: fullPath, number: number, objectBuilder: builder, cfg: cfg}
+	filePath := seg.filePath()
+
+	info, err := cfg.fs().Stat(filePath)
+	if err != nil {
+		return errors.Wrap(err, "error reading file: "+filePath)
+	}
+	data, err := readFile(cfg.fs(), filePath)
+	if err != nil {
+		return errors.Wrap(err, "error reading file: "+filePath)
+	}
+	if len(data) == 0 {
+		// A new segment that doesn't have its header yet
+		return nil
+	}
+	if seg.header, err = readSegmentHeader(bytes.NewReader(data), filePath); err != nil {
+		return err
+	}
+
+	// Replay the records to find the ones still queued.  Removal markers
+	// and checkpoints remove the oldest records whether or not they can be
+	// decoded.
+	var records [][]byte
+	var bad []bool
+	removed := 0
+	changed := false
+	offset := segmentHeaderSize
+	for offset+4 <= len(data) {
+		recLen := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		if recLen == 0 {
+			if len(records) > 0 {
+				records, bad = records[1:], bad[1:]
+				removed++
+			} else {
+				// A removal marker without an item to remove is dropped
+				changed = true
+			}
+			offset += 4
+			continue
+		}
+		if uint32(recLen) == checkpointMarker {
+			if offset+checkpointSize > len(data) {
+				break
+			}
+			n := int(binary.LittleEndian.Uint32(data[offset+4:offset+checkpointSize])) - removed
+			if n < 0 || n > len(records) {
+				// A checkpoint that doesn't fit the records is dropped
+				n = 0
+				changed = true
+			}
+			records, bad = records[n:], bad[n:]
+			removed += n
+			offset += checkpointSize
+			continue
+		}
+		if offset+4+recLen > len(data) {
+			break
+		}
+
+		// Repair has no key, so the records of encrypted segments are
+		// kept without being checked
+		rec := data[offset : offset+4+recLen]
+		var err error
+		if !seg.header.encrypted {
+			if _, err = seg.decode(rec[4:]); err != nil {
+				cfg.logf("dque: unable to decode the record at byte %d of %s: %s", offset, filePath, err)
+			}
+		}
+		records = append(records, rec)
+		bad = append(bad, err != nil)
+		offset += 4 + recLen
+	}
+	if offset < len(data) {
+		cfg.logf("dque: truncating %s at byte %d", filePath, offset)
+		report.BytesTruncated += int64(len(data) - offset)
+		changed = true
+	}
+
+	// Drop the queued records that can't be decoded
+	kept := records[:0]
+	for i, rec := range records {
+		if bad[i] {
+			report.RecordsDropped++
+			changed = true
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	records = kept
+	report.RecordsRecovered += len(records)
+
+	if !changed {
+		return nil
+	}
+
+	// Write the repaired file beside the original and then swap them
+	repaired := seg.header.bytes()
+	for _, rec := range records {
+		repaired = append(repaired, rec...)
+	}
+	tmpPath := filePath + ".tmp"
+	if err := writeFileSync(cfg.fs(), tmpPath, repaired, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := cfg.fs().Rename(tmpPath, filePath); err != nil {
+		return errors.Wrap(err, "error replacing file: "+filePath)
+	}
+	return nil
+}
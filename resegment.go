@@ -0,0 +1,168 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Resegment rewrites the segment files of the named queue so each holds
+// newItemsPerSegment items, keeping the items in order along with the time
+// they were enqueued.  The new files are written to a directory beside the
+// queue's, which then replaces it.  In-flight items, retained segment
+// files, and the dedup window saved with Options.PersistDedup are carried
+// over.
+//
+// The queue must not be open; ErrQueueLocked is returned if it is.  Queues
+// with cursors or encrypted segments can't be resegmented.  Use DrainTo to
+// copy those to a new queue instead.
+func Resegment(name string, dirPath string, oldBuilder func() interface{}, newItemsPerSegment int) error {
+	if newItemsPerSegment < 1 {
+		return errors.New("the number of items per segment must be positive")
+	}
+
+	if err := checkName(name); err != nil {
+		return err
+	}
+	fs := osStorage{}
+	fullPath := path.Join(dirPath, name)
+	if !dirExists(fs, fullPath) {
+		return errors.New("the given queue does not exist (" + fullPath + ")")
+	}
+
+	fileLock, err := acquireLock(fs, fullPath)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Close()
+
+	if cursors, err := fs.ReadDir(path.Join(fullPath, cursorDir)); err == nil && len(cursors) > 0 {
+		return errors.New("the queue has cursors, which can't be moved to new segments (" + fullPath + ")")
+	}
+
+	// Read every item still in the queue.  Reading the segments as a
+	// read-only queue does leaves the old files untouched.
+	numbers, err := listSegmentNumbers(fs, fullPath, filePattern, log.Printf)
+	if err != nil {
+		return err
+	}
+	readCfg := config{readOnly: true, Storage: fs}
+	var objects []interface{}
+	var header segmentHeader
+	for _, number := range numbers {
+		seg := &qSegment{dirPath: fullPath, number: number, objectBuilder: oldBuilder, cfg: &readCfg}
+		if _, err := openReadOnlySegment(seg); err != nil {
+			return err
+		}
+		if err := seg.close(); err != nil {
+			return err
+		}
+		objects = append(objects, seg.objects...)
+		header = seg.header
+	}
+
+	// Write the new segments beside the queue, removing any left behind by
+	// an earlier attempt
+	tmpPath := fullPath + ".resegment"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return errors.Wrap(err, "error removing "+tmpPath)
+	}
+	if err := fs.Mkdir(tmpPath, defaultDirMode); err != nil {
+		return errors.Wrap(err, "error creating "+tmpPath)
+	}
+	writeCfg := config{
+		ItemsPerSegment: newItemsPerSegment,
+		Codec:           header.codec,
+		Compression:     header.compression,
+		Storage:         fs,
+	}
+	// Number the new segments from the old first one, so they can't take
+	// the names of consumed segment files retained before it
+	first := 1
+	if len(numbers) > 0 {
+		first = numbers[0]
+	}
+	if err := writeSegments(tmpPath, first, objects, oldBuilder, &writeCfg); err != nil {
+		return err
+	}
+	files, err := fs.ReadDir(fullPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to read files in "+fullPath)
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), retainedSuffix) {
+			if err := fs.Rename(path.Join(fullPath, f.Name()), path.Join(tmpPath, f.Name())); err != nil {
+				return errors.Wrap(err, "error moving retained segment "+f.Name())
+			}
+		}
+	}
+	inflightPath := path.Join(fullPath, inflightDir)
+	if dirExists(fs, inflightPath) {
+		if err := fs.Rename(inflightPath, path.Join(tmpPath, inflightDir)); err != nil {
+			return errors.Wrap(err, "error moving "+inflightPath)
+		}
+	}
+
+	dedupPath := path.Join(fullPath, dedupFile)
+	if _, err := fs.Stat(dedupPath); err == nil {
+		if err := fs.Rename(dedupPath, path.Join(tmpPath, dedupFile)); err != nil {
+			return errors.Wrap(err, "error moving "+dedupPath)
+		}
+	}
+
+	// Swap the directories
+	oldPath := fullPath + ".old"
+	if err := fs.Rename(fullPath, oldPath); err != nil {
+		return errors.Wrap(err, "error moving "+fullPath)
+	}
+	if err := fs.Rename(tmpPath, fullPath); err != nil {
+		return errors.Wrapf(err, "error moving %s to %s, the old queue is in %s", tmpPath, fullPath, oldPath)
+	}
+	if err := os.RemoveAll(oldPath); err != nil {
+		return errors.Wrap(err, "error removing "+oldPath)
+	}
+	return nil
+}
+
+// writeSegments writes the objects to new segment files in the given
+// directory, numbered from first.
+func writeSegments(dirPath string, first int, objects []interface{}, builder func() interface{}, cfg *config) error {
+	number := first
+	seg, err := newQueueSegment(dirPath, number, true, builder, cfg)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if seg.sizeOnDisk() >= cfg.ItemsPerSegment {
+			if err := closeSynced(seg); err != nil {
+				return err
+			}
+			number++
+			if seg, err = newQueueSegment(dirPath, number, true, builder, cfg); err != nil {
+				return err
+			}
+		}
+		if err := seg.add(obj); err != nil {
+			return errors.Wrapf(err, "error adding item to segment %d", number)
+		}
+	}
+	return closeSynced(seg)
+}
+
+// closeSynced syncs a segment written in turbo mode and closes it.
+func closeSynced(seg *qSegment) error {
+	if err := seg.turboSync(); err != nil {
+		seg.close()
+		return err
+	}
+	return seg.close()
+}
@@ -0,0 +1,120 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EnqueueAt adds an item to the end of the queue that is not delivered
+// until the given time.  Until then Dequeue, Peek, and the methods built on
+// them pass over it, returning the first item behind it that is due, or
+// ErrEmpty if none is.  Blocking methods such as DequeueBlock wake up when
+// the next scheduled item becomes due.  The time is recorded with the item,
+// so it survives the queue being closed and opened again.
+//
+// Items that are due are still delivered in the order they were enqueued.
+// While the first item in the queue isn't due, though, finding one that is
+// is an O(n) operation like RemoveWhere, and the segment holding it is
+// rewritten without it.  Scheduled items are counted by Size.
+func (q *DQue) EnqueueAt(obj interface{}, when time.Time) error {
+	if err := q.checkItem(obj); err != nil {
+		return err
+	}
+	env := &envelope{obj: obj, enqueuedAt: q.config.now().UnixNano(), notBefore: when.UnixNano()}
+	added, err := q.enqueue(env)
+	if added {
+		// Wakeup any goroutine that is currently waiting for an item to be
+		// enqueued, so it can take the new item's time into account
+		q.signalNotEmpty()
+
+		q.observeEnqueue()
+	}
+	return err
+}
+
+// removeDueLocked removes the first item in the queue that is due, for when
+// the first item isn't, and returns it converted by as.  The head lock must
+// be held.
+func (q *DQue) removeDueLocked(as itemConverter) (interface{}, error) {
+	return q.findDueLocked(func(seg *qSegment, index int) (interface{}, error) {
+		obj, err := seg.removeAt(index, func(object interface{}) (interface{}, error) { return as(seg, index, object) })
+		if err == nil && seg == q.firstSegment {
+			// The item became due after the first one was found not to be
+			err = q.skipEmptyFirstSegments()
+		}
+		return obj, err
+	})
+}
+
+// peekDueLocked returns the first item in the queue that is due, for when
+// the first item isn't.  The head lock must be held.
+func (q *DQue) peekDueLocked() (interface{}, error) {
+	return q.findDueLocked(func(seg *qSegment, index int) (interface{}, error) {
+		return seg.peekAt(index, seg.item)
+	})
+}
+
+// findDueLocked searches the queue from the head for the first item that is
+// due and calls fn with the segment holding it and its index.  Segments
+// between the first and the last are read from disk.  If no item is due,
+// ErrEmpty is returned and nextDue is set to when the next one will be.
+// The head lock must be held.
+func (q *DQue) findDueLocked(fn func(seg *qSegment, index int) (interface{}, error)) (interface{}, error) {
+	// Nothing can be added to or removed from the segments while the tail
+	// lock is held
+	q.tailMutex.Lock()
+	defer q.tailMutex.Unlock()
+
+	now := q.config.now().UnixNano()
+	var next int64
+	search := func(seg *qSegment) (interface{}, bool, error) {
+		index, notBefore := seg.findDue(now)
+		if index < 0 {
+			if notBefore != 0 && (next == 0 || notBefore < next) {
+				next = notBefore
+			}
+			return nil, false, nil
+		}
+		obj, err := fn(seg, index)
+		return obj, true, err
+	}
+
+	// Search the first segment
+	if obj, ok, err := search(q.firstSegment); ok {
+		return obj, err
+	}
+
+	// Search the segments that are only on disk
+	for num := q.firstSegment.number + 1; num < q.lastSegment.number; num++ {
+		seg, err := openQueueSegment(q.fullPath, num, q.turbo, q.builder, &q.config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error opening queue segment %d", num)
+		}
+		obj, ok, err := search(seg)
+		if closeErr := seg.close(); err == nil {
+			err = closeErr
+		}
+		if ok || err != nil {
+			// The segment may have been rewritten without the item
+			q.invalidateReadAhead()
+			return obj, err
+		}
+	}
+
+	// Search the last segment
+	if q.lastSegment != q.firstSegment {
+		if obj, ok, err := search(q.lastSegment); ok {
+			return obj, err
+		}
+	}
+
+	q.nextDue = next
+	return nil, ErrEmpty
+}
@@ -17,27 +17,36 @@ package dque
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // ErrCorruptedSegment is returned when a segment file cannot be opened due to inconsistent formatting.
 // Recovery may be possible by clearing or deleting the file, then reloading using dque.New().
+// Callers can use errors.As to find it and decide whether to recover.
 type ErrCorruptedSegment struct {
-	Path string
-	Err  error
+	Path   string
+	Offset int64 // byte offset in the file of the record that could not be read
+	Err    error
 }
 
 // Error returns a string describing ErrCorruptedSegment
 func (e ErrCorruptedSegment) Error() string {
-	return fmt.Sprintf("segment file %s is corrupted: %s", e.Path, e.Err)
+	return fmt.Sprintf("segment file %s is corrupted at byte %d: %s", e.Path, e.Offset, e.Err)
 }
 
 // Unwrap returns the wrapped error
@@ -61,26 +70,72 @@ func (e ErrUnableToDecode) Unwrap() error {
 	return e.Err
 }
 
+// ErrDecodeMismatch is wrapped by ErrUnableToDecode when gob can't decode
+// an object into the type returned by the queue's builder.  This usually
+// means the builder returns a different type than the one that was enqueued.
+type ErrDecodeMismatch struct {
+	Path   string
+	Offset int64  // byte offset of the object's record in the file
+	Index  int    // number of objects written to the file before this one
+	Type   string // type of the object returned by the builder
+	Err    error
+}
+
+// Error returns a string describing ErrDecodeMismatch
+func (e ErrDecodeMismatch) Error() string {
+	return fmt.Sprintf("object %d at byte %d of segment file %s does not match the builder's type %s: %s", e.Index, e.Offset, e.Path, e.Type, e.Err)
+}
+
+// Unwrap returns the wrapped error
+func (e ErrDecodeMismatch) Unwrap() error {
+	return e.Err
+}
+
+// ErrIncompatibleSegment is returned when a segment file is missing its header
+// or was written by an unknown version of dque.  Files written before segment
+// headers existed can be upgraded with MigrateLegacySegments.
+type ErrIncompatibleSegment struct {
+	Path   string
+	Reason string
+}
+
+// Error returns a string describing ErrIncompatibleSegment
+func (e ErrIncompatibleSegment) Error() string {
+	return fmt.Sprintf("segment file %s is incompatible: %s", e.Path, e.Reason)
+}
+
 var (
 	errEmptySegment = errors.New("Segment is empty")
+
+	// maxRecordSize is the most bytes a record can hold after its 4-byte
+	// length, which can't be checkpointMarker.  It is a variable so tests
+	// can lower it.
+	maxRecordSize uint64 = checkpointMarker - 1
 )
 
 // qSegment represents a portion (segment) of a persistent queue
 type qSegment struct {
-	dirPath       string
-	number        int
-	objects       []interface{}
-	objectBuilder func() interface{}
-	file          *os.File
-	mutex         sync.Mutex
-	removeCount   int
-	turbo         bool
-	maybeDirty    bool  // filesystem changes may not have been flushed to disk
-	syncCount     int64 // for testing
+	dirPath        string
+	number         int
+	objects        []interface{}
+	objectBuilder  func() interface{}
+	header         segmentHeader // how items in this file are written
+	headerPending  bool          // the header is written along with the first item
+	cfg            *config
+	file           File
+	mutex          sync.Mutex
+	removeCount    int
+	uncheckpointed int // removals not yet recorded by a checkpoint
+	turbo          bool
+	maybeDirty     bool  // filesystem changes may not have been flushed to disk
+	fileBytes      int64 // size of the file, counting writes not yet synced
+	preallocated   bool  // disk was reserved beyond the end of the file
+	syncCount      int64 // for testing
 }
 
 // load reads all objects from the queue file into a slice
 // returns ErrCorruptedSegment or ErrUnableToDecode for errors pertaining to file contents.
+// A partial record at the end of the file is truncated rather than treated as corruption.
 func (seg *qSegment) load() error {
 
 	// This is heavy-handed but its safe
@@ -88,24 +143,45 @@ func (seg *qSegment) load() error {
 	defer seg.mutex.Unlock()
 
 	// Open the file in read mode
-	f, err := os.OpenFile(seg.filePath(), os.O_RDONLY, 0644)
+	f, err := seg.cfg.fs().OpenFile(seg.filePath(), os.O_RDONLY, 0644)
 	if err != nil {
 		return errors.Wrap(err, "error opening file: "+seg.filePath())
 	}
 	defer f.Close()
 	seg.file = f
 
+	// Read and validate the header
+	header, err := readSegmentHeader(seg.file, seg.filePath())
+	if err != nil {
+		return err
+	}
+	seg.header = header
+	if err := seg.cfg.checkKey(header, seg.filePath()); err != nil {
+		return err
+	}
+
+	// offset is the end of the last complete record
+	offset := int64(segmentHeaderSize)
+	seg.fileBytes = offset
+
+	// Records that aren't decoded share one copy of the path
+	lazyPath := seg.filePath()
+
 	// Loop until we can load no more
+	lenBytes := make([]byte, 4)
 	for {
 		// Read the 4 byte length of the gob
-		lenBytes := make([]byte, 4)
 		if n, err := io.ReadFull(seg.file, lenBytes); err != nil {
 			if err == io.EOF {
 				return nil
 			}
+			if err == io.ErrUnexpectedEOF {
+				return seg.truncate(offset, fmt.Sprintf("partial object length (read %d/4 bytes)", n))
+			}
 			return ErrCorruptedSegment{
-				Path: seg.filePath(),
-				Err:  errors.Wrapf(err, "error reading object length (read %d/4 bytes)", n),
+				Path:   seg.filePath(),
+				Offset: offset,
+				Err:    errors.Wrapf(err, "error reading object length (read %d/4 bytes)", n),
 			}
 		}
 
@@ -115,38 +191,105 @@ func (seg *qSegment) load() error {
 			// Remove the first item from the in-memory queue
 			if len(seg.objects) == 0 {
 				return ErrCorruptedSegment{
-					Path: seg.filePath(),
-					Err:  fmt.Errorf("excess deletion records (%d)", seg.removeCount+1),
+					Path:   seg.filePath(),
+					Offset: offset,
+					Err:    fmt.Errorf("excess deletion records (%d)", seg.removeCount+1),
 				}
 			}
-			seg.objects = seg.objects[1:]
-			// log.Println("TEMP: Detected delete in load()")
+			seg.dropFirst()
 			seg.removeCount++
+			offset += 4
+			seg.fileBytes = offset
+			continue
+		}
+		if gobLen == checkpointMarker {
+			// A checkpoint holds the number of items removed so far
+			countBytes := make([]byte, 4)
+			if n, err := io.ReadFull(seg.file, countBytes); err != nil {
+				if err == io.ErrUnexpectedEOF || err == io.EOF {
+					return seg.truncate(offset, fmt.Sprintf("partial checkpoint (read %d/4 bytes)", n))
+				}
+				return ErrCorruptedSegment{
+					Path:   seg.filePath(),
+					Offset: offset,
+					Err:    errors.Wrap(err, "error reading checkpoint from file"),
+				}
+			}
+			if err := seg.applyCheckpoint(int(binary.LittleEndian.Uint32(countBytes)), offset); err != nil {
+				return err
+			}
+			offset += checkpointSize
+			seg.fileBytes = offset
 			continue
 		}
 
 		data := make([]byte, int(gobLen))
-		if _, err := io.ReadFull(seg.file, data); err != nil {
+		if n, err := io.ReadFull(seg.file, data); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return seg.truncate(offset, fmt.Sprintf("partial object (read %d/%d bytes)", n, gobLen))
+			}
 			return ErrCorruptedSegment{
-				Path: seg.filePath(),
-				Err:  errors.Wrap(err, "error reading gob data from file"),
+				Path:   seg.filePath(),
+				Offset: offset,
+				Err:    errors.Wrap(err, "error reading gob data from file"),
 			}
 		}
 
-		// Decode the bytes into an object
-		object := seg.objectBuilder()
-		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(object); err != nil {
-			return ErrUnableToDecode{
+		// Decode the bytes into an object, or only note where they are
+		var object interface{}
+		if seg.cfg.lazyDecode {
+			object, err = seg.decodeLazy(data, lazyPath, offset+4)
+		} else {
+			object, err = seg.decode(data)
+		}
+		if _, ok := err.(builderError); ok {
+			// The record may be fine, so it isn't poison
+			return errors.Wrapf(err, "unable to load the item at byte %d of %s", offset, seg.filePath())
+		}
+		if err != nil {
+			if mismatch, ok := err.(ErrDecodeMismatch); ok {
+				mismatch.Offset = offset
+				mismatch.Index = len(seg.objects) + seg.removeCount
+				err = mismatch
+			}
+			seg.cfg.observer.decodeFailed(err)
+			err = ErrUnableToDecode{
 				Path: seg.filePath(),
-				Err:  errors.Wrapf(err, "failed to decode %T", object),
+				Err:  err,
 			}
+			if seg.cfg.onPoison == nil {
+				return err
+			}
+			// Keep the record's place so later removal markers still
+			// remove the right items.  skipPoison deals with it.
+			object = &poisonRecord{raw: data, err: err}
 		}
 
 		// Add item to the objects slice
 		seg.objects = append(seg.objects, object)
+		offset += 4 + int64(gobLen)
+		seg.fileBytes = offset
+	}
+}
 
-		// log.Printf("TEMP: Loaded: %#v\n", object)
+// truncate cuts a partial record off the end of the segment file.  A crash
+// part way through writing an item leaves one behind.  The item was never
+// successfully enqueued, so dropping it loses nothing.
+func (seg *qSegment) truncate(offset int64, reason string) error {
+	if seg.cfg.readOnly {
+		// The record may still be being written by the process that owns
+		// the queue, so leave it alone
+		return nil
 	}
+	seg.cfg.logf("dque: truncating %s at byte %d: %s", seg.filePath(), offset, reason)
+	if err := seg.cfg.fs().Truncate(seg.filePath(), offset); err != nil {
+		return ErrCorruptedSegment{
+			Path:   seg.filePath(),
+			Offset: offset,
+			Err:    errors.Wrap(err, "unable to truncate partial object"),
+		}
+	}
+	return nil
 }
 
 // peek returns the first item in the segment without removing it.
@@ -165,13 +308,31 @@ func (seg *qSegment) peek() (interface{}, error) {
 	// Save a reference to the first item in the in-memory queue
 	object := seg.objects[0]
 
-	return object, nil
+	return seg.item(object)
 }
 
 // remove removes and returns the first item in the segment and adds
 // a zero length marker to the end of the queue file to signify a removal.
 // If the queue is already empty, the emptySegment error will be returned.
 func (seg *qSegment) remove() (interface{}, error) {
+	return seg.removeAs(seg.item)
+}
+
+// discard removes the first item in the segment without decoding it, for
+// an item that is dropped rather than returned.  removed is true if the
+// item is gone, in which case it is gone even if an error is returned
+// because the removal couldn't be synced.
+func (seg *qSegment) discard() (removed bool, err error) {
+	kept, err := seg.removeAs(func(object interface{}) (interface{}, error) { return object, nil })
+	return kept != nil, err
+}
+
+// removeAs removes the first item in the segment and returns it converted
+// by as.  Nothing is removed if it can't be converted.  If the removal is
+// written but can't be synced, such as when the SyncTimeout option gives up
+// on the sync, the item is removed all the same and is returned along with
+// the error.
+func (seg *qSegment) removeAs(as func(object interface{}) (interface{}, error)) (interface{}, error) {
 
 	// This is heavy-handed but its safe
 	seg.mutex.Lock()
@@ -181,70 +342,514 @@ func (seg *qSegment) remove() (interface{}, error) {
 		// Queue is empty so return nil object (and empty_segment error)
 		return nil, errEmptySegment
 	}
+	item, err := as(seg.objects[0])
+	if err != nil {
+		return nil, err
+	}
 
-	// Create a 4-byte length of value zero (this signifies a removal)
-	deleteLen := 0
-	deleteLenBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(deleteLenBytes, uint32(deleteLen))
+	if seg.checkpointing() {
+		// Only every so many removals are written to the file
+		written := seg.uncheckpointed+1 == seg.cfg.checkpointEvery
+		if written {
+			if err := seg.writeCheckpoint(seg.removeCount + 1); err != nil {
+				return nil, err
+			}
+		} else {
+			seg.uncheckpointed++
+		}
+		seg.dropFirst()
+		seg.removeCount++
+		if written {
+			// Possibly force writes to disk
+			if err := seg._sync(); err != nil {
+				return item, err
+			}
+		}
+		return item, nil
+	}
 
 	// Write the 4-byte length (of zero) first
-	if _, err := seg.file.Write(deleteLenBytes); err != nil {
-		return nil, errors.Wrapf(err, "failed to remove item from segment %d", seg.number)
+	if _, err := seg.file.Write(removalMarker[:]); err != nil {
+		seg.undoWrite()
+		return nil, diskError(err, fmt.Sprintf("failed to remove item from segment %d", seg.number))
 	}
 
-	// Save a reference to the first item in the in-memory queue
-	object := seg.objects[0]
-
 	// Remove the first item from the in-memory queue
-	seg.objects = seg.objects[1:]
+	seg.dropFirst()
 
 	// Increment the delete count
 	seg.removeCount++
+	seg.fileBytes += 4
 
 	// Possibly force writes to disk
 	if err := seg._sync(); err != nil {
-		return nil, err
+		return item, err
 	}
 
-	return object, nil
+	return item, nil
+}
+
+// dropFirst removes the first object from memory.  Its slot is cleared so
+// the backing array of the slice doesn't keep a dequeued item reachable
+// for as long as the segment is held.  The segment mutex must be held.
+func (seg *qSegment) dropFirst() {
+	seg.objects[0] = nil
+	seg.objects = seg.objects[1:]
 }
 
 // Add adds an item to the in-memory queue segment and appends it to the persistent file
 func (seg *qSegment) add(object interface{}) error {
+	_, err := seg.addContext(context.Background(), object)
+	return err
+}
+
+// addContext is add with a context that a File implementing ContextSyncer
+// is given to sync with.  added is true if the item was written, in which
+// case it is in the segment even if an error is returned because the write
+// couldn't be synced.  Otherwise nothing was written, or what was written
+// has been undone.
+func (seg *qSegment) addContext(ctx context.Context, object interface{}) (added bool, err error) {
 
 	// This is heavy-handed but its safe
 	seg.mutex.Lock()
 	defer seg.mutex.Unlock()
 
-	// Encode the struct to a byte buffer
-	var buff bytes.Buffer
-	enc := gob.NewEncoder(&buff)
-	if err := enc.Encode(object); err != nil {
-		return errors.Wrap(err, "error gob encoding object")
+	// Encode the struct and its length prefix
+	if env, ok := object.(*envelope); ok && (env.notBefore != 0 || env.tag != "") && !seg.header.envelope {
+		return false, errors.Errorf("segment %d was written by a version of dque that can't schedule or tag items", seg.number)
+	}
+	object = seg.wrap(object)
+	data, err := seg.record(object)
+	if err != nil {
+		return false, err
+	}
+	if obs := seg.cfg.observer.items(); obs != nil {
+		obs.OnItemEncoded(len(data) - 4)
 	}
 
-	// Count the bytes stored in the byte buffer
-	// and store the count into a 4-byte byte array
-	buffLen := len(buff.Bytes())
-	buffLenBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buffLenBytes, uint32(buffLen))
-
-	// Write the 4-byte buffer length first
-	if _, err := seg.file.Write(buffLenBytes); err != nil {
-		return errors.Wrapf(err, "failed to write object length to segment %d", seg.number)
+	// A new file gets its header in the same write as its first item
+	if seg.headerPending {
+		data = append(seg.header.bytes(), data...)
 	}
 
-	// Then write the buffer bytes
-	if _, err := seg.file.Write(buff.Bytes()); err != nil {
-		return errors.Wrapf(err, "failed to write object to segment %d", seg.number)
+	// Write the length and the encoded bytes together
+	if _, err := seg.file.Write(data); err != nil {
+		seg.undoWrite()
+		return false, diskError(err, fmt.Sprintf("failed to write object to segment %d", seg.number))
 	}
+	seg.headerPending = false
+	seg.fileBytes += int64(len(data))
 
 	seg.objects = append(seg.objects, object)
 
 	// Possibly force writes to disk
+	return true, seg._syncContext(ctx)
+}
+
+// cutBack removes the items added to the end of the segment since it held
+// n items in fileBytes bytes, both from memory and from its file.
+func (seg *qSegment) cutBack(n int, fileBytes int64) error {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	if err := seg.cfg.fs().Truncate(seg.filePath(), fileBytes); err != nil {
+		return errors.Wrapf(err, "unable to truncate segment %d", seg.number)
+	}
+	seg.objects = seg.objects[:n]
+	seg.fileBytes = fileBytes
+	seg.headerPending = fileBytes == 0
+
+	// Possibly force the change to disk
 	return seg._sync()
 }
 
+// undoWrite truncates the file to the end of the last complete write, so a
+// write that failed part way through isn't followed by the next record.
+func (seg *qSegment) undoWrite() {
+	if err := seg.cfg.fs().Truncate(seg.filePath(), seg.fileBytes); err != nil {
+		seg.cfg.logf("dque: unable to truncate the partial write to %s: %v", seg.filePath(), err)
+	}
+}
+
+// diskError wraps an error writing to the disk with the given message, as
+// ErrDiskFull if the disk has no space left.
+func diskError(err error, msg string) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return errors.Wrapf(ErrDiskFull, "%s: %v", msg, err)
+	}
+	return errors.Wrap(err, msg)
+}
+
+// record returns the object encoded for storage in this segment, preceded
+// by its 4-byte length.
+func (seg *qSegment) record(object interface{}) ([]byte, error) {
+	if lazyOf(object) != nil {
+		// An item from another segment that was never decoded
+		decoded, err := seg.resolve(object)
+		if err != nil {
+			return nil, err
+		}
+		object = seg.wrap(decoded)
+	}
+
+	// The encoded bytes may live in pooled buffers, so they are copied
+	// into the record before the buffers are given back
+	buff, zbuff := getBuffer(), getBuffer()
+	defer putBuffer(buff)
+	defer putBuffer(zbuff)
+	data, err := seg.encode(buff, zbuff, unwrap(object))
+	if err != nil {
+		return nil, err
+	}
+	var prefix []byte
+	if env, ok := object.(*envelope); ok {
+		prefix = env.bytes()
+	}
+	if seg.header.encrypted {
+		if data, err = seg.cfg.encryption.seal(append(prefix, data...)); err != nil {
+			return nil, err
+		}
+		prefix = nil
+	}
+
+	// Count the bytes stored in the byte slice
+	// and store the count into a 4-byte byte array
+	size := len(prefix) + len(data)
+	if uint64(size) > maxRecordSize {
+		return nil, errors.Errorf("the item is %d bytes once encoded, more than the %d a segment can hold", size, maxRecordSize)
+	}
+	rec := make([]byte, 4, 4+size)
+	binary.LittleEndian.PutUint32(rec, uint32(size))
+	rec = append(rec, prefix...)
+	return append(rec, data...), nil
+}
+
+// rewrite replaces the segment file with one holding only the given objects,
+// dropping every removal marker.  The new file is written beside the old
+// one and renamed over it, so a crash leaves either the old or the new file.
+func (seg *qSegment) rewrite(objects []interface{}) error {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	data := seg.header.bytes()
+	objects = append([]interface{}{}, objects...)
+	for i, object := range objects {
+		// Items that were never decoded are copied as they are
+		rec, moved, ok, err := seg.lazyRecordBytes(object, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		if ok {
+			objects[i] = moved
+		} else {
+			objects[i] = seg.wrap(object)
+			if rec, err = seg.record(objects[i]); err != nil {
+				return err
+			}
+		}
+		data = append(data, rec...)
+	}
+
+	// Keep the permission of the file being replaced
+	info, err := seg.cfg.fs().Stat(seg.filePath())
+	if err != nil {
+		return errors.Wrap(err, "error reading file: "+seg.filePath())
+	}
+
+	tmpPath := seg.filePath() + ".tmp"
+	if err := writeFileSync(seg.cfg.fs(), tmpPath, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// Close the old file first because Windows can't rename over an open file
+	if err := seg.file.Close(); err != nil {
+		return errors.Wrapf(err, "unable to close segment file %s.", seg.fileName())
+	}
+	renameErr := seg.cfg.fs().Rename(tmpPath, seg.filePath())
+
+	// Re-open the file in append mode, whether or not it was replaced
+	seg.file, err = seg.cfg.openSegmentFile(seg.filePath(), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "error opening file: "+seg.filePath())
+	}
+	if renameErr != nil {
+		return errors.Wrap(renameErr, "error replacing file: "+seg.filePath())
+	}
+	if !seg.turbo {
+		if err := syncDir(seg.cfg.fs(), seg.dirPath); err != nil {
+			return err
+		}
+	}
+
+	seg.objects = objects
+	seg.headerPending = false
+	seg.removeCount = 0
+	seg.uncheckpointed = 0
+	seg.fileBytes = int64(len(data))
+	seg.preallocated = false
+	seg.maybeDirty = false
+	return nil
+}
+
+// prepend rewrites the segment with the given objects ahead of the ones it
+// already holds.
+func (seg *qSegment) prepend(objects []interface{}) error {
+	seg.mutex.Lock()
+	objects = append(append([]interface{}{}, objects...), seg.objects...)
+	seg.mutex.Unlock()
+
+	return seg.rewrite(objects)
+}
+
+// removeWhere removes and returns the first object for which pred returns
+// true by rewriting the segment without it.
+func (seg *qSegment) removeWhere(pred func(obj interface{}) bool) (interface{}, bool, error) {
+	seg.mutex.Lock()
+	index := -1
+	var item interface{}
+	for i, object := range seg.objects {
+		var err error
+		if item, err = seg.item(object); err != nil {
+			seg.mutex.Unlock()
+			return nil, false, err
+		}
+		if pred(item) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		seg.mutex.Unlock()
+		return nil, false, nil
+	}
+	objects := append(append([]interface{}{}, seg.objects[:index]...), seg.objects[index+1:]...)
+	seg.mutex.Unlock()
+
+	if err := seg.rewrite(objects); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to remove item from segment %d", seg.number)
+	}
+	return item, true, nil
+}
+
+// encode encodes the object with the segment's codec into buff and
+// compresses the result into zbuff if this segment is compressed.  The
+// bytes returned may belong to either buffer.
+func (seg *qSegment) encode(buff, zbuff *bytes.Buffer, object interface{}) ([]byte, error) {
+	data, err := seg.encodeItem(buff, object)
+	if err != nil {
+		return nil, err
+	}
+
+	if seg.header.compression != CompressionGzip {
+		return data, nil
+	}
+
+	zw := getGzipWriter(zbuff)
+	defer gzipWriterPool.Put(zw)
+	if _, err := zw.Write(data); err != nil {
+		return nil, errors.Wrap(err, "error compressing object")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "error compressing object")
+	}
+	return zbuff.Bytes(), nil
+}
+
+// encodeItem encodes the object with the segment's codec into buff.  Items
+// enqueued with EnqueueRaw are already encoded.
+func (seg *qSegment) encodeItem(buff *bytes.Buffer, object interface{}) ([]byte, error) {
+	if raw, ok := object.(*rawItem); ok {
+		return raw.data, nil
+	}
+
+	var data []byte
+	if seg.header.codec == CodecBytes {
+		b, ok := object.([]byte)
+		if !ok {
+			return nil, errors.Errorf("a queue using CodecBytes can't store %T", object)
+		}
+		if len(b) == 0 {
+			return nil, errors.New("a queue using CodecBytes can't store an empty slice")
+		}
+		data = b
+	} else {
+		// A gob encoder sends each type once, so a fresh one is needed for
+		// every item to keep each record decodable on its own
+		enc := gob.NewEncoder(buff)
+		if err := enc.Encode(object); err != nil {
+			if strings.Contains(err.Error(), "not registered for interface") {
+				// Explain the fix rather than leaving only gob's message
+				return nil, errors.Wrapf(err, "error gob encoding %T (register the types stored in its interface fields with Options.GobTypes)", object)
+			}
+			return nil, errors.Wrap(err, "error gob encoding object")
+		}
+		data = buff.Bytes()
+	}
+	return data, nil
+}
+
+// firstDue returns false if the first item in the segment is scheduled to be
+// delivered after now.
+func (seg *qSegment) firstDue(now int64) bool {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	if len(seg.objects) == 0 {
+		return true
+	}
+	env, ok := seg.objects[0].(*envelope)
+	return !ok || env.due(now)
+}
+
+// findDue returns the index of the first item in the segment that is due at
+// now.  If none is, -1 is returned along with the earliest time one will be,
+// or zero if the segment is empty.
+func (seg *qSegment) findDue(now int64) (int, int64) {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	var next int64
+	for i, object := range seg.objects {
+		env, ok := object.(*envelope)
+		if !ok || env.due(now) {
+			return i, 0
+		}
+		if next == 0 || env.notBefore < next {
+			next = env.notBefore
+		}
+	}
+	return -1, next
+}
+
+// peekAt returns the item at the given index converted by as.
+func (seg *qSegment) peekAt(index int, as func(object interface{}) (interface{}, error)) (interface{}, error) {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	return as(seg.objects[index])
+}
+
+// removeAt removes the item at the given index, rewriting the segment file
+// without it, and returns it converted by as.  Nothing is removed if it
+// can't be converted.
+func (seg *qSegment) removeAt(index int, as func(object interface{}) (interface{}, error)) (interface{}, error) {
+	seg.mutex.Lock()
+	item, err := as(seg.objects[index])
+	if err != nil {
+		seg.mutex.Unlock()
+		return nil, err
+	}
+	objects := append(append([]interface{}{}, seg.objects[:index]...), seg.objects[index+1:]...)
+	seg.mutex.Unlock()
+
+	if err := seg.rewrite(objects); err != nil {
+		return nil, errors.Wrapf(err, "failed to remove item from segment %d", seg.number)
+	}
+	return item, nil
+}
+
+// decode reverses encode, returning a new object from the builder.
+func (seg *qSegment) decode(data []byte) (interface{}, error) {
+	obs := seg.cfg.observer.items()
+	if obs == nil {
+		return seg.decodeRecord(data)
+	}
+	start := time.Now()
+	object, err := seg.decodeRecord(data)
+	if err == nil {
+		obs.OnItemDecoded(len(data), time.Since(start))
+	}
+	return object, err
+}
+
+// decodeRecord is decode without reporting to an ItemObserver.
+func (seg *qSegment) decodeRecord(data []byte) (interface{}, error) {
+	if seg.header.encrypted {
+		if err := seg.cfg.checkKey(seg.header, seg.filePath()); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = seg.cfg.encryption.open(data); err != nil {
+			return nil, err
+		}
+	}
+	if !seg.header.envelope {
+		return seg.decodeItem(data)
+	}
+
+	env, data, err := readEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	builder := seg.objectBuilder
+	if env.tag != "" {
+		if builder = seg.cfg.builders[env.tag]; builder == nil {
+			return nil, errors.Errorf("no builder was given for type tag %q", env.tag)
+		}
+	}
+	if env.obj, err = seg.decodeItemWith(data, builder); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// decodeItem decodes an item, without its envelope, read from the segment file.
+func (seg *qSegment) decodeItem(data []byte) (interface{}, error) {
+	return seg.decodeItemWith(data, seg.objectBuilder)
+}
+
+// decodeItemWith is decodeItem with the builder for the item.
+func (seg *qSegment) decodeItemWith(data []byte, builder func() interface{}) (interface{}, error) {
+	if seg.header.compression == CompressionGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "error decompressing object")
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, errors.Wrap(err, "error decompressing object")
+		}
+	}
+	return seg.decodeEncodedWith(data, builder)
+}
+
+// decodeEncoded decodes an item encoded by encodeItem.
+func (seg *qSegment) decodeEncoded(data []byte) (interface{}, error) {
+	return seg.decodeEncodedWith(data, seg.objectBuilder)
+}
+
+// decodeEncodedWith is decodeEncoded with the builder for the item.
+func (seg *qSegment) decodeEncodedWith(data []byte, builder func() interface{}) (interface{}, error) {
+	if seg.header.codec == CodecBytes {
+		return data, nil
+	}
+	if builder == nil {
+		return nil, errors.New("no builder was given for items without a type tag")
+	}
+
+	object := builder()
+	if failed, ok := object.(builderError); ok {
+		return nil, failed
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(object); err != nil {
+		return nil, ErrDecodeMismatch{
+			Path: seg.filePath(),
+			Type: fmt.Sprintf("%T", object),
+			Err:  err,
+		}
+	}
+	return object, nil
+}
+
 // size returns the number of objects in this segment.
 // The size does not include items that have been removed.
 func (seg *qSegment) size() int {
@@ -269,6 +874,31 @@ func (seg *qSegment) sizeOnDisk() int {
 	return len(seg.objects) + seg.removeCount
 }
 
+// bytesOnDisk returns the size of the segment file, including removed
+// objects and removal markers.
+func (seg *qSegment) bytesOnDisk() int64 {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	return seg.fileBytes
+}
+
+// retainedSuffix is added to the name of a consumed segment file kept
+// because of Options.RetainConsumed.  It keeps the file from matching the
+// segment pattern, so it is never loaded again.
+const retainedSuffix = ".done"
+
+// removeSegmentFile deletes a segment file whose items have all been
+// consumed, or renames it aside when consumed segments are retained.
+func (c *config) removeSegmentFile(filePath string) error {
+	if c.retainConsumed {
+		return c.fs().Rename(filePath, filePath+retainedSuffix)
+	}
+	return c.fs().Remove(filePath)
+}
+
 // delete wipes out the queue and its persistent state
 func (seg *qSegment) delete() error {
 
@@ -281,9 +911,16 @@ func (seg *qSegment) delete() error {
 	}
 
 	// Delete the storage for this queue
-	err := os.Remove(seg.filePath())
-	if err != nil {
+	err := seg.cfg.removeSegmentFile(seg.filePath())
+	if os.IsNotExist(err) {
+		// Something else already deleted it, which is what we wanted anyway
+		seg.cfg.logf("dque: segment file %s was already deleted", seg.filePath())
+	} else if err != nil {
 		return errors.Wrap(err, "error deleting file: "+seg.filePath())
+	} else if !seg.turbo {
+		if err := syncDir(seg.cfg.fs(), seg.dirPath); err != nil {
+			return err
+		}
 	}
 
 	// Empty the in-memory slice of objects
@@ -295,7 +932,7 @@ func (seg *qSegment) delete() error {
 }
 
 func (seg *qSegment) fileName() string {
-	return fmt.Sprintf("%013d.dque", seg.number)
+	return seg.cfg.segmentFileName(seg.number)
 }
 
 func (seg *qSegment) filePath() string {
@@ -331,11 +968,18 @@ func (seg *qSegment) turboSync() error {
 		// will be called twice.
 		return nil
 	}
+	return seg.flush()
+}
+
+// flush does an fsync to disk if there are changes that may not have been
+// synced, whether or not turbo is on.
+func (seg *qSegment) flush() error {
 	if seg.maybeDirty {
-		if err := seg.file.Sync(); err != nil {
-			return errors.Wrap(err, "unable to sync file changes.")
+		if err := seg.syncFile(context.Background()); err != nil {
+			return diskError(err, "unable to sync file changes.")
 		}
 		seg.syncCount++
+		seg.cfg.synced()
 		seg.maybeDirty = false
 	}
 	return nil
@@ -344,21 +988,58 @@ func (seg *qSegment) turboSync() error {
 // _sync must only be called by the add and remove methods on qSegment.
 // Only syncs if turbo is off
 func (seg *qSegment) _sync() error {
+	return seg._syncContext(context.Background())
+}
+
+// _syncContext is _sync with a context for a File implementing ContextSyncer.
+func (seg *qSegment) _syncContext(ctx context.Context) error {
 	if seg.turbo {
 		// We do *not* force a sync if turbo is on
 		// We just mark it maybe dirty
 		seg.maybeDirty = true
+		seg.cfg.syncer.changed()
 		return nil
 	}
 
-	if err := seg.file.Sync(); err != nil {
-		return errors.Wrap(err, "unable to sync file changes in _sync method.")
+	if err := seg.syncFile(ctx); err != nil {
+		// The changes may not be on disk
+		seg.maybeDirty = true
+		return diskError(err, "unable to sync file changes in _sync method.")
 	}
 	seg.syncCount++
+	seg.cfg.synced()
 	seg.maybeDirty = false
 	return nil
 }
 
+// syncFile syncs the segment file, with ctx if the file implements
+// ContextSyncer.  With the SyncTimeout option, ErrSyncTimeout is returned if
+// the sync takes longer, though it carries on in the background.
+func (seg *qSegment) syncFile(ctx context.Context) error {
+	f := seg.file
+	sync := func() error {
+		if cs, ok := f.(ContextSyncer); ok {
+			return cs.SyncContext(ctx)
+		}
+		return f.Sync()
+	}
+	timeout := seg.cfg.syncTimeout
+	if timeout <= 0 {
+		return sync()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sync() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errors.Wrapf(ErrSyncTimeout, "%s was not synced within %s", seg.fileName(), timeout)
+	}
+}
+
 // close is used when this is the last segment, but is now full, so we are
 // creating a new last segment.
 // This should only be called if this segment is not also the first segment.
@@ -368,46 +1049,93 @@ func (seg *qSegment) close() error {
 		return errors.Wrapf(err, "unable to close segment file %s.", seg.fileName())
 	}
 
+	// Give back the disk reserved beyond the end of the file
+	if seg.preallocated {
+		seg.preallocated = false
+		if err := seg.cfg.fs().Truncate(seg.filePath(), seg.fileBytes); err != nil {
+			return errors.Wrapf(err, "unable to release the space preallocated for %s.", seg.fileName())
+		}
+	}
+
 	return nil
 }
 
 // newQueueSegment creates a new, persistent  segment of the queue
-func newQueueSegment(dirPath string, number int, turbo bool, builder func() interface{}) (*qSegment, error) {
+func newQueueSegment(dirPath string, number int, turbo bool, builder func() interface{}, cfg *config) (*qSegment, error) {
 
-	seg := qSegment{dirPath: dirPath, number: number, turbo: turbo, objectBuilder: builder}
+	seg := qSegment{dirPath: dirPath, number: number, turbo: turbo, objectBuilder: builder, header: newSegmentHeader(cfg), cfg: cfg}
 
-	if !dirExists(seg.dirPath) {
+	// A file with a larger number would be skipped when the queue is loaded
+	if number > maxSegmentNumber {
+		return nil, errors.Errorf("segment number %d is larger than the maximum of %d", number, maxSegmentNumber)
+	}
+
+	if !dirExists(cfg.fs(), seg.dirPath) {
 		return nil, errors.New("dirPath is not a valid directory: " + seg.dirPath)
 	}
 
-	if fileExists(seg.filePath()) {
+	if fileExists(cfg.fs(), seg.filePath()) {
 		return nil, errors.New("file already exists: " + seg.filePath())
 	}
 
 	// Create the file in append mode
 	var err error
-	seg.file, err = os.OpenFile(seg.filePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	seg.file, err = seg.cfg.openSegmentFile(seg.filePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, cfg.filePerm())
 	if err != nil {
-		return nil, errors.Wrapf(err, "error creating file: %s.", seg.filePath())
+		return nil, diskError(err, fmt.Sprintf("error creating file: %s.", seg.filePath()))
 	}
+	if cfg.preallocate > 0 {
+		err := withFile(seg.file, func(f File) error {
+			var err error
+			seg.preallocated, err = preallocate(f, cfg.preallocate)
+			return err
+		})
+		if err != nil {
+			cfg.logf("dque: unable to preallocate %s: %s", seg.filePath(), err)
+		}
+	}
+
+	// Make the new file itself durable unless turbo is on
+	if !turbo {
+		if err := syncDir(cfg.fs(), dirPath); err != nil {
+			seg.file.Close()
+			return nil, err
+		}
+	}
+
+	// The header is written with the first item, which saves a write for
+	// every segment.  openQueueSegment adds it to a file left empty.
+	seg.headerPending = true
 	// Leave the file open for future writes
 
 	return &seg, nil
 }
 
 // openQueueSegment reads an existing persistent segment of the queue into memory
-func openQueueSegment(dirPath string, number int, turbo bool, builder func() interface{}) (*qSegment, error) {
+func openQueueSegment(dirPath string, number int, turbo bool, builder func() interface{}, cfg *config) (*qSegment, error) {
 
-	seg := qSegment{dirPath: dirPath, number: number, turbo: turbo, objectBuilder: builder}
+	seg := qSegment{dirPath: dirPath, number: number, turbo: turbo, objectBuilder: builder, cfg: cfg}
 
-	if !dirExists(seg.dirPath) {
+	if !dirExists(cfg.fs(), seg.dirPath) {
 		return nil, errors.New("dirPath is not a valid directory: " + seg.dirPath)
 	}
 
-	if !fileExists(seg.filePath()) {
+	if !fileExists(cfg.fs(), seg.filePath()) {
 		return nil, errors.New("file does not exist: " + seg.filePath())
 	}
 
+	if cfg.readOnly {
+		return openReadOnlySegment(&seg)
+	}
+
+	// The header is written along with the first item, so a segment that
+	// never had one is an empty file.  Give it its header.
+	if fileSize(seg.cfg.fs(), seg.filePath()) == 0 {
+		if err := writeFileSync(cfg.fs(), seg.filePath(), newSegmentHeader(cfg).bytes(), cfg.filePerm()); err != nil {
+			return nil, err
+		}
+	}
+
 	// Load the items into memory
 	if err := seg.load(); err != nil {
 		return nil, errors.Wrap(err, "unable to load queue segment in "+dirPath)
@@ -415,11 +1143,127 @@ func openQueueSegment(dirPath string, number int, turbo bool, builder func() int
 
 	// Re-open the file in append mode
 	var err error
-	seg.file, err = os.OpenFile(seg.filePath(), os.O_APPEND|os.O_WRONLY, 0644)
+	seg.file, err = seg.cfg.openSegmentFile(seg.filePath(), os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, errors.Wrap(err, "error opening file: "+seg.filePath())
 	}
 	// Leave the file open for future writes
 
+	if err := seg.skipPoison(); err != nil {
+		seg.file.Close()
+		return nil, errors.Wrap(err, "unable to load queue segment in "+dirPath)
+	}
+
 	return &seg, nil
 }
+
+// openReadOnlySegment loads a segment of a queue opened with OpenReadOnly.
+// The file is never written to.
+func openReadOnlySegment(seg *qSegment) (*qSegment, error) {
+	if fileSize(seg.cfg.fs(), seg.filePath()) == 0 {
+		// A new segment that doesn't have its header yet
+		seg.header = newSegmentHeader(seg.cfg)
+	} else if err := seg.load(); err != nil {
+		return nil, errors.Wrap(err, "unable to load queue segment in "+seg.dirPath)
+	}
+
+	var err error
+	seg.file, err = seg.cfg.openSegmentFile(seg.filePath(), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening file: "+seg.filePath())
+	}
+	if err := seg.skipPoison(); err != nil {
+		seg.file.Close()
+		return nil, errors.Wrap(err, "unable to load queue segment in "+seg.dirPath)
+	}
+	return seg, nil
+}
+
+// poisonRecord stands in for a record that could not be decoded while the
+// segment is loaded.
+type poisonRecord struct {
+	raw []byte
+	err error
+}
+
+// skipPoison passes the undecodable records still queued in the segment to
+// the OnPoison option and rewrites the segment without the ones it skips.
+// The error of the first record it doesn't skip is returned.
+func (seg *qSegment) skipPoison() error {
+	kept := make([]interface{}, 0, len(seg.objects))
+	for _, object := range seg.objects {
+		if poison, ok := object.(*poisonRecord); ok {
+			if !seg.cfg.onPoison(poison.raw, poison.err) {
+				return poison.err
+			}
+			continue
+		}
+		kept = append(kept, object)
+	}
+	if len(kept) == len(seg.objects) {
+		return nil
+	}
+
+	seg.cfg.logf("dque: skipped %d undecodable items in %s", len(seg.objects)-len(kept), seg.filePath())
+	if seg.cfg.readOnly {
+		seg.objects = kept
+		return nil
+	}
+	return seg.rewrite(kept)
+}
+
+// wrap returns the object as it is kept in memory: in an envelope if the
+// segment has them and out of one if it doesn't.
+func (seg *qSegment) wrap(object interface{}) interface{} {
+	if seg.header.envelope {
+		env := wrap(object, seg.cfg.now())
+		if env.tag == "" && seg.cfg.tags != nil {
+			// Items of a multi-type queue are tagged however they got here
+			env.tag = seg.cfg.tags[reflect.TypeOf(env.obj)]
+		}
+		return env
+	}
+	return unwrap(object)
+}
+
+// item returns an object of the segment as it is handed to the caller: out
+// of its envelope, and decoded if it was enqueued with EnqueueRaw.
+func (seg *qSegment) item(object interface{}) (interface{}, error) {
+	object, err := seg.resolve(object)
+	if err != nil {
+		return nil, err
+	}
+	object = unwrap(object)
+	if raw, ok := object.(*rawItem); ok {
+		return seg.decodeEncoded(raw.data)
+	}
+	return object, nil
+}
+
+// raw returns an object of the segment as its encoded bytes, which are
+// kept as they were given to EnqueueRaw.
+func (seg *qSegment) raw(object interface{}) (interface{}, error) {
+	object, err := seg.resolve(object)
+	if err != nil {
+		return nil, err
+	}
+	return seg.encodeItem(new(bytes.Buffer), unwrap(object))
+}
+
+// firstEnqueuedAt returns when the first item in the segment was enqueued.
+// False is returned if the segment is empty or doesn't record the time.
+func (seg *qSegment) firstEnqueuedAt() (int64, bool) {
+
+	// This is heavy-handed but its safe
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+
+	if len(seg.objects) == 0 {
+		return 0, false
+	}
+	env, ok := seg.objects[0].(*envelope)
+	if !ok {
+		return 0, false
+	}
+	return env.enqueuedAt, true
+}
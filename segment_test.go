@@ -6,10 +6,12 @@ package dque
 //
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -33,7 +35,7 @@ func TestSegment(t *testing.T) {
 	}
 
 	// Create a new segment of the queue
-	seg, err := newQueueSegment(testDir, 1, false, item1Builder)
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{})
 	if err != nil {
 		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
 	}
@@ -63,7 +65,7 @@ func TestSegment(t *testing.T) {
 	//
 	// Recreate the segment from disk and remove the remaining item
 	//
-	seg, err = openQueueSegment(testDir, 1, false, item1Builder)
+	seg, err = openQueueSegment(testDir, 1, false, item1Builder, &config{})
 	if err != nil {
 		t.Fatalf("openQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
 	}
@@ -93,18 +95,22 @@ func TestSegment_ErrCorruptedSegment(t *testing.T) {
 		t.Fatalf("Error creating directory in the TestSegment_ErrCorruptedSegment method: %s\n", err)
 	}
 
-	f, err := os.Create((&qSegment{dirPath: testDir}).filePath())
+	f, err := os.Create(filepath.Join(testDir, (&config{}).segmentFileName(0)))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// expect an 8 byte object, but only write 7 bytes
-	if _, err := f.Write([]byte{0, 0, 0, 8, 1, 2, 3, 4, 5, 6, 7}); err != nil {
+	if _, err := f.Write(newSegmentHeader(&config{}).bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// write a deletion record without an object to delete
+	if _, err := f.Write([]byte{0, 0, 0, 0}); err != nil {
 		t.Fatal(err)
 	}
 	f.Close()
 
-	_, err = openQueueSegment(testDir, 0, false, func() interface{} { return make([]byte, 8) })
+	_, err = openQueueSegment(testDir, 0, false, func() interface{} { return make([]byte, 8) }, &config{})
 	if err == nil {
 		t.Fatal("expected ErrCorruptedSegment but got nil")
 	}
@@ -120,16 +126,222 @@ func TestSegment_ErrCorruptedSegment(t *testing.T) {
 	if corruptedError.Path != "TestSegmentError/0000000000000.dque" {
 		t.Fatalf("unexpected file path: %s", corruptedError.Path)
 	}
-	if corruptedError.Error() != "segment file TestSegmentError/0000000000000.dque is corrupted: error reading gob data from file: unexpected EOF" {
+	if corruptedError.Offset != segmentHeaderSize {
+		t.Fatalf("unexpected offset: %d", corruptedError.Offset)
+	}
+	if corruptedError.Error() != "segment file TestSegmentError/0000000000000.dque is corrupted at byte 16: excess deletion records (1)" {
 		t.Fatalf("wrong error message: %s", corruptedError.Error())
 	}
 }
 
+// TestSegment_TruncatedRecord tests that a partial record left by a crash is truncated
+func TestSegment_TruncatedRecord(t *testing.T) {
+	testDir := "./TestSegmentTruncated"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory in the TestSegment_TruncatedRecord method: %s\n", err)
+	}
+
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, seg.add(&item1{Name: "Number 1"}) == nil, "failed to add item1")
+	seg.close()
+	validSize := fileSize(osStorage{}, seg.filePath())
+	want := 1
+
+	for _, partial := range [][]byte{
+		{40},                   // part of a length
+		{40, 0, 0, 0, 1, 2, 3}, // a length and part of an object
+	} {
+		f, err := os.OpenFile(seg.filePath(), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(partial); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		seg, err = openQueueSegment(testDir, 1, false, item1Builder, &config{})
+		if err != nil {
+			t.Fatalf("openQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+		}
+		assert(t, want == seg.size(), "Expected %d items but got %d", want, seg.size())
+		assert(t, validSize == fileSize(osStorage{}, seg.filePath()), "Expected the file to be truncated to %d bytes but it is %d", validSize, fileSize(osStorage{}, seg.filePath()))
+
+		// New items must follow the last complete record
+		assert(t, seg.add(&item1{Name: "Another"}) == nil, "failed to add item")
+		seg.close()
+		want++
+		seg, err = openQueueSegment(testDir, 1, false, item1Builder, &config{})
+		if err != nil {
+			t.Fatalf("openQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+		}
+		assert(t, want == seg.size(), "Expected %d items but got %d", want, seg.size())
+		seg.close()
+		validSize = fileSize(osStorage{}, seg.filePath())
+	}
+}
+
 func unwrapError(err error) error {
 	return err.(interface{ Unwrap() error }).Unwrap()
 }
 
 // TestSegment_Open verifies the behavior of the openSegment function.
+// Deleting a segment whose file is already gone must succeed
+func TestSegment_DeleteMissingFile(t *testing.T) {
+	testDir := "./TestSegmentDeleteMissing"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory in the TestSegment_DeleteMissingFile method: %s\n", err)
+	}
+
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, seg.add(&item1{Name: "Number 1"}) == nil, "failed to add item1")
+
+	if err := os.Remove(seg.filePath()); err != nil {
+		t.Fatal(err)
+	}
+	err = seg.delete()
+	assert(t, err == nil, "Expected deleting a missing file to succeed but got %v", err)
+	assert(t, 0 == seg.size(), "Expected an empty segment but got %d items", seg.size())
+}
+
+// failingFile writes only the first few bytes given to it before failing,
+// as a file on a failing disk may
+type failingFile struct {
+	File
+	room int
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if len(p) > f.room {
+		n, _ := f.File.Write(p[:f.room])
+		f.room = 0
+		return n, errors.New("write failed")
+	}
+	f.room -= len(p)
+	return f.File.Write(p)
+}
+
+// TestSegment_ReleaseRemoved verifies that removed items are not kept
+// reachable by the segment.
+func TestSegment_ReleaseRemoved(t *testing.T) {
+	testDir := "./TestSegmentReleaseRemoved"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory in the TestSegment_ReleaseRemoved method: %s\n", err)
+	}
+
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, seg.add(&item1{Name: "Number 1"}) == nil, "failed to add item1")
+	assert(t, seg.add(&item1{Name: "Number 2"}) == nil, "failed to add item2")
+
+	objects := seg.objects
+	if _, err := seg.remove(); err != nil {
+		t.Fatal("Error removing item1:", err)
+	}
+	assert(t, nil == objects[0], "Expected the removed item to be released")
+	assert(t, 1 == seg.size(), "Expected size of 1 but got %d", seg.size())
+	assert(t, seg.close() == nil, "failed to close the segment")
+}
+
+// TestSegment_FailedWrite verifies that a write that fails part way through
+// leaves neither a partial record on disk nor a change in memory.
+func TestSegment_FailedWrite(t *testing.T) {
+	testDir := "./TestSegmentFailedWrite"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory in the TestSegment_FailedWrite method: %s\n", err)
+	}
+
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, seg.add(&item1{Name: "Number 1"}) == nil, "failed to add item1")
+	before, err := os.Stat(seg.filePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := seg.file
+	seg.file = &failingFile{File: file, room: 6}
+	assert(t, seg.add(&item1{Name: "Number 2"}) != nil, "Expected adding item2 to fail")
+	assert(t, 1 == seg.size(), "Expected size of 1 but got %d", seg.size())
+	seg.file = &failingFile{File: file, room: 2}
+	_, err = seg.remove()
+	assert(t, err != nil, "Expected removing item1 to fail")
+	assert(t, 1 == seg.size(), "Expected size of 1 but got %d", seg.size())
+
+	after, err := os.Stat(seg.filePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, before.Size() == after.Size(), "Expected the file to stay %d bytes but it is %d", before.Size(), after.Size())
+
+	// The segment keeps working once writes succeed again
+	seg.file = file
+	assert(t, seg.add(&item1{Name: "Number 3"}) == nil, "failed to add item3")
+	seg.close()
+
+	seg, err = openQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("openQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	defer seg.close()
+	assert(t, 2 == seg.size(), "Expected size of 2 but got %d", seg.size())
+	for _, name := range []string{"Number 1", "Number 3"} {
+		obj, err := seg.remove()
+		if err != nil {
+			t.Fatal("Remove() failed:", err)
+		}
+		assert(t, name == obj.(*item1).Name, "Expected %s but got %s", name, obj.(*item1).Name)
+	}
+}
+
+// TestSegment_RecordTooLarge verifies that an item too large for its length
+// prefix is rejected rather than written with a truncated length.
+func TestSegment_RecordTooLarge(t *testing.T) {
+	testDir := "./TestSegmentRecordTooLarge"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory in the TestSegment_RecordTooLarge method: %s\n", err)
+	}
+
+	defer func(size uint64) { maxRecordSize = size }(maxRecordSize)
+	maxRecordSize = 100
+
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	defer seg.close()
+	assert(t, seg.add(&item1{Name: "small"}) == nil, "failed to add a small item")
+	err = seg.add(&item1{Name: strings.Repeat("x", 200)})
+	assert(t, err != nil, "Expected adding a large item to fail")
+	assert(t, 1 == seg.size(), "Expected size of 1 but got %d", seg.size())
+	assert(t, fileSize(seg.cfg.fs(), seg.filePath()) == seg.fileBytes, "Expected nothing to be written for the large item")
+}
+
 func TestSegment_openQueueSegment_failIfNew(t *testing.T) {
 	testDir := "./TestSegment_Open"
 	os.RemoveAll(testDir)
@@ -137,7 +349,7 @@ func TestSegment_openQueueSegment_failIfNew(t *testing.T) {
 		t.Fatalf("Error creating directory in the TestSegment_Open method: %s\n", err)
 	}
 
-	seg, err := openQueueSegment(testDir, 1, false, item1Builder)
+	seg, err := openQueueSegment(testDir, 1, false, item1Builder, &config{})
 	if err == nil {
 		t.Fatalf("openQueueSegment('%s') should have failed because it should be new\n", testDir)
 	}
@@ -157,7 +369,7 @@ func TestSegment_Turbo(t *testing.T) {
 		t.Fatalf("Error creating directory in the TestSegment_Turbo method: %s\n", err)
 	}
 
-	seg, err := newQueueSegment(testDir, 10, false, item1Builder)
+	seg, err := newQueueSegment(testDir, 10, false, item1Builder, &config{})
 	if err != nil {
 		t.Fatalf("newQueueSegment('%s') failed\n", testDir)
 	}
@@ -194,6 +406,41 @@ func TestSegment_Turbo(t *testing.T) {
 	}
 }
 
+// TestSegment_Compression verifies that compressed items survive a reload.
+func TestSegment_Compression(t *testing.T) {
+	testDir := "./TestSegment_Compression"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	if err := os.Mkdir(testDir, 0755); err != nil {
+		t.Fatalf("Error creating directory in the TestSegment_Compression method: %s\n", err)
+	}
+
+	seg, err := newQueueSegment(testDir, 1, false, item1Builder, &config{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("newQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, seg.add(&item1{Name: "Number 1"}) == nil, "failed to add item1")
+	assert(t, seg.add(&item1{Name: "Number 2"}) == nil, "failed to add item2")
+	_, err = seg.remove()
+	if err != nil {
+		t.Fatalf("Remove() failed with '%s'\n", err.Error())
+	}
+	assert(t, seg.close() == nil, "failed to close segment")
+
+	seg, err = openQueueSegment(testDir, 1, false, item1Builder, &config{})
+	if err != nil {
+		t.Fatalf("openQueueSegment('%s') failed with '%s'\n", testDir, err.Error())
+	}
+	assert(t, CompressionGzip == seg.header.compression, "Expected the header to record gzip compression")
+	assert(t, 1 == seg.size(), "Expected size of 1")
+	obj, err := seg.peek()
+	if err != nil {
+		t.Fatalf("peek() failed with '%s'\n", err.Error())
+	}
+	assert(t, "Number 2" == obj.(*item1).Name, "Unexpected item %#v", obj)
+	assert(t, seg.close() == nil, "failed to close segment")
+}
+
 // assert fails the test if the condition is false.
 func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
 	if !condition {
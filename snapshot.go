@@ -0,0 +1,113 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot copies the queue to a directory named after it inside destDir,
+// so the copy can be opened with Open(q.Name, destDir, ...).  Segment files,
+// in-flight items, and cursors are copied.  Every change is synced to disk
+// first, and enqueues and dequeues wait until the copy is done, so it holds
+// the queue exactly as it was when Snapshot was called.
+//
+// An error is returned if destDir already holds a queue of the same name.
+// The copy is left incomplete if Snapshot fails part way through.
+func (q *DQue) Snapshot(destDir string) error {
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+
+	fs := q.config.fs()
+	destPath := path.Join(destDir, q.Name)
+	if _, err := fs.Stat(destPath); err == nil {
+		return errors.New("the snapshot destination already exists (" + destPath + ")")
+	}
+
+	if err := q.firstSegment.flush(); err != nil {
+		return errors.Wrap(err, "unable to sync changes to disk")
+	}
+	if err := q.lastSegment.flush(); err != nil {
+		return errors.Wrap(err, "unable to sync changes to disk")
+	}
+
+	if err := fs.Mkdir(destPath, q.config.dirPerm()); err != nil {
+		return errors.Wrap(err, "error creating "+destPath)
+	}
+	numbers, err := listSegmentNumbers(fs, q.fullPath, q.config.segmentPattern(), q.config.logf)
+	if err != nil {
+		return err
+	}
+	for _, num := range numbers {
+		name := q.config.segmentFileName(num)
+		if err := copyFile(fs, path.Join(q.fullPath, name), path.Join(destPath, name), q.config.filePerm()); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{inflightDir, cursorDir} {
+		if err := q.copyDir(path.Join(q.fullPath, dir), path.Join(destPath, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir copies the files of a directory of the queue, if it exists.
+func (q *DQue) copyDir(srcPath, destPath string) error {
+	fs := q.config.fs()
+	if !dirExists(fs, srcPath) {
+		return nil
+	}
+	files, err := fs.ReadDir(srcPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to read files in "+srcPath)
+	}
+	if err := fs.Mkdir(destPath, q.config.dirPerm()); err != nil {
+		return errors.Wrap(err, "error creating "+destPath)
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := copyFile(fs, path.Join(srcPath, f.Name()), path.Join(destPath, f.Name()), q.config.filePerm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file and syncs the copy to disk.
+func copyFile(fs Storage, srcPath, destPath string, perm os.FileMode) error {
+	src, err := fs.OpenFile(srcPath, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "error opening "+srcPath)
+	}
+	defer src.Close()
+
+	dest, err := fs.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Wrap(err, "error creating "+destPath)
+	}
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+		return errors.Wrap(err, "error copying "+srcPath)
+	}
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		return errors.Wrap(err, "error syncing "+destPath)
+	}
+	return dest.Close()
+}
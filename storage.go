@@ -0,0 +1,140 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// Storage is where a queue keeps its files.  It defaults to the local
+// filesystem, but can be replaced, for example with an in-memory
+// implementation for tests.  Names are slash-separated paths built with
+// path.Join.
+//
+// Durability depends on File.Sync: once it returns, what was written must
+// survive a crash.
+type Storage interface {
+	// OpenFile opens the named file like os.OpenFile.  Only the O_RDONLY,
+	// O_WRONLY, O_APPEND, O_CREATE, and O_TRUNC flags are used.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Stat returns a FileInfo describing the named file or directory.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the named directory sorted by name.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	// Mkdir creates the named directory.
+	Mkdir(name string, perm os.FileMode) error
+	// Remove removes the named file.  An error satisfying os.IsNotExist must
+	// be returned if there is no such file.
+	Remove(name string) error
+	// Rename replaces newpath with oldpath.
+	Rename(oldpath, newpath string) error
+	// Truncate changes the size of the named file.
+	Truncate(name string, size int64) error
+	// Lock takes an exclusive lock named by the given path, which is never
+	// otherwise opened.  ErrQueueLocked is returned if the lock is held.
+	// Closing the returned value releases the lock.
+	Lock(name string) (io.Closer, error)
+}
+
+// File is a file opened by a Storage.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// ContextSyncer may be implemented by a File whose Sync can give up when a
+// context is done, such as one backed by a network filesystem.
+// DQue.EnqueueContext uses it in place of Sync.  A SyncContext that gives
+// up must return an error, as the item may not be on disk.
+type ContextSyncer interface {
+	SyncContext(ctx context.Context) error
+}
+
+// osStorage keeps files on the local filesystem.
+type osStorage struct{}
+
+func (osStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Don't return a non-nil File holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osStorage) Stat(name string) (os.FileInfo, error)         { return os.Stat(name) }
+func (osStorage) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
+func (osStorage) Mkdir(name string, perm os.FileMode) error     { return os.Mkdir(name, perm) }
+func (osStorage) Remove(name string) error                      { return os.Remove(name) }
+func (osStorage) Rename(oldpath, newpath string) error          { return os.Rename(oldpath, newpath) }
+func (osStorage) Truncate(name string, size int64) error        { return os.Truncate(name, size) }
+
+// Lock takes an advisory lock on the named file so that two processes can't
+// open the same queue.
+func (osStorage) Lock(name string) (io.Closer, error) {
+	fileLock := flock.New(name)
+
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		return nil, errors.Wrap(err, "error locking "+name)
+	}
+	if !locked {
+		return nil, errors.Wrap(ErrQueueLocked, "unable to lock "+name)
+	}
+	return fileLock, nil
+}
+
+// readFile reads the whole named file from the storage.
+func readFile(fs Storage, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// syncDir fsyncs a directory, which makes the files created in it, removed
+// from it, and renamed within it survive a crash.  Windows can't sync a
+// directory and doesn't need to.
+func syncDir(fs Storage, dirPath string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := fs.OpenFile(dirPath, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "unable to open directory "+dirPath)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync directory "+dirPath)
+	}
+	return nil
+}
+
+// mkdirIfMissing creates the named directory unless it already exists.
+func mkdirIfMissing(fs Storage, name string, perm os.FileMode) error {
+	if dirExists(fs, name) {
+		return nil
+	}
+	return fs.Mkdir(name, perm)
+}
+
+// nopLock is the lock of a queue that doesn't take one.
+type nopLock struct{}
+
+func (nopLock) Close() error { return nil }
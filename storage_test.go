@@ -0,0 +1,1132 @@
+package dque_test
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/joncrlsn/dque"
+)
+
+// memStorage is a dque.Storage that keeps everything in memory
+type memStorage struct {
+	mutex sync.Mutex
+	files map[string]*memEntry
+	locks map[string]bool
+}
+
+type memEntry struct {
+	data  []byte
+	mode  os.FileMode
+	isDir bool
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: map[string]*memEntry{"/": {isDir: true, mode: os.ModeDir | 0755}}, locks: map[string]bool{}}
+}
+
+func (m *memStorage) notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, m.notExist("open", name)
+		}
+		e = &memEntry{mode: perm}
+		m.files[name] = e
+	}
+	if flag&os.O_TRUNC != 0 {
+		e.data = nil
+	}
+	return &memFile{m: m, name: name, entry: e, appendOnly: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *memStorage) Stat(name string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.files[name]
+	if !ok {
+		return nil, m.notExist("stat", name)
+	}
+	return memInfo{name: path.Base(name), entry: e}, nil
+}
+
+func (m *memStorage) ReadDir(dirname string) ([]os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var infos []os.FileInfo
+	for name, e := range m.files {
+		if name != dirname && path.Dir(name) == dirname {
+			infos = append(infos, memInfo{name: path.Base(name), entry: e})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *memStorage) Mkdir(name string, perm os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	m.files[name] = &memEntry{isDir: true, mode: os.ModeDir | perm}
+	return nil
+}
+
+func (m *memStorage) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return m.notExist("remove", name)
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memStorage) Rename(oldpath, newpath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.files[oldpath]
+	if !ok {
+		return m.notExist("rename", oldpath)
+	}
+	m.files[newpath] = e
+	delete(m.files, oldpath)
+	return nil
+}
+
+func (m *memStorage) Truncate(name string, size int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.files[name]
+	if !ok {
+		return m.notExist("truncate", name)
+	}
+	e.data = e.data[:size]
+	return nil
+}
+
+func (m *memStorage) Lock(name string) (io.Closer, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.locks[name] {
+		return nil, dque.ErrQueueLocked
+	}
+	m.locks[name] = true
+	return memLock{m: m, name: name}, nil
+}
+
+type memLock struct {
+	m    *memStorage
+	name string
+}
+
+func (l memLock) Close() error {
+	l.m.mutex.Lock()
+	defer l.m.mutex.Unlock()
+
+	delete(l.m.locks, l.name)
+	return nil
+}
+
+// memFile is an open file of a memStorage
+type memFile struct {
+	m          *memStorage
+	name       string
+	entry      *memEntry
+	offset     int
+	appendOnly bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.m.mutex.Lock()
+	defer f.m.mutex.Unlock()
+
+	if f.offset >= len(f.entry.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.entry.data[f.offset:])
+	f.offset += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.m.mutex.Lock()
+	defer f.m.mutex.Unlock()
+
+	if f.appendOnly {
+		f.offset = len(f.entry.data)
+	}
+	data := append(f.entry.data[:f.offset:f.offset], p...)
+	if end := f.offset + len(p); end < len(f.entry.data) {
+		data = append(data, f.entry.data[end:]...)
+	}
+	f.entry.data = data
+	f.offset += len(p)
+	return len(p), nil
+}
+
+func (f *memFile) Close() error { return nil }
+func (f *memFile) Sync() error  { return nil }
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.mutex.Lock()
+	defer f.m.mutex.Unlock()
+
+	return memInfo{name: path.Base(f.name), entry: f.entry}, nil
+}
+
+// memInfo describes a file of a memStorage
+type memInfo struct {
+	name  string
+	entry *memEntry
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.entry.data)) }
+func (i memInfo) Mode() os.FileMode  { return i.entry.mode }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.entry.isDir }
+func (i memInfo) Sys() interface{}   { return nil }
+
+func TestQueue_Storage(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := dque.Options{Storage: mem}
+
+	q, err := dque.NewWithOptions("testStorage", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	if _, err := q.Dequeue(); err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+
+	// The queue is locked through the storage
+	_, err = dque.OpenWithOptions("testStorage", "/queues", 3, item2Builder, opts)
+	assert(t, err == dque.ErrQueueLocked, "Expected ErrQueueLocked but got %v", err)
+
+	// It can be inspected through the storage all the same
+	ro, err := dque.OpenReadOnlyWithOptions("testStorage", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening the queue read-only:", err)
+	}
+	objects, err := ro.PeekN(2)
+	assert(t, err == nil && 2 == len(objects) && 1 == objects[0].(*item2).Id, "Expected items 1 and 2 but got %v, %v", objects, err)
+	ro.Close()
+	q.Close()
+
+	// Nothing touches the local filesystem
+	_, err = os.Stat("/queues")
+	assert(t, os.IsNotExist(err), "Expected no directory on disk")
+	files, _ := mem.ReadDir("/queues/testStorage")
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := "0000000000001.dque 0000000000002.dque 0000000000003.dque"
+	assert(t, want == strings.Join(names, " "), "Expected files %q but got %q", want, names)
+
+	q, err = dque.OpenWithOptions("testStorage", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for i := 1; i < 7; i++ {
+		iface, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == iface.(*item2).Id, "Expected item %d but got %d", i, iface.(*item2).Id)
+	}
+	q.Close()
+}
+
+func TestPartitioned_Storage(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := dque.Options{Storage: mem, DirMode: 0700}
+	keyFn := func(obj interface{}) string {
+		if obj.(*item2).Id%2 == 0 {
+			return "even"
+		}
+		return "odd"
+	}
+
+	p, err := dque.NewPartitionedWithOptions("testPartitionedStorage", "/queues", 3, item2Builder, keyFn, opts)
+	if err != nil {
+		t.Fatal("Error creating partitioned queue:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := p.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	p.Close()
+
+	// The directories are made through the storage with the given mode
+	_, err = os.Stat("/queues")
+	assert(t, os.IsNotExist(err), "Expected no directory on disk")
+	for _, dir := range []string{"/queues/testPartitionedStorage", "/queues/testPartitionedStorage/p-even"} {
+		info, err := mem.Stat(dir)
+		if err != nil {
+			t.Fatal("Error reading directory:", err)
+		}
+		assert(t, 0700 == info.Mode().Perm(), "Expected %s to have mode 0700 but got %o", dir, info.Mode().Perm())
+	}
+
+	p, err = dque.NewPartitionedWithOptions("testPartitionedStorage", "/queues", 3, item2Builder, keyFn, opts)
+	if err != nil {
+		t.Fatal("Error opening partitioned queue:", err)
+	}
+	assert(t, "even,odd" == strings.Join(p.Partitions(), ","), "Expected partitions even and odd but got %v", p.Partitions())
+	obj, err := p.DequeuePartition("odd")
+	assert(t, err == nil && 1 == obj.(*item2).Id, "Expected item 1 but got %v, %v", obj, err)
+	p.Close()
+}
+
+// shortReadStorage returns files that never read more than a few bytes at a
+// time, as a file on a network filesystem may
+type shortReadStorage struct {
+	*memStorage
+}
+
+func (s shortReadStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.memStorage.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return shortReadFile{f}, nil
+}
+
+type shortReadFile struct {
+	dque.File
+}
+
+func (f shortReadFile) Read(p []byte) (int, error) {
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return f.File.Read(p)
+}
+
+func TestQueue_LargeItems(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := dque.Options{Codec: dque.CodecBytes, Storage: shortReadStorage{mem}}
+
+	q, err := dque.NewWithOptions("testLargeItems", "/queues", 3, nil, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	items := make([][]byte, 4)
+	for i := range items {
+		items[i] = make([]byte, 64*1024+i)
+		rand.Read(items[i])
+		if err := q.EnqueueBytes(items[i]); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// Every record is read back through many short reads
+	q, err = dque.OpenWithOptions("testLargeItems", "/queues", 3, nil, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for i := range items {
+		b, err := q.DequeueBytes()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, bytes.Equal(items[i], b), "Item %d was not read back intact", i)
+	}
+	q.Close()
+}
+
+// fullStorage returns files that run out of space once the given number of
+// bytes have been written to them, writing as much as fits
+type fullStorage struct {
+	*memStorage
+	space *int
+}
+
+func (s fullStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.memStorage.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fullFile{f, s.space}, nil
+}
+
+type fullFile struct {
+	dque.File
+	space *int
+}
+
+func (f fullFile) Write(p []byte) (int, error) {
+	if len(p) <= *f.space {
+		*f.space -= len(p)
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:*f.space])
+	*f.space = 0
+	return n, &os.PathError{Op: "write", Path: "segment", Err: syscall.ENOSPC}
+}
+
+func TestQueue_DiskFull(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	space := 1 << 20
+	opts := dque.Options{Storage: fullStorage{mem, &space}}
+
+	q, err := dque.NewWithOptions("testDiskFull", "/queues", 10, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	if err := q.Enqueue(&item2{0}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+
+	// The disk fills part way through the next record
+	space = 5
+	err = q.Enqueue(&item2{1})
+	assert(t, errors.Is(err, dque.ErrDiskFull), "Expected ErrDiskFull but got %v", err)
+	assert(t, 1 == q.Size(), "Expected 1 item but got %d", q.Size())
+
+	// Once there is space again the enqueue can be retried
+	space = 1 << 20
+	if err := q.Enqueue(&item2{2}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	q.Close()
+
+	// The partial record didn't corrupt the segment file
+	q, err = dque.OpenWithOptions("testDiskFull", "/queues", 10, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for _, id := range []int{0, 2} {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == obj.(*item2).Id, "Expected item %d but got %d", id, obj.(*item2).Id)
+	}
+	q.Close()
+}
+
+func TestQueue_PrependDiskFull(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	space := 1 << 20
+	opts := dque.Options{Storage: fullStorage{mem, &space}}
+
+	// Find the size of a segment header and of a record
+	measure, err := dque.NewWithOptions("measure", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	before := space
+	if err := measure.Enqueue(&item2{10}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	first := before - space
+	before = space
+	if err := measure.Enqueue(&item2{11}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	record := before - space
+	header := first - record
+	measure.Close()
+
+	// Leave segments 1 and 2 free before the first one
+	q, err := dque.NewWithOptions("testPrependDiskFull", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 9; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+
+	// The disk fills while the second item goes into segment 1, after
+	// segment 2 took the last three
+	space = 2*header + 4*record + 2
+	items := []interface{}{&item2{10}, &item2{11}, &item2{12}, &item2{13}, &item2{14}}
+	err = q.Prepend(items)
+	assert(t, errors.Is(err, dque.ErrDiskFull), "Expected ErrDiskFull but got %v", err)
+	space = 1 << 20
+
+	// The items that were written are counted and dequeued
+	assert(t, 7 == q.SizeUnsafe(), "Expected SizeUnsafe to count 7 items but got %d", q.SizeUnsafe())
+	for _, id := range []int{10, 12, 13, 14, 6, 7, 8} {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, id == obj.(*item2).Id, "Expected item %d but got %d", id, obj.(*item2).Id)
+	}
+	q.Close()
+}
+
+func TestBatch_Rollback(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	space := 1 << 20
+	work, err := dque.NewWithOptions("work", "/queues", 3, item2Builder, dque.Options{Storage: mem})
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	audit, err := dque.NewWithOptions("audit", "/queues", 3, item2Builder, dque.Options{Storage: fullStorage{mem, &space}})
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	if err := work.Enqueue(&item2{0}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+
+	// The audit queue runs out of space after the work queue has started
+	// new segments for the batch
+	var b dque.Batch
+	for i := 1; i <= 5; i++ {
+		b.Add(work, &item2{i})
+	}
+	b.Add(audit, &item2{1})
+	space = 0
+	err = b.Commit()
+	assert(t, errors.Is(err, dque.ErrDiskFull), "Expected ErrDiskFull but got %v", err)
+	assert(t, 6 == b.Len(), "Expected the batch to keep its 6 items but it has %d", b.Len())
+	assert(t, 1 == work.Size(), "Expected 1 item in the work queue but got %d", work.Size())
+	assert(t, 1 == work.Stats().SegmentCount, "Expected 1 segment but got %d", work.Stats().SegmentCount)
+	assert(t, 0 == audit.Size(), "Expected an empty audit queue but got %d items", audit.Size())
+
+	// Once there is space the batch can be committed
+	space = 1 << 20
+	if err := b.Commit(); err != nil {
+		t.Fatal("Error committing batch:", err)
+	}
+	assert(t, 0 == b.Len(), "Expected an empty batch but it has %d items", b.Len())
+	assert(t, 6 == work.SizeUnsafe(), "Expected 6 items in the work queue but got %d", work.SizeUnsafe())
+	assert(t, 1 == audit.SizeUnsafe(), "Expected 1 item in the audit queue but got %d", audit.SizeUnsafe())
+	work.Close()
+	audit.Close()
+
+	// The rolled back items left nothing behind on disk
+	work, err = dque.OpenWithOptions("work", "/queues", 3, item2Builder, dque.Options{Storage: mem})
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	for i := 0; i <= 5; i++ {
+		obj, err := work.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+	_, err = work.Dequeue()
+	assert(t, dque.ErrEmpty == err, "Expected ErrEmpty but got %v", err)
+	work.Close()
+}
+
+// dirSyncStorage counts the syncs of the directories of a memStorage
+type dirSyncStorage struct {
+	*memStorage
+	syncs *int
+}
+
+func (s dirSyncStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.memStorage.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return dirSyncFile{f, s.syncs}, nil
+	}
+	return f, nil
+}
+
+type dirSyncFile struct {
+	dque.File
+	syncs *int
+}
+
+func (f dirSyncFile) Sync() error {
+	*f.syncs++
+	return f.File.Sync()
+}
+
+func TestQueue_DirSync(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories aren't synced on Windows")
+	}
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var syncs int
+	opts := dque.Options{Storage: dirSyncStorage{mem, &syncs}}
+
+	q, err := dque.NewWithOptions("testDirSync", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+
+	// Creating and deleting segments syncs the directory
+	syncs = 0
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 1 == syncs, "Expected 1 directory sync for the new segment but got %d", syncs)
+	for i := 0; i < 3; i++ {
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+	}
+	assert(t, 2 == syncs, "Expected 2 directory syncs after deleting a segment but got %d", syncs)
+
+	// Turbo leaves it to the filesystem
+	if err := q.TurboOn(); err != nil {
+		t.Fatal("Error turning turbo on:", err)
+	}
+	syncs = 0
+	for i := 0; i < 6; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 0 == syncs, "Expected no directory syncs in turbo mode but got %d", syncs)
+	q.Close()
+}
+
+// ctxSyncStorage gives the files of a memStorage a SyncContext that fails
+// once its context is done
+type ctxSyncStorage struct {
+	*memStorage
+}
+
+func (s ctxSyncStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.memStorage.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return ctxSyncFile{f}, nil
+}
+
+type ctxSyncFile struct {
+	dque.File
+}
+
+func (f ctxSyncFile) SyncContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func TestQueue_EnqueueContext(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := dque.Options{Storage: ctxSyncStorage{mem}}
+	q, err := dque.NewWithOptions("testEnqueueContext", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := q.EnqueueContext(ctx, &item2{1}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	cancel()
+
+	// Nothing is done once the context is cancelled
+	err = q.EnqueueContext(ctx, &item2{2})
+	assert(t, context.Canceled == err, "Expected context.Canceled but got %v", err)
+	_, err = q.DequeueContext(ctx)
+	assert(t, context.Canceled == err, "Expected context.Canceled but got %v", err)
+	assert(t, 1 == q.Size(), "Expected 1 item but got %d", q.Size())
+
+	obj, err := q.DequeueContext(context.Background())
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 1 == obj.(*item2).Id, "Expected item 1 but got %d", obj.(*item2).Id)
+	q.Close()
+}
+
+// hangingSyncStorage makes the Sync of the files of a memStorage wait for
+// release while hang is set
+type hangingSyncStorage struct {
+	*memStorage
+	hang    *int32
+	release chan struct{}
+}
+
+func (s hangingSyncStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.memStorage.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return hangingSyncFile{f, s}, nil
+}
+
+type hangingSyncFile struct {
+	dque.File
+	s hangingSyncStorage
+}
+
+func (f hangingSyncFile) Sync() error {
+	if atomic.LoadInt32(f.s.hang) != 0 {
+		<-f.s.release
+	}
+	return f.File.Sync()
+}
+
+func TestQueue_SyncTimeout(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var hang int32
+	storage := hangingSyncStorage{mem, &hang, make(chan struct{})}
+	opts := dque.Options{Storage: storage, SyncTimeout: 20 * time.Millisecond}
+	q, err := dque.NewWithOptions("testSyncTimeout", "/queues", 4, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// A sync that hangs fails the enqueue instead of blocking it
+	atomic.StoreInt32(&hang, 1)
+	err = q.Enqueue(&item2{3})
+	assert(t, errors.Is(err, dque.ErrSyncTimeout), "Expected ErrSyncTimeout but got %v", err)
+
+	// The item was written all the same
+	assert(t, 3 == q.Size(), "Expected 3 items but got %d", q.Size())
+	assert(t, 3 == q.SizeUnsafe(), "Expected SizeUnsafe to count 3 items but got %d", q.SizeUnsafe())
+
+	// A dequeue whose sync times out has removed the item, so it hands it over
+	obj, err := q.Dequeue()
+	assert(t, errors.Is(err, dque.ErrSyncTimeout), "Expected ErrSyncTimeout but got %v", err)
+	assert(t, obj != nil && 1 == obj.(*item2).Id, "Expected item 1 but got %v", obj)
+	assert(t, 2 == q.SizeUnsafe(), "Expected SizeUnsafe to count 2 items but got %d", q.SizeUnsafe())
+
+	// An item enqueued uniquely is remembered, so a retry doesn't add it again
+	ok, err := q.EnqueueUnique("retry", &item2{4})
+	assert(t, ok && errors.Is(err, dque.ErrSyncTimeout), "Expected true and ErrSyncTimeout but got %v, %v", ok, err)
+	ok, err = q.EnqueueUnique("retry", &item2{4})
+	assert(t, !ok && err == nil, "Expected the retry to be skipped but got %v, %v", ok, err)
+	assert(t, 3 == q.SizeUnsafe(), "Expected SizeUnsafe to count 3 items but got %d", q.SizeUnsafe())
+	atomic.StoreInt32(&hang, 0)
+	close(storage.release)
+	q.Close()
+
+	// The changes are there once the queue is opened again
+	q, err = dque.OpenWithOptions("testSyncTimeout", "/queues", 4, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 3 == q.Size(), "Expected 3 items but got %d", q.Size())
+	obj, err = q.Dequeue()
+	if err != nil {
+		t.Fatal("Error dequeueing:", err)
+	}
+	assert(t, 2 == obj.(*item2).Id, "Expected item 2 but got %d", obj.(*item2).Id)
+	q.Close()
+}
+
+func TestQueue_SyncTimeoutExpired(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var hang int32
+	storage := hangingSyncStorage{mem, &hang, make(chan struct{})}
+	obs := &itemObserver{}
+	opts := dque.Options{Storage: storage, SyncTimeout: 20 * time.Millisecond, LazyDecode: true, Observer: obs}
+	q, err := dque.NewWithOptions("testSyncTimeoutExpired", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	q.Close()
+
+	// The items are left encoded when the queue is opened again
+	q, err = dque.OpenWithOptions("testSyncTimeoutExpired", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	q.SetTTL(20 * time.Millisecond)
+
+	// An expired item whose removal isn't synced is counted as expired
+	atomic.StoreInt32(&hang, 1)
+	_, err = q.Peek()
+	assert(t, errors.Is(err, dque.ErrSyncTimeout), "Expected ErrSyncTimeout but got %v", err)
+	assert(t, 1 == q.Stats().ExpiredCount, "Expected 1 expired item but got %d", q.Stats().ExpiredCount)
+	assert(t, 1 == q.SizeUnsafe(), "Expected SizeUnsafe to count 1 item but got %d", q.SizeUnsafe())
+	atomic.StoreInt32(&hang, 0)
+	close(storage.release)
+
+	_, err = q.Peek()
+	assert(t, err == dque.ErrEmpty, "Expected ErrEmpty but got %v", err)
+	assert(t, 2 == q.Stats().ExpiredCount, "Expected 2 expired items but got %d", q.Stats().ExpiredCount)
+
+	// Expired items are dropped without being decoded
+	assert(t, 0 == len(obs.decoded), "Expected no decoded items but got %d", len(obs.decoded))
+	q.Close()
+}
+
+func TestQueue_SyncTimeoutManagedFile(t *testing.T) {
+	dque.SetMaxOpenSegments(2)
+	defer dque.SetMaxOpenSegments(0)
+
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var hang int32
+	storage := hangingSyncStorage{mem, &hang, make(chan struct{})}
+	opts := dque.Options{Storage: storage, SyncTimeout: 20 * time.Millisecond, IdleTimeout: time.Minute}
+	q, err := dque.NewWithOptions("testSyncTimeoutManagedFile", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	if err := q.Enqueue(&item2{1}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+
+	atomic.StoreInt32(&hang, 1)
+	err = q.Enqueue(&item2{2})
+	assert(t, errors.Is(err, dque.ErrSyncTimeout), "Expected ErrSyncTimeout but got %v", err)
+
+	// Closing doesn't wait for the syncs still hanging in the background,
+	// though its own sync times out as well
+	closed := make(chan error, 1)
+	go func() { closed <- q.Close() }()
+	select {
+	case err := <-closed:
+		assert(t, errors.Is(err, dque.ErrSyncTimeout), "Expected ErrSyncTimeout closing but got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the hanging sync")
+	}
+	atomic.StoreInt32(&hang, 0)
+	close(storage.release)
+
+	// The file is closed once the sync returns, making room for the next
+	q, err = dque.OpenWithOptions("testSyncTimeoutManagedFile", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error opening dque:", err)
+	}
+	assert(t, 2 == q.Size(), "Expected 2 items but got %d", q.Size())
+	q.Close()
+}
+
+// inflightSyncStorage is a hangingSyncStorage whose in-flight files are
+// always synced
+type inflightSyncStorage struct {
+	hangingSyncStorage
+}
+
+func (s inflightSyncStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	if strings.Contains(name, "/inflight") {
+		return s.memStorage.OpenFile(name, flag, perm)
+	}
+	return s.hangingSyncStorage.OpenFile(name, flag, perm)
+}
+
+func TestQueue_SyncTimeoutAck(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var hang int32
+	storage := inflightSyncStorage{hangingSyncStorage{mem, &hang, make(chan struct{})}}
+	opts := dque.Options{Storage: storage, SyncTimeout: 20 * time.Millisecond}
+	q, err := dque.NewWithOptions("testSyncTimeoutAck", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// An item whose removal isn't synced is checked out all the same
+	atomic.StoreInt32(&hang, 1)
+	obj, token, err := q.DequeueWithAck()
+	assert(t, errors.Is(err, dque.ErrSyncTimeout), "Expected ErrSyncTimeout but got %v", err)
+	assert(t, obj != nil && 1 == obj.(*item2).Id, "Expected item 1 but got %v", obj)
+	assert(t, 1 == q.Size(), "Expected 1 item but got %d", q.Size())
+	atomic.StoreInt32(&hang, 0)
+	close(storage.release)
+
+	// So it can be returned with its token
+	if err := token.Nack(); err != nil {
+		t.Fatal("Error returning item:", err)
+	}
+	assert(t, 2 == q.Size(), "Expected 2 items but got %d", q.Size())
+	obj, err = q.Peek()
+	assert(t, err == nil && 1 == obj.(*item2).Id, "Expected to peek at item 1 but got %v, %v", obj, err)
+	q.Close()
+}
+
+// openCountStorage counts the segment files of a memStorage that are open
+type openCountStorage struct {
+	*memStorage
+	open *int32
+}
+
+func (s openCountStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.memStorage.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, ".dque") {
+		return f, err
+	}
+	atomic.AddInt32(s.open, 1)
+	return &openCountFile{File: f, open: s.open}, nil
+}
+
+type openCountFile struct {
+	dque.File
+	open   *int32
+	closed bool
+}
+
+func (f *openCountFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		atomic.AddInt32(f.open, -1)
+	}
+	return f.File.Close()
+}
+
+func TestQueue_IdleTimeout(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var open int32
+	opts := dque.Options{Storage: openCountStorage{mem, &open}, IdleTimeout: 100 * time.Millisecond}
+	q, err := dque.NewWithOptions("testIdleTimeout", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+	assert(t, 2 == atomic.LoadInt32(&open), "Expected the first and last segments to be open but %d files are", atomic.LoadInt32(&open))
+
+	// Both files are released once the queue is idle
+	waitFor(t, func() bool { return atomic.LoadInt32(&open) == 0 }, "the idle files to be closed")
+	assert(t, 4 == q.Size(), "Expected 4 items but got %d", q.Size())
+
+	// They are opened again as they are needed
+	if err := q.Enqueue(&item2{4}); err != nil {
+		t.Fatal("Error enqueueing:", err)
+	}
+	assert(t, 1 == atomic.LoadInt32(&open), "Expected the last segment to be reopened but %d files are open", atomic.LoadInt32(&open))
+	for i := 0; i < 5; i++ {
+		obj, err := q.Dequeue()
+		if err != nil {
+			t.Fatal("Error dequeueing:", err)
+		}
+		assert(t, i == obj.(*item2).Id, "Expected item %d but got %d", i, obj.(*item2).Id)
+	}
+
+	q.Close()
+	assert(t, 0 == atomic.LoadInt32(&open), "Expected every file to be closed but %d are open", atomic.LoadInt32(&open))
+}
+
+func TestSetMaxOpenSegments(t *testing.T) {
+	dque.SetMaxOpenSegments(2)
+	defer dque.SetMaxOpenSegments(0)
+
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var open int32
+	opts := dque.Options{Storage: openCountStorage{mem, &open}}
+	checkOpen := func() {
+		n := atomic.LoadInt32(&open)
+		assert(t, n <= 2, "Expected at most 2 open segment files but %d are", n)
+	}
+
+	// Three queues of two segments each would hold six files open
+	names := []string{"testMaxOpen1", "testMaxOpen2", "testMaxOpen3"}
+	queues := make([]*dque.DQue, len(names))
+	for i, name := range names {
+		q, err := dque.NewWithOptions(name, "/queues", 3, item2Builder, opts)
+		if err != nil {
+			t.Fatal("Error creating dque:", err)
+		}
+		queues[i] = q
+		checkOpen()
+	}
+	for id := 0; id < 5; id++ {
+		for _, q := range queues {
+			if err := q.Enqueue(&item2{id}); err != nil {
+				t.Fatal("Error enqueueing:", err)
+			}
+			checkOpen()
+		}
+	}
+	for _, q := range queues {
+		if err := q.Close(); err != nil {
+			t.Fatal("Error closing dque:", err)
+		}
+	}
+	assert(t, 0 == atomic.LoadInt32(&open), "Expected every file to be closed but %d are open", atomic.LoadInt32(&open))
+
+	// Segments are loaded and dequeued from correctly when their files are
+	// closed to make room for others
+	dque.SetMaxOpenSegments(1)
+	for i, name := range names {
+		q, err := dque.OpenWithOptions(name, "/queues", 3, item2Builder, opts)
+		if err != nil {
+			t.Fatal("Error opening dque:", err)
+		}
+		queues[i] = q
+	}
+	for id := 0; id < 5; id++ {
+		for _, q := range queues {
+			obj, err := q.Dequeue()
+			if err != nil {
+				t.Fatal("Error dequeueing:", err)
+			}
+			assert(t, id == obj.(*item2).Id, "Expected item %d but got %d", id, obj.(*item2).Id)
+			assert(t, atomic.LoadInt32(&open) <= 1, "Expected at most 1 open segment file but %d are", atomic.LoadInt32(&open))
+		}
+	}
+	for _, q := range queues {
+		q.Close()
+	}
+}
+
+// waitFor waits up to two seconds for cond to be true
+func waitFor(t *testing.T, cond func() bool, what string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// closeFailStorage makes closing the segment files of an openCountStorage
+// fail after they are closed
+type closeFailStorage struct {
+	openCountStorage
+}
+
+func (s closeFailStorage) OpenFile(name string, flag int, perm os.FileMode) (dque.File, error) {
+	f, err := s.openCountStorage.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, ".dque") {
+		return f, err
+	}
+	return closeFailFile{f}, nil
+}
+
+type closeFailFile struct {
+	dque.File
+}
+
+func (f closeFailFile) Close() error {
+	f.File.Close()
+	return errors.New("close failed")
+}
+
+func TestQueue_CloseErrors(t *testing.T) {
+	mem := newMemStorage()
+	if err := mem.Mkdir("/queues", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var open int32
+	opts := dque.Options{Storage: closeFailStorage{openCountStorage{mem, &open}}}
+	q, err := dque.NewWithOptions("testCloseErrors", "/queues", 3, item2Builder, opts)
+	if err != nil {
+		t.Fatal("Error creating dque:", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Enqueue(&item2{i}); err != nil {
+			t.Fatal("Error enqueueing:", err)
+		}
+	}
+
+	// Both segment files are closed, and the failure of each is reported
+	err = q.Close()
+	assert(t, err != nil && strings.HasPrefix(err.Error(), "2 errors:"), "Expected both failures to be reported but got %v", err)
+	assert(t, 0 == atomic.LoadInt32(&open), "Expected every file to be closed but %d are open", atomic.LoadInt32(&open))
+	assert(t, q.IsClosed(), "Expected the queue to be closed")
+	assert(t, errors.Is(q.Close(), dque.ErrQueueClosed), "Expected ErrQueueClosed closing the queue again")
+}
@@ -0,0 +1,114 @@
+package dque
+
+//
+// Copyright (c) 2018 Jon Carlson.  All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// turboSyncer syncs the changes made in turbo mode to disk from a background
+// goroutine, at a regular interval and after a number of unsynced changes.
+type turboSyncer struct {
+	maxOps int32
+	ops    int32         // changes since the last sync, updated atomically
+	kick   chan struct{} // asks for a sync before the next tick
+	done   chan struct{} // closed to stop the goroutine
+}
+
+// TurboInterval turns turbo on and syncs the changes to disk from a
+// background goroutine every d, and also after every maxOps enqueues and
+// dequeues if maxOps is greater than zero.  This bounds how much is lost on a
+// power-loss without paying for a sync on every change.  The goroutine is
+// stopped by TurboOff and Close.
+func (q *DQue) TurboInterval(d time.Duration, maxOps int) error {
+	if d <= 0 {
+		return errors.New("DQue.TurboInterval() requires a positive interval")
+	}
+
+	// This is heavy-handed but it is safe
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.fileLock == nil {
+		return ErrQueueClosed
+	}
+
+	if !q.turbo {
+		q.turbo = true
+		q.firstSegment.turboOn()
+		q.lastSegment.turboOn()
+	}
+
+	q.stopTurboSyncer()
+	s := &turboSyncer{
+		maxOps: int32(maxOps),
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	q.config.syncer = s
+	go q.runTurboSyncer(s, d)
+	return nil
+}
+
+// stopTurboSyncer stops the background syncing started by TurboInterval.
+// Both locks must be held.
+func (q *DQue) stopTurboSyncer() {
+	if q.config.syncer != nil {
+		close(q.config.syncer.done)
+		q.config.syncer = nil
+	}
+}
+
+func (q *DQue) runTurboSyncer(s *turboSyncer, d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+		if err := q.turboSyncFrom(s); err != nil {
+			q.config.logf("dque: unable to sync %s: %s", q.fullPath, err)
+		}
+	}
+}
+
+// turboSyncFrom syncs the queue unless the syncer has been stopped while it
+// waited for the locks.
+func (q *DQue) turboSyncFrom(s *turboSyncer) error {
+	q.lockAll()
+	defer q.unlockAll()
+
+	if q.config.syncer != s {
+		return nil
+	}
+	atomic.StoreInt32(&s.ops, 0)
+	if err := q.firstSegment.turboSync(); err != nil {
+		return err
+	}
+	return q.lastSegment.turboSync()
+}
+
+// changed counts a change that was not synced and asks for a sync once
+// there are maxOps of them.  It does nothing on a nil syncer.
+func (s *turboSyncer) changed() {
+	if s == nil || s.maxOps <= 0 {
+		return
+	}
+	if atomic.AddInt32(&s.ops, 1) >= s.maxOps {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+}
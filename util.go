@@ -1,12 +1,16 @@
 package dque
 
 import (
-	"os"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 // dirExists returns true or false
-func dirExists(path string) bool {
-	fileInfo, err := os.Stat(path)
+func dirExists(fs Storage, path string) bool {
+	fileInfo, err := fs.Stat(path)
 	if err == nil {
 		return fileInfo.IsDir()
 	}
@@ -14,10 +18,85 @@ func dirExists(path string) bool {
 }
 
 // fileExists returns true or false
-func fileExists(path string) bool {
-	fileInfo, err := os.Stat(path)
+func fileExists(fs Storage, path string) bool {
+	fileInfo, err := fs.Stat(path)
 	if err == nil {
 		return !fileInfo.IsDir()
 	}
 	return false
 }
+
+// fileSize returns the size of the file in bytes, or -1 if it can't be determined
+func fileSize(fs Storage, path string) int64 {
+	fileInfo, err := fs.Stat(path)
+	if err == nil {
+		return fileInfo.Size()
+	}
+	return -1
+}
+
+// checkName returns an error if name can't be the name of a queue.  The
+// name is the queue's directory within dirPath, so it must be a single path
+// element that can't lead outside of dirPath.
+func checkName(name string) error {
+	if len(name) == 0 {
+		return errors.New("the queue name requires a value")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return errors.New("the queue name must not contain a path separator: " + name)
+	}
+	if name == "." || name == ".." {
+		return errors.New("the queue name must not be " + name)
+	}
+	return nil
+}
+
+// absDir returns dirPath as an absolute path when the queue is kept on the
+// local filesystem, so the queue doesn't move if the process changes its
+// working directory while the queue is open.
+func absDir(fs Storage, dirPath string) (string, error) {
+	if _, ok := fs.(osStorage); !ok {
+		return dirPath, nil
+	}
+	abs, err := filepath.Abs(dirPath)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find the absolute path of the queue directory "+dirPath)
+	}
+	return abs, nil
+}
+
+// closeErrors collects the errors of the steps of closing something that
+// carries on past a failed step.
+type closeErrors []error
+
+// add collects err if it isn't nil.
+func (e *closeErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// err returns nil if no error was collected, the error itself if only one
+// was, or else the collected errors.
+func (e closeErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+func (e closeErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the first error, so errors.Is and errors.As find it.
+func (e closeErrors) Unwrap() error {
+	return e[0]
+}